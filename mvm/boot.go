@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/MixinNetwork/mixin/logger"
 	"github.com/MixinNetwork/nfo/mtg"
@@ -16,6 +21,7 @@ import (
 	"github.com/MixinNetwork/trusted-group/mvm/machine"
 	"github.com/MixinNetwork/trusted-group/mvm/quorum"
 	"github.com/MixinNetwork/trusted-group/mvm/rpc"
+	"github.com/MixinNetwork/trusted-group/mvm/solana"
 	"github.com/MixinNetwork/trusted-group/mvm/store"
 	"github.com/fox-one/mixin-sdk-go"
 	"github.com/urfave/cli/v2"
@@ -23,7 +29,8 @@ import (
 
 func bootCmd(c *cli.Context) error {
 	logger.SetLevel(logger.VERBOSE)
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	cp := c.String("config")
 	if strings.HasPrefix(cp, "~/") {
@@ -46,17 +53,6 @@ func bootCmd(c *cli.Context) error {
 	}
 	defer db.Close()
 
-	go func() {
-		if c.Int("port") < 1000 {
-			return
-		}
-		server := rpc.NewServer(db, conf, c.Int("port"))
-		err := server.ListenAndServe()
-		if err != nil {
-			panic(err)
-		}
-	}()
-
 	go func() {
 		if !c.Bool("profile") {
 			return
@@ -69,6 +65,10 @@ func bootCmd(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	multisig, err := machine.NewMultisigGroup(group, db, conf.MTG)
+	if err != nil {
+		return err
+	}
 
 	s := &mixin.Keystore{
 		ClientID:   conf.Messenger.UserId,
@@ -84,32 +84,95 @@ func bootCmd(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	im, err := machine.Boot(conf.Machine, group, db, messenger, mixin)
+	im, err := machine.Boot(ctx, conf.Machine, multisig, db, messenger, mixin)
 	if err != nil {
 		return err
 	}
 
+	// the engines close after their loops finish, so the context is canceled
+	// first in case the boot fails with some engines running
+	var engines []io.Closer
+	defer func() {
+		stop()
+		for _, en := range engines {
+			en.Close()
+		}
+	}()
+
 	if conf.Quorum != nil {
-		en, err := quorum.Boot(conf.Quorum)
+		en, err := quorum.Boot(ctx, conf.Quorum)
+		if err != nil {
+			return err
+		}
+		engines = append(engines, en)
+		err = im.AddEngine(en)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range conf.EVM {
+		en, err := quorum.Boot(ctx, c)
+		if err != nil {
+			return err
+		}
+		engines = append(engines, en)
+		err = im.AddEngine(en)
 		if err != nil {
 			return err
 		}
-		im.AddEngine(machine.ProcessPlatformQuorum, en)
 	}
 
 	if conf.EOS != nil {
-		enEOS, err := eos.Boot(conf.EOS, group.GetThreshold())
+		enEOS, err := eos.Boot(ctx, conf.EOS, group.GetThreshold())
+		if err != nil {
+			return err
+		}
+		engines = append(engines, enEOS)
+		err = im.AddEngine(enEOS)
 		if err != nil {
 			return err
 		}
-		im.AddEngine(machine.ProcessPlatformEOS, enEOS)
 	}
 
-	go im.Loop(ctx)
+	if conf.Solana != nil {
+		enSolana, err := solana.Boot(ctx, conf.Solana)
+		if err != nil {
+			return err
+		}
+		engines = append(engines, enSolana)
+		err = im.AddEngine(enSolana)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Int("port") >= 1000 {
+		server := rpc.NewServer(db, conf, im, c.Int("port"))
+		go func() {
+			err := server.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				panic(err)
+			}
+		}()
+		defer server.Shutdown(context.Background())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		im.Loop(ctx)
+		close(done)
+	}()
 
+	// the group loops never return, and the machine blocks all outputs
+	// after shutdown, so the group runs without the cancellation
 	group.SetOutputGrouper(machine.OutputGrouper)
 	group.AddWorker(im)
-	group.Run(ctx)
+	go group.Run(context.Background())
 
+	<-ctx.Done()
+	stop()
+	logger.Printf("bootCmd() => shutting down")
+	<-done
 	return nil
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/MixinNetwork/trusted-group/mvm/config"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/gofrs/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/urfave/cli/v2"
+)
+
+func haltProcessCmd(c *cli.Context) error {
+	op := &encoding.Operation{
+		Purpose: encoding.OperationPurposeHaltProcess,
+		Process: c.String("process"),
+	}
+	return voteGroupCommand(c, op)
+}
+
+func evolveProcessCmd(c *cli.Context) error {
+	if c.String("address") == "" {
+		return fmt.Errorf("invalid next address")
+	}
+	op := &encoding.Operation{
+		Purpose: encoding.OperationPurposeEvolveProcess,
+		Process: c.String("process"),
+		Address: c.String("address"),
+	}
+	return voteGroupCommand(c, op)
+}
+
+// voteGroupCommand sends the vote from the member app of the node, so the
+// command is approved when the threshold members voted the same one
+func voteGroupCommand(c *cli.Context, op *encoding.Operation) error {
+	ctx := context.Background()
+
+	conf, err := config.ReadConfiguration(c.String("config"))
+	if err != nil {
+		return err
+	}
+	id, err := uuid.FromString(op.Process)
+	if err != nil || id == uuid.Nil {
+		return fmt.Errorf("invalid process %s", op.Process)
+	}
+
+	s := &mixin.Keystore{
+		ClientID:   conf.MTG.App.ClientId,
+		SessionID:  conf.MTG.App.SessionId,
+		PrivateKey: conf.MTG.App.PrivateKey,
+		PinToken:   conf.MTG.App.PinToken,
+	}
+	client, err := mixin.NewFromKeystore(s)
+	if err != nil {
+		return err
+	}
+
+	trace, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	input := &mixin.TransferInput{
+		AssetID: conf.Machine.ProcessFeeAsset,
+		Amount:  decimal.NewFromFloat(0.00000001),
+		TraceID: trace.String(),
+	}
+	input.OpponentMultisig.Receivers = conf.MTG.Genesis.Members
+	input.OpponentMultisig.Threshold = uint8(conf.MTG.Genesis.Threshold)
+	input.Memo = base64.RawURLEncoding.EncodeToString(op.Encode())
+	tx, err := client.Transaction(ctx, input, conf.MTG.App.PIN)
+	if err != nil {
+		return err
+	}
+	fmt.Println(*tx)
+	return nil
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -11,6 +12,7 @@ import (
 	"github.com/MixinNetwork/trusted-group/mvm/eos"
 	"github.com/MixinNetwork/trusted-group/mvm/machine"
 	"github.com/MixinNetwork/trusted-group/mvm/quorum"
+	"github.com/MixinNetwork/trusted-group/mvm/solana"
 	"github.com/pelletier/go-toml"
 )
 
@@ -18,7 +20,9 @@ type Configuration struct {
 	MTG       *mtg.Configuration            `toml:"mtg"`
 	Machine   *machine.Configuration        `toml:"machine"`
 	Quorum    *quorum.Configuration         `toml:"quorum"`
+	EVM       []*quorum.Configuration       `toml:"evm"`
 	EOS       *eos.Configuration            `toml:"eos"`
+	Solana    *solana.Configuration         `toml:"solana"`
 	Messenger *messenger.MixinConfiguration `toml:"messenger"`
 }
 
@@ -33,5 +37,51 @@ func ReadConfiguration(path string) (*Configuration, error) {
 	}
 	var conf Configuration
 	err = toml.Unmarshal(f, &conf)
-	return &conf, err
+	if err != nil {
+		return nil, err
+	}
+	if conf.Machine != nil && conf.Machine.Member == "" && conf.Messenger != nil {
+		conf.Machine.Member = conf.Messenger.UserId
+	}
+	// the evm chains are the platforms evm-1, evm-137 etc. by default
+	for _, c := range conf.EVM {
+		if c.Platform == "" {
+			c.Platform = fmt.Sprintf("evm-%d", c.ChainId)
+		}
+	}
+	err = conf.checkPlatforms()
+	if err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// checkPlatforms rejects the engines of the same platform, only the first
+// one could be added to the machine
+func (conf *Configuration) checkPlatforms() error {
+	var platforms []string
+	if conf.Quorum != nil {
+		platform := conf.Quorum.Platform
+		if platform == "" {
+			platform = machine.ProcessPlatformQuorum
+		}
+		platforms = append(platforms, platform)
+	}
+	for _, c := range conf.EVM {
+		platforms = append(platforms, c.Platform)
+	}
+	if conf.EOS != nil {
+		platforms = append(platforms, machine.ProcessPlatformEOS)
+	}
+	if conf.Solana != nil {
+		platforms = append(platforms, solana.Platform)
+	}
+	filter := make(map[string]bool)
+	for _, p := range platforms {
+		if filter[p] {
+			return fmt.Errorf("duplicated engine platform %s", p)
+		}
+		filter[p] = true
+	}
+	return nil
 }
@@ -0,0 +1,54 @@
+package encoding
+
+import (
+	"fmt"
+
+	"github.com/gofrs/uuid"
+)
+
+const (
+	// CollectibleAsset is the asset of the collectible events, the amount is
+	// always 1 and the extra is the encoded collectible. The parsers of the
+	// fungible events decode them as usual, and tell them by the asset.
+	CollectibleAsset = "8037f184-e386-33e1-982a-d8f49a76282a"
+)
+
+// Collectible is the extra of the collectible events
+//
+// token || hash || extra
+type Collectible struct {
+	Token string
+	Hash  []byte
+	Extra []byte
+}
+
+func (e *Event) IsCollectible() bool {
+	return e.Asset == CollectibleAsset
+}
+
+func (c *Collectible) Encode() []byte {
+	token, err := uuid.FromString(c.Token)
+	if err != nil {
+		panic(err)
+	}
+	if len(c.Hash) != 32 {
+		panic(c.Hash)
+	}
+	b := append(token.Bytes(), c.Hash...)
+	return append(b, c.Extra...)
+}
+
+func DecodeCollectible(b []byte) (*Collectible, error) {
+	if len(b) < 48 {
+		return nil, fmt.Errorf("invalid collectible size %d", len(b))
+	}
+	token, err := uuid.FromBytes(b[:16])
+	if err != nil {
+		return nil, err
+	}
+	return &Collectible{
+		Token: token.String(),
+		Hash:  b[16:48],
+		Extra: b[48:],
+	}, nil
+}
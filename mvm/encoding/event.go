@@ -17,7 +17,7 @@ import (
 type Event struct {
 	Process   string
 	Asset     string
-	Members   []string // need to do user mask per process
+	Members   []string // masked per process, see machine.MaskUserId
 	Threshold int
 	Amount    common.Integer
 	Extra     []byte
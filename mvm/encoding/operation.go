@@ -7,6 +7,8 @@ const (
 	OperationPurposeGroupEvent    = 1
 	OperationPurposeAddProcess    = 11
 	OperationPurposeCreditProcess = 12
+	OperationPurposeHaltProcess   = 21
+	OperationPurposeEvolveProcess = 22
 )
 
 type Operation struct {
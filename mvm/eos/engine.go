@@ -2,6 +2,7 @@ package eos
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -10,6 +11,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -17,6 +19,8 @@ import (
 	"github.com/MixinNetwork/mixin/common"
 	"github.com/MixinNetwork/mixin/logger"
 	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/MixinNetwork/trusted-group/mvm/metrics"
 	"github.com/dgraph-io/badger/v3"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/learnforpractice/goeoslib/chain"
@@ -79,13 +83,14 @@ type Engine struct {
 	eventStatus          map[uint64]time.Time
 	startBlockNum        uint64
 	extraRequestClient   *http.Client
+	loops                *sync.WaitGroup
 }
 
 type ExtendedAction struct {
 	Data string `json:"data"`
 }
 
-func Boot(conf *Configuration, threshold int) (*Engine, error) {
+func Boot(ctx context.Context, conf *Configuration, threshold int) (*Engine, error) {
 	if threshold <= 0 {
 		panic(fmt.Errorf("invalid threshold value %d", threshold))
 	}
@@ -176,19 +181,56 @@ func Boot(conf *Configuration, threshold int) (*Engine, error) {
 		eventStatus:          make(map[uint64]time.Time),
 		startBlockNum:        conf.StartBlockNum,
 		extraRequestClient:   client,
+		loops:                new(sync.WaitGroup),
 	}
 
 	if e.key != nil {
 		chain.GetWallet().Import("mywallet", conf.PrivateKey)
 	}
 
-	e.syncNetwork()
-	go e.loopCheckNetworkStatus()
-	go e.loopHandleContracts()
-	go e.loopContractEvents()
+	e.syncNetwork(ctx)
+	e.spawn(func() { e.loopCheckNetworkStatus(ctx) })
+	e.spawn(func() { e.loopHandleContracts(ctx) })
+	e.spawn(func() { e.loopContractEvents(ctx) })
 	return e, nil
 }
 
+// Close waits all loops and pushing transactions to finish after the
+// boot context is done, then closes the engine database
+func (e *Engine) Close() error {
+	e.loops.Wait()
+	return e.db.Close()
+}
+
+func (e *Engine) spawn(loop func()) {
+	e.loops.Add(1)
+	go func() {
+		defer e.loops.Done()
+		loop()
+	}()
+}
+
+func (e *Engine) Platform() string {
+	return machine.ProcessPlatformEOS
+}
+
+func (e *Engine) SignType() int {
+	return machine.SignTypeSECP256K1
+}
+
+// CombineSignatures sorts and concatenates the partials, the last byte is the
+// partials count
+func (e *Engine) CombineSignatures(address string, event *encoding.Event, partials [][]byte) ([]byte, error) {
+	sort.Slice(partials, func(i, j int) bool {
+		return bytes.Compare(partials[i], partials[j]) < 0
+	})
+	var sig []byte
+	for _, partial := range partials {
+		sig = append(sig, partial...)
+	}
+	return append(sig, byte(len(partials))), nil
+}
+
 func (e *Engine) Hash(b []byte) []byte {
 	return crypto.Keccak256(b)
 }
@@ -214,7 +256,7 @@ func (e *Engine) SignEvent(address string, event *encoding.Event) []byte {
 	}
 }
 
-func (e *Engine) VerifyAddress(addr string, extra []byte) error {
+func (e *Engine) VerifyAddress(ctx context.Context, addr, pid string, extra []byte) error {
 	if addr == e.mixinContract {
 		return fmt.Errorf("Mixin contract account can not set as Process address!")
 	}
@@ -314,8 +356,8 @@ func (e *Engine) checkNetworkStatus() {
 	// logger.Verbosef("irrerversible block info: %v %v, lib time: %v", info.LastIrreversibleBlockNum, info.LastIrreversibleBlockTime, libTime.String())
 }
 
-func (e *Engine) syncNetwork() {
-	for {
+func (e *Engine) syncNetwork(ctx context.Context) {
+	for ctx.Err() == nil {
 		info, err := e.chainApiGetState.GetInfo()
 		if err != nil {
 			panic(err)
@@ -329,17 +371,17 @@ func (e *Engine) syncNetwork() {
 
 		if t.Before(time.Now().Add(-time.Second * 30)) {
 			logger.Verbosef("Network is not synced, waiting...")
-			time.Sleep(time.Second * 10)
+			sleep(ctx, time.Second*10)
 			continue
 		}
 		break
 	}
 }
 
-func (e *Engine) loopCheckNetworkStatus() {
-	for {
+func (e *Engine) loopCheckNetworkStatus(ctx context.Context) {
+	for ctx.Err() == nil {
 		e.checkNetworkStatus()
-		time.Sleep(time.Second * 3)
+		sleep(ctx, time.Second*3)
 	}
 }
 
@@ -376,12 +418,12 @@ func (e *Engine) EnsureSendGroupEvents(address string, events []*encoding.Event)
 	return e.storeWriteGroupEvents(address, events)
 }
 
-func (e *Engine) loopContractEvents() {
-	for {
+func (e *Engine) loopContractEvents(ctx context.Context) {
+	for ctx.Err() == nil {
 		err := e.PullContractEvents()
 		if err != nil {
 			if err == ErrorNotIrreversible {
-				time.Sleep(time.Second * 3)
+				sleep(ctx, time.Second*3)
 			} else {
 				logger.Verbosef("PullContractEvents return error: %v", err)
 			}
@@ -481,6 +523,7 @@ func (e *Engine) PullContractEvents() error {
 	if curBlockNum < e.startBlockNum {
 		curBlockNum = e.startBlockNum
 	}
+	metrics.EngineBlockOffset.WithLabelValues("eos").Set(float64(curBlockNum))
 	if curBlockNum%100 == 0 {
 		logger.Verbosef("+++++++++++++current block num %d", curBlockNum)
 	}
@@ -591,14 +634,14 @@ func (e *Engine) GetAddressNonce(address string) (uint64, error) {
 	return binary.LittleEndian.Uint64(b[8:]), nil
 }
 
-func (e *Engine) loopExecGroupEvents(address string) {
+func (e *Engine) loopExecGroupEvents(ctx context.Context, address string) {
 	if !e.IsExecutor() {
 		return
 	}
 
 	executor := chain.NewName(e.mtgExecutor)
 	counter := uint64(0)
-	for {
+	for ctx.Err() == nil {
 		tx := chain.NewTransaction(uint32(time.Now().Unix()) + TX_EXPIRATION)
 
 		refBlockId := e.GetRefBlockId()
@@ -624,7 +667,7 @@ func (e *Engine) loopExecGroupEvents(address string) {
 			} else {
 				logger.Verbosef("PushTransaction ret: err: %v", err)
 			}
-			time.Sleep(time.Second * 5)
+			sleep(ctx, time.Second*5)
 		} else {
 			console, err := r.GetString("processed", "action_traces", 0, "console")
 			if err != nil {
@@ -715,16 +758,16 @@ func (e *Engine) execPendingEvent(address string, nonce uint64, url string, hash
 	return nil
 }
 
-func (e *Engine) loopExecPendingEvents(address string) {
+func (e *Engine) loopExecPendingEvents(ctx context.Context, address string) {
 	if !e.IsExecutor() {
 		return
 	}
 	executedEvent := make(map[uint64]time.Time)
-	for {
+	for ctx.Err() == nil {
 		events, err := e.GetPendingEvents(address, 20)
 		logger.Verbosef("+++loopExecPendingEvents -> len(events): %v", len(events))
 		if err != nil || len(events) == 0 {
-			time.Sleep(time.Second * 3)
+			sleep(ctx, time.Second*3)
 			continue
 		}
 
@@ -734,30 +777,30 @@ func (e *Engine) loopExecPendingEvents(address string) {
 				continue
 			}
 			executedEvent[event.nonce] = time.Now()
+			event := event
 			if event.extra[0] == 1 && len(event.extra) > 33 {
 				hash := event.extra[1:33]
 				url := string(event.extra[33:])
-				go e.execPendingEvent(address, event.nonce, url, hash)
+				e.spawn(func() { e.execPendingEvent(address, event.nonce, url, hash) })
 			} else {
-				go e.execPendingEvent(address, event.nonce, "", nil)
+				e.spawn(func() { e.execPendingEvent(address, event.nonce, "", nil) })
 			}
 			count += 1
 		}
 		if count == 0 {
-			time.Sleep(time.Second * 3)
+			sleep(ctx, time.Second*3)
 		}
 	}
 }
 
-func (e *Engine) loopDoWorks(address string) {
+func (e *Engine) loopDoWorks(ctx context.Context, address string) {
 	if !e.IsExecutor() {
 		return
 	}
 
 	executor := chain.NewName(e.mtgExecutor)
 	counter := uint64(0)
-	for {
-		time.Sleep(time.Second * 5)
+	for sleep(ctx, time.Second*5) {
 		result, err := e.chainApiGetState.GetTableRows(
 			false,   //json bool,
 			address, //code string,
@@ -778,14 +821,14 @@ func (e *Engine) loopDoWorks(address string) {
 		logger.Verbosef("++++++loopDoWorks: %v", result)
 		transfers, err := result.GetArray("rows")
 		if err != nil {
-			logger.Verbosef("+++++++++err", err)
+			logger.Verbosef("+++++++++err: %v", err)
 			return
 		}
 
 		for _, transfer := range transfers {
 			raw, err := hex.DecodeString(transfer.(string))
 			if err != nil {
-				logger.Verbosef("+++++++++err", err)
+				logger.Verbosef("+++++++++err: %v", err)
 				return
 			}
 			if len(raw) < 8 {
@@ -909,8 +952,8 @@ func (e *Engine) GetPendingEvents(address string, limit int) ([]*TxEvent, error)
 	return pendingEvents, nil
 }
 
-func (e *Engine) loopPushGroupEvents(address string) {
-	for e.IsPublisher() {
+func (e *Engine) loopPushGroupEvents(ctx context.Context, address string) {
+	for e.IsPublisher() && ctx.Err() == nil {
 		nonce, err := e.GetAddressNonce(address)
 		if err != nil {
 			logger.Verbosef("+++GetAddressNonce(%v) => %v", address, err)
@@ -933,20 +976,20 @@ func (e *Engine) loopPushGroupEvents(address string) {
 			}
 			if e.eventStatus[evt.Nonce].Add(TX_EXPIRATION * time.Second).Before(time.Now()) {
 				e.eventStatus[evt.Nonce] = time.Now()
-				go e.pushEvent(address, evt, true)
+				evt := evt
+				e.spawn(func() { e.pushEvent(address, evt, true) })
 				sendCount += 1
 			}
 		}
 		if sendCount == 0 {
-			time.Sleep(ClockTick)
+			sleep(ctx, ClockTick)
 		}
 	}
 }
 
-func (e *Engine) loopHandleContracts() {
+func (e *Engine) loopHandleContracts(ctx context.Context) {
 	contracts := make(map[string]bool)
-	for {
-		time.Sleep(ClockTick)
+	for sleep(ctx, ClockTick) {
 		all, err := e.storeListContractAddresses()
 		if err != nil {
 			panic(err)
@@ -956,10 +999,11 @@ func (e *Engine) loopHandleContracts() {
 				continue
 			}
 			contracts[c] = true
-			go e.loopPushGroupEvents(c)
-			go e.loopExecGroupEvents(c)
-			go e.loopExecPendingEvents(c)
-			go e.loopDoWorks(c)
+			address := c
+			e.spawn(func() { e.loopPushGroupEvents(ctx, address) })
+			e.spawn(func() { e.loopExecGroupEvents(ctx, address) })
+			e.spawn(func() { e.loopExecPendingEvents(ctx, address) })
+			e.spawn(func() { e.loopDoWorks(ctx, address) })
 		}
 	}
 }
@@ -1,6 +1,7 @@
 package eos
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
@@ -156,3 +157,14 @@ func BuildErrorEventTransaction(eventPublisher string, address string, event *en
 	tx.Actions = append(tx.Actions, action)
 	return tx, nil
 }
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/tip/messenger"
+	"github.com/MixinNetwork/trusted-group/mvm/config"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/urfave/cli/v2"
+)
+
+// keygenCmd runs the key generation ceremony with the genesis members, all
+// members run it with the same nonce at the same time, and run it again with
+// the same dir to resume if it quits before done
+func keygenCmd(c *cli.Context) error {
+	return runKeygen(c, "keygen", func(msgr messenger.Messenger, conf *config.Configuration, path string) (*machine.Keygen, error) {
+		genesis := conf.MTG.Genesis
+		return machine.NewKeygen(msgr, genesis.Members, genesis.Threshold, conf.MTG.App.ClientId, c.Uint64("nonce"), path)
+	})
+}
+
+// reshareCmd reshares the group key of the genesis members to the new members
+// and threshold, the new members run it with the group poly and empty share
+func reshareCmd(c *cli.Context) error {
+	return runKeygen(c, "reshare", func(msgr messenger.Messenger, conf *config.Configuration, path string) (*machine.Keygen, error) {
+		poly, err := hex.DecodeString(conf.Machine.Poly)
+		if err != nil {
+			return nil, err
+		}
+		share, err := hex.DecodeString(conf.Machine.Share)
+		if err != nil {
+			return nil, err
+		}
+		genesis := conf.MTG.Genesis
+		return machine.NewReshare(msgr, genesis.Members, poly, share, c.StringSlice("members"), c.Int("threshold"), conf.MTG.App.ClientId, c.Uint64("nonce"), path)
+	})
+}
+
+func runKeygen(c *cli.Context, name string, build func(messenger.Messenger, *config.Configuration, string) (*machine.Keygen, error)) error {
+	logger.SetLevel(logger.VERBOSE)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	conf, err := config.ReadConfiguration(c.String("config"))
+	if err != nil {
+		return err
+	}
+	dir := c.String("dir")
+	if strings.HasPrefix(dir, "~/") {
+		usr, _ := user.Current()
+		dir = filepath.Join(usr.HomeDir, (dir)[2:])
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	messenger, err := messenger.NewMixinMessenger(ctx, conf.Messenger)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%d.json", name, c.Uint64("nonce")))
+	kg, err := build(messenger, conf, path)
+	if err != nil {
+		return err
+	}
+	poly, share, err := kg.Run(ctx)
+	if err != nil {
+		return err
+	}
+	if name == "keygen" {
+		fmt.Printf("[machine]\npoly = \"%s\"\nshare = \"%s\"\n", poly, share)
+		return nil
+	}
+	fmt.Printf("[machine.rotation]\npoly = \"%s\"\nshare = \"%s\"\nnonce = %d\n", poly, share, c.Uint64("switch"))
+	return nil
+}
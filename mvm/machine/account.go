@@ -17,10 +17,19 @@ func (p *Process) buildAccountSnapshot(e *encoding.Event, credit bool) *AccountS
 	if p.Identifier != e.Process {
 		panic(e.Process)
 	}
+	// the custody of the collectible token is kept as a balance of 1
+	asset := e.Asset
+	if e.IsCollectible() {
+		c, err := encoding.DecodeCollectible(e.Extra)
+		if err != nil {
+			panic(err)
+		}
+		asset = c.Token
+	}
 	return &AccountSnapshot{
 		Process: p.Identifier,
 		Nonce:   e.Nonce,
-		Asset:   e.Asset,
+		Asset:   asset,
 		Amount:  e.Amount,
 		Credit:  credit,
 	}
@@ -0,0 +1,163 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/nfo/mtg"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/fox-one/mixin-sdk-go"
+)
+
+// CollectibleToken is the token meta cached by the machine, the hash is
+// the content hash of the token
+type CollectibleToken struct {
+	Id   string
+	Hash []byte
+}
+
+// CollectibleGroup is implemented by the groups able to transfer the
+// collectibles they hold, the transaction extra is the token NFO so the
+// transfer carries no memo. The collectible events to a group without it
+// are quarantined.
+type CollectibleGroup interface {
+	BuildCollectibleTransaction(ctx context.Context, tokenId string, receivers []string, threshold int, traceId string) error
+}
+
+// CollectibleEngine is implemented by the engines whose contracts encode the
+// collectible events, the collectibles deposited to the processes of other
+// engines are refunded to the senders
+type CollectibleEngine interface {
+	SupportsCollectibles() bool
+}
+
+// WriteCollectibleEvent makes the collectible event owned by the senders of
+// the output, the process custody of the token is kept as a balance of 1.
+// The output can't be refunded without the amount 1 or the valid senders, so
+// it's quarantined for the operator.
+func (m *Machine) WriteCollectibleEvent(ctx context.Context, op *encoding.Operation, out *mtg.CollectibleOutput) {
+	if out.Amount != "1" {
+		m.quarantineOutput(op.Process, out.OutputId, fmt.Errorf("%w: collectible amount %s", ErrorInvalidEvent, out.Amount))
+		return
+	}
+	members, err := sortGroupEventOwners(out.Senders, int(out.SendersThreshold))
+	if err != nil {
+		m.quarantineOutput(op.Process, out.OutputId, fmt.Errorf("%w: collectible senders %v", ErrorInvalidEvent, err))
+		return
+	}
+	threshold := int(out.SendersThreshold)
+	// the refunds may take long, so they are not blocking the process readers
+	proc := m.getProcess(op.Process)
+	if proc == nil {
+		m.refundCollectibleOutput(ctx, op.Process, out, members, threshold, "PROCESS")
+		return
+	}
+	if ce, ok := m.engines[proc.Platform].(CollectibleEngine); !ok || !ce.SupportsCollectibles() {
+		m.refundCollectibleOutput(ctx, op.Process, out, members, threshold, "ENGINE")
+		return
+	}
+
+	m.procLock.RLock()
+	defer m.procLock.RUnlock()
+
+	err = m.retryOutput(m.procLock.RLocker(), "WriteCollectibleEvent", func() error {
+		return m.writeCollectibleEvent(ctx, proc, out, op.Extra, members, threshold)
+	})
+	if err != nil {
+		m.quarantineOutput(proc.Identifier, out.OutputId, err)
+	}
+}
+
+func (m *Machine) writeCollectibleEvent(ctx context.Context, proc *Process, out *mtg.CollectibleOutput, extra []byte, members []string, threshold int) error {
+	done, err := m.store.CheckPendingGroupEventIdentifier(out.OutputId)
+	if err != nil || done {
+		return err
+	}
+	token, err := m.fetchCollectibleToken(ctx, out.TokenId)
+	if err != nil {
+		return err
+	}
+	members, err = m.maskGroupEventMembers(proc, members)
+	if err != nil {
+		return err
+	}
+
+	c := &encoding.Collectible{Token: token.Id, Hash: token.Hash, Extra: extra}
+	evt := &encoding.Event{
+		Process:   proc.Identifier,
+		Asset:     encoding.CollectibleAsset,
+		Members:   members,
+		Threshold: threshold,
+		Amount:    common.NewInteger(1),
+		Extra:     c.Encode(),
+		Timestamp: uint64(out.CreatedAt.UnixNano()),
+		Nonce:     proc.Nonce,
+	}
+	as := proc.buildAccountSnapshot(evt, true)
+	err = m.store.WriteAccountSnapshot(as)
+	if err != nil {
+		return err
+	}
+	err = m.store.WritePendingGroupEventAndNonce(evt, out.OutputId, proc.SignType())
+	if err != nil {
+		return err
+	}
+	proc.Nonce = proc.Nonce + 1
+	return nil
+}
+
+// refundCollectibleOutput sends the collectible not accepted back to the
+// senders, the trace id is derived from the output as the fungible refunds
+func (m *Machine) refundCollectibleOutput(ctx context.Context, pid string, out *mtg.CollectibleOutput, members []string, threshold int, reason string) {
+	cg, ok := m.group.(CollectibleGroup)
+	if !ok {
+		logger.Printf("refundCollectibleOutput(%s, %s, %s) => group not supported", out.OutputId, out.TokenId, reason)
+		return
+	}
+	traceId := mixin.UniqueConversationID(out.OutputId, "REFUND")
+	logger.Printf("refundCollectibleOutput(%s, %s, %s) => %v %s", out.OutputId, out.TokenId, reason, members, traceId)
+	err := m.retryOutput(nil, "BuildCollectibleRefundTransaction", func() error {
+		return cg.BuildCollectibleTransaction(ctx, out.TokenId, members, threshold, traceId)
+	})
+	if err != nil {
+		m.quarantineOutput(pid, out.OutputId, err)
+	}
+}
+
+func (m *Machine) fetchCollectibleToken(ctx context.Context, id string) (*CollectibleToken, error) {
+	old, err := m.store.ReadCollectibleToken(id)
+	if err != nil || old != nil {
+		return old, err
+	}
+	token, err := m.mixin.ReadCollectiblesToken(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	ct := &CollectibleToken{Id: id, Hash: token.Meta.Hash[:]}
+	return ct, m.store.WriteCollectibleToken(ct)
+}
+
+func checkCollectibleEvent(evt *encoding.Event) error {
+	if evt.Amount.Cmp(common.NewInteger(1)) != 0 {
+		return fmt.Errorf("%w: collectible amount %s", ErrorInvalidEvent, evt.Amount)
+	}
+	_, err := encoding.DecodeCollectible(evt.Extra)
+	if err != nil {
+		return fmt.Errorf("%w: collectible %v", ErrorInvalidEvent, err)
+	}
+	return nil
+}
+
+func buildCollectibleTransaction(ctx context.Context, group Group, evt *encoding.Event, traceId string) error {
+	cg, ok := group.(CollectibleGroup)
+	if !ok {
+		return poisonEventError(QuarantineStageReceive, evt, fmt.Errorf("%w: group collectible transactions not supported", ErrorInvalidEvent))
+	}
+	c, err := encoding.DecodeCollectible(evt.Extra)
+	if err != nil {
+		panic(err)
+	}
+	return cg.BuildCollectibleTransaction(ctx, c.Token, evt.Members, evt.Threshold, traceId)
+}
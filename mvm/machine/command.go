@@ -0,0 +1,330 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/nfo/mtg"
+	"github.com/MixinNetwork/tip/crypto"
+	"github.com/MixinNetwork/tip/crypto/en256"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/drand/kyber/sign/tbls"
+	"github.com/fox-one/mixin-sdk-go"
+)
+
+const (
+	// CommandProcess is the pseudo process of the group command messages,
+	// the message asset is the command process and the extra is the id
+	CommandProcess = "00000000-0000-0000-0000-000000000001"
+
+	GroupCommandHalt   = 1
+	GroupCommandEvolve = 2
+)
+
+var (
+	commandPeriod = time.Minute
+)
+
+// GroupCommand is voted by the group members with their outputs, and signed
+// by the group once the threshold members voted. The command acts on the
+// target contract of the process, and evolve switches it to the next one.
+type GroupCommand struct {
+	Id        string   `json:"id"`
+	Process   string   `json:"process"`
+	Kind      int      `json:"kind"`
+	Target    string   `json:"target"`
+	Next      string   `json:"next"`
+	Voters    []string `json:"voters"`
+	Approved  bool     `json:"approved"`
+	Nonce     uint64   `json:"nonce"`
+	Partials  [][]byte `json:"partials"`
+	Signature []byte   `json:"signature"`
+	Done      bool     `json:"done"`
+}
+
+// VoteGroupCommand records the vote of the member who sent the output, the
+// halt stops sending events at once when approved, before signed
+func (m *Machine) VoteGroupCommand(ctx context.Context, op *encoding.Operation, out *mtg.Output) {
+	if !m.isGroupMember(out.Sender) {
+		logger.Verbosef("VoteGroupCommand(%s, %d) => sender %s", op.Process, op.Purpose, out.Sender)
+		return
+	}
+	if op.Purpose == encoding.OperationPurposeEvolveProcess && !m.verifyEvolveAddress(op) {
+		return
+	}
+	m.procLock.Lock()
+	defer m.procLock.Unlock()
+
+	proc := m.processes[op.Process]
+	if proc == nil {
+		logger.Verbosef("VoteGroupCommand(%s, %d) => process not found", op.Process, op.Purpose)
+		return
+	}
+	if _, ok := m.engines[proc.Platform].(GroupCommander); !ok {
+		logger.Verbosef("VoteGroupCommand(%s, %d) => engine %s", op.Process, op.Purpose, proc.Platform)
+		return
+	}
+	c := &GroupCommand{Process: proc.Identifier, Target: proc.Address}
+	switch op.Purpose {
+	case encoding.OperationPurposeHaltProcess:
+		c.Kind = GroupCommandHalt
+	case encoding.OperationPurposeEvolveProcess:
+		if op.Address == "" || op.Address == proc.Address {
+			logger.Verbosef("VoteGroupCommand(%s, %d) => address %s", op.Process, op.Purpose, op.Address)
+			return
+		}
+		c.Kind, c.Next = GroupCommandEvolve, op.Address
+	default:
+		panic(op.Purpose)
+	}
+	c.Id = groupCommandId(c)
+
+	err := m.retryOutput(m.procLock, "WriteGroupCommandVote", func() error {
+		return m.writeGroupCommandVote(proc, c, out.Sender)
+	})
+	if err != nil {
+		m.quarantineOutput(proc.Identifier, out.UTXOID, err)
+	}
+}
+
+// verifyEvolveAddress checks the next contract is deployed for the process,
+// otherwise the process would send events to a contract it doesn't own, e.g.
+// the next registry contract with another PID. The engine is called without
+// the process lock just like adding the process.
+func (m *Machine) verifyEvolveAddress(op *encoding.Operation) bool {
+	proc := m.getProcess(op.Process)
+	if proc == nil || op.Address == "" {
+		return true
+	}
+	commander, ok := m.engines[proc.Platform].(GroupCommander)
+	if !ok {
+		return true
+	}
+	address, _ := m.readProcessState(proc)
+	err := m.retryEngine("VerifyEvolveAddress", func() error {
+		return commander.VerifyEvolveAddress(m.ctx, address, op.Address)
+	})
+	if err != nil {
+		logger.Verbosef("VoteGroupCommand(%s, %d) => VerifyEvolveAddress(%s) => %v", op.Process, op.Purpose, op.Address, err)
+		return false
+	}
+	return true
+}
+
+func (m *Machine) writeGroupCommandVote(proc *Process, c *GroupCommand, voter string) error {
+	old, err := m.store.ReadGroupCommand(c.Id)
+	if err != nil {
+		return err
+	} else if old != nil {
+		c = old
+	}
+	if c.Approved {
+		return nil
+	}
+	for _, v := range c.Voters {
+		if v == voter {
+			return nil
+		}
+	}
+	c.Voters = append(c.Voters, voter)
+	if len(c.Voters) >= m.group.GetThreshold() {
+		c.Approved, c.Nonce = true, proc.Nonce
+		logger.Printf("VoteGroupCommand(%s, %d, %s, %s) => approved", c.Process, c.Kind, c.Target, c.Next)
+	}
+	if c.Approved && c.Kind == GroupCommandHalt {
+		err = m.store.WriteProcessState(proc.Identifier, proc.Address, true)
+		if err != nil {
+			return err
+		}
+		proc.Halted = true
+	}
+	return m.store.WriteGroupCommand(c)
+}
+
+func (m *Machine) loopGroupCommands(ctx context.Context) {
+	sent := make(map[string]time.Time)
+	for sleep(ctx, loopInterval) {
+		commands, err := m.store.ListGroupCommands()
+		if err != nil {
+			logger.Printf("ListGroupCommands() => %v", err)
+			continue
+		}
+		for _, c := range commands {
+			if !c.Approved || c.Done {
+				continue
+			}
+			if c.Signature == nil {
+				if time.Since(sent[c.Id]) < commandPeriod {
+					continue
+				}
+				err = m.signGroupCommand(ctx, c)
+				logger.Verbosef("signGroupCommand(%s) => %v", c.Id, err)
+				if err == nil {
+					sent[c.Id] = time.Now()
+				}
+				continue
+			}
+			_, err = runStep("executeGroupCommand", func() (time.Duration, error) {
+				return 0, m.executeGroupCommand(c)
+			})
+			if err != nil {
+				logger.Printf("executeGroupCommand(%s, %d, %s) => %v", c.Process, c.Kind, c.Target, err)
+			}
+		}
+	}
+}
+
+func (m *Machine) signGroupCommand(ctx context.Context, c *GroupCommand) error {
+	msg, err := m.encodeGroupCommand(c)
+	if err != nil {
+		return err
+	}
+	key := m.groupKey(c.Nonce)
+	if key.share == nil {
+		return nil
+	}
+	scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
+	partial, err := scheme.Sign(key.share, msg)
+	if err != nil {
+		return err
+	}
+	err = m.appendGroupCommandPartial(c.Id, msg, partial)
+	if err != nil {
+		return err
+	}
+	evt := &encoding.Event{
+		Process:   CommandProcess,
+		Asset:     c.Process,
+		Amount:    common.Zero,
+		Extra:     []byte(c.Id),
+		Signature: partial,
+	}
+	return m.queueMessage(ctx, m.group.GetMembers(), MessageTypePartial, evt)
+}
+
+func (m *Machine) handleCommandMessage(peer string, evt *encoding.Event) error {
+	c, err := m.store.ReadGroupCommand(string(evt.Extra))
+	if err != nil || c == nil || !c.Approved || c.Signature != nil {
+		return err
+	}
+	msg, err := m.encodeGroupCommand(c)
+	if err != nil {
+		return nil
+	}
+	key := m.groupKey(c.Nonce)
+	err = m.verifyPeerPartial(peer, key, msg, evt.Signature)
+	if err != nil {
+		m.recordPeerMisbehavior(peer, PeerMisbehaviorInvalidPartial, evt, err)
+		return nil
+	}
+	return m.appendGroupCommandPartial(c.Id, msg, evt.Signature)
+}
+
+func (m *Machine) appendGroupCommandPartial(id string, msg, partial []byte) error {
+	m.signerLock.Lock()
+	defer m.signerLock.Unlock()
+
+	c, err := m.store.ReadGroupCommand(id)
+	if err != nil || c.Signature != nil {
+		return err
+	}
+	if checkSignedWith(c.Partials, partial) {
+		return nil
+	}
+	key := m.groupKey(c.Nonce)
+	c.Partials = validPartials(key, msg, append(c.Partials, partial))
+	if len(c.Partials) >= key.threshold {
+		sig, err := recoverSignature(key, msg, c.Partials)
+		if err != nil {
+			return err
+		}
+		err = crypto.Verify(key.poly.Commit(), msg, sig)
+		if err != nil {
+			return err
+		}
+		c.Signature = sig
+		logger.Printf("appendGroupCommandPartial(%s, %d) => %x", c.Process, c.Kind, sig)
+	}
+	return m.store.WriteGroupCommand(c)
+}
+
+// executeGroupCommand sends the signed command until it takes effect, then
+// the evolved process is switched to the next contract and resumed
+func (m *Machine) executeGroupCommand(c *GroupCommand) error {
+	proc := m.getProcess(c.Process)
+	if proc == nil {
+		return fmt.Errorf("process %s not found", c.Process)
+	}
+	commander := m.engines[proc.Platform].(GroupCommander)
+	done, err := commander.ExecuteGroupCommand(c.Target, c)
+	if err != nil || !done {
+		return err
+	}
+	if c.Kind == GroupCommandEvolve {
+		err = m.evolveProcess(proc, c.Next)
+		if err != nil {
+			return err
+		}
+	}
+	c.Done = true
+	logger.Printf("executeGroupCommand(%s, %d, %s, %s) => done", c.Process, c.Kind, c.Target, c.Next)
+	return m.store.WriteGroupCommand(c)
+}
+
+func (m *Machine) evolveProcess(proc *Process, next string) error {
+	if address, _ := m.readProcessState(proc); address == next {
+		return nil
+	}
+	// the notifier is setup by the RPC, so not with the process lock
+	err := m.engines[proc.Platform].SetupNotifier(next)
+	if err != nil {
+		return err
+	}
+
+	m.procLock.Lock()
+	defer m.procLock.Unlock()
+
+	err = m.store.WriteProcessState(proc.Identifier, next, false)
+	if err != nil {
+		return err
+	}
+	proc.Address, proc.Halted = next, false
+	return nil
+}
+
+func (m *Machine) encodeGroupCommand(c *GroupCommand) ([]byte, error) {
+	proc := m.getProcess(c.Process)
+	if proc == nil {
+		return nil, fmt.Errorf("process %s not found", c.Process)
+	}
+	commander, ok := m.engines[proc.Platform].(GroupCommander)
+	if !ok {
+		return nil, fmt.Errorf("engine %s not commander", proc.Platform)
+	}
+	return commander.EncodeGroupCommand(c)
+}
+
+func (m *Machine) isGroupMember(id string) bool {
+	for _, member := range m.group.GetMembers() {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+// readProcessState returns the contract address and whether the process
+// is halted, both may be changed by the group commands
+func (m *Machine) readProcessState(p *Process) (string, bool) {
+	m.procLock.RLock()
+	defer m.procLock.RUnlock()
+
+	return p.Address, p.Halted
+}
+
+func groupCommandId(c *GroupCommand) string {
+	return mixin.UniqueConversationID(c.Process, fmt.Sprintf("COMMAND:%d:%s:%s", c.Kind, c.Target, c.Next))
+}
@@ -0,0 +1,304 @@
+package machine
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/tip/crypto/en256"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/metrics"
+	"github.com/drand/kyber/share"
+	"github.com/drand/kyber/sign/tbls"
+	"github.com/gofrs/uuid"
+)
+
+const (
+	MessageVersion = 1
+
+	MessageTypePartial          = 1
+	MessageTypeFull             = 2
+	MessageTypeSignatureRequest = 3
+	MessageTypeSyncRequest      = 4
+	MessageTypeSyncResponse     = 5
+
+	// the legacy message is the event followed by the 8 bytes timestamp,
+	// whose highest bit tells the sender accepts the envelope, and the old
+	// nodes just ignore the timestamp
+	legacyEnvelopeFlag = uint64(1) << 63
+
+	// the envelope out of the timestamp skew is a replay, or from a peer with
+	// a wrong clock, and it's dropped without a misbehavior record
+	messageSkew = 10 * time.Minute
+)
+
+var (
+	messageMagic = []byte{0x4d, 0x56, 0x4d, 0xe0}
+
+	errStaleMessage = errors.New("stale message")
+)
+
+// Message is the envelope of the group messages among the members, the
+// payload is the event encoding, and the auth is the TBLS partial of the
+// sender over the message without auth, i.e.
+// magic || version || type || sender || timestamp || payload || auth
+type Message struct {
+	Version   int
+	Type      int
+	Sender    string
+	Timestamp uint64
+	Payload   []byte
+	Auth      []byte
+}
+
+func (msg *Message) Encode() []byte {
+	enc := common.NewEncoder()
+	enc.Write(msg.body())
+	enc.WriteInt(len(msg.Auth))
+	enc.Write(msg.Auth)
+	return enc.Bytes()
+}
+
+// Sign sets the auth by the TBLS partial of the share
+func (msg *Message) Sign(s *share.PriShare) error {
+	scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
+	auth, err := scheme.Sign(s, msg.body())
+	if err != nil {
+		return err
+	}
+	msg.Auth = auth
+	return nil
+}
+
+func (msg *Message) body() []byte {
+	enc := common.NewEncoder()
+	enc.Write(messageMagic)
+	enc.WriteInt(msg.Version)
+	enc.WriteInt(msg.Type)
+	enc.Write(uuid.FromStringOrNil(msg.Sender).Bytes())
+	enc.WriteUint64(msg.Timestamp)
+	enc.WriteInt(len(msg.Payload))
+	enc.Write(msg.Payload)
+	return enc.Bytes()
+}
+
+// DecodeMessage decodes both the envelope and the legacy message, the type of
+// the legacy message is inferred by the signature length, and the sender is
+// left empty to fill by the messenger peer
+func DecodeMessage(b []byte) (*Message, *encoding.Event, error) {
+	if !bytes.HasPrefix(b, messageMagic) {
+		return decodeLegacyMessage(b)
+	}
+	msg, evt, err := decodeEnvelope(b)
+	if err != nil {
+		// the legacy event may have the same process prefix as the magic
+		return decodeLegacyMessage(b)
+	}
+	return msg, evt, nil
+}
+
+func decodeEnvelope(b []byte) (*Message, *encoding.Event, error) {
+	dec := common.NewDecoder(b[len(messageMagic):])
+	version, err := dec.ReadInt()
+	if err != nil {
+		return nil, nil, err
+	}
+	if version != MessageVersion {
+		return nil, nil, fmt.Errorf("invalid message version %d", version)
+	}
+	typ, err := dec.ReadInt()
+	if err != nil {
+		return nil, nil, err
+	}
+	if typ < MessageTypePartial || typ > MessageTypeSyncResponse {
+		return nil, nil, fmt.Errorf("invalid message type %d", typ)
+	}
+	sender := make([]byte, 16)
+	err = dec.Read(sender)
+	if err != nil {
+		return nil, nil, err
+	}
+	ts, err := dec.ReadUint64()
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := dec.ReadBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	auth, err := dec.ReadBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	evt, err := encoding.DecodeEvent(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := &Message{
+		Version:   version,
+		Type:      typ,
+		Sender:    uuid.FromBytesOrNil(sender).String(),
+		Timestamp: ts,
+		Payload:   payload,
+		Auth:      auth,
+	}
+	return msg, evt, nil
+}
+
+func decodeLegacyMessage(b []byte) (*Message, *encoding.Event, error) {
+	if len(b) < 8 {
+		return nil, nil, fmt.Errorf("invalid message size %d", len(b))
+	}
+	evt, err := encoding.DecodeEvent(b[:len(b)-8])
+	if err != nil {
+		return nil, nil, err
+	}
+	msg := &Message{
+		Type:      MessageTypePartial,
+		Timestamp: binary.BigEndian.Uint64(b[len(b)-8:]),
+		Payload:   b[:len(b)-8],
+	}
+	if len(evt.Signature) == 64 {
+		msg.Type = MessageTypeFull
+	}
+	return msg, evt, nil
+}
+
+// buildMessage encodes the event in the envelope if all receivers accept it,
+// otherwise in the legacy format
+func (m *Machine) buildMessage(envelope bool, typ int, evt *encoding.Event) []byte {
+	now := uint64(time.Now().UnixNano())
+	if !envelope {
+		ts := make([]byte, 8)
+		binary.BigEndian.PutUint64(ts, now|legacyEnvelopeFlag)
+		return append(evt.Encode(), ts...)
+	}
+	msg := &Message{
+		Version:   MessageVersion,
+		Type:      typ,
+		Sender:    m.self,
+		Timestamp: now,
+		Payload:   evt.Encode(),
+	}
+	err := msg.Sign(m.authKey().share)
+	if err != nil {
+		panic(err)
+	}
+	return msg.Encode()
+}
+
+// verifyMessage checks the envelope is sent by the messenger peer and signed
+// by its share of the group, or of the rotation if it joins the new group.
+// The legacy message is not authenticated, so it's rejected once the peer
+// sent the envelope, which never sends the legacy message again. But the sync
+// messages are always sent in the envelope, even to the peers still receiving
+// the legacy messages, so they only tell the peer accepts the envelope.
+func (m *Machine) verifyMessage(peer string, msg *Message) error {
+	m.peerLock.RLock()
+	enveloped := m.enveloped[peer]
+	m.peerLock.RUnlock()
+
+	if msg.Version == 0 {
+		if enveloped {
+			return fmt.Errorf("legacy message from the envelope peer %s", peer)
+		}
+		if msg.Timestamp&legacyEnvelopeFlag != 0 {
+			m.markPeerEnvelope(peer, false)
+		}
+		return nil
+	}
+	if msg.Sender != peer {
+		return fmt.Errorf("invalid message sender %s %s", msg.Sender, peer)
+	}
+	ts := time.Unix(0, int64(msg.Timestamp))
+	if skew := time.Since(ts); skew > messageSkew || skew < -messageSkew {
+		return fmt.Errorf("%w: %s %s", errStaleMessage, peer, ts)
+	}
+	key, i, err := m.verifyMessageAuth(peer, msg)
+	if err != nil {
+		return err
+	}
+	err = m.bindPeerIndex(key, peer, i)
+	if err != nil {
+		return err
+	}
+	sync := msg.Type == MessageTypeSyncRequest || msg.Type == MessageTypeSyncResponse
+	m.markPeerEnvelope(peer, !sync)
+	return nil
+}
+
+// verifyMessageAuth returns the key of the peer share signed the auth, and
+// the share index
+func (m *Machine) verifyMessageAuth(peer string, msg *Message) (*groupKey, int, error) {
+	scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
+	i, err := scheme.IndexOf(msg.Auth)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := []*groupKey{m.key}
+	if m.rotation != nil {
+		keys = append(keys, m.rotation.key)
+	}
+	err = fmt.Errorf("invalid message auth index %d", i)
+	for _, key := range keys {
+		if !key.hasMember(peer) || i < 0 || i >= len(key.members) {
+			continue
+		}
+		err = scheme.VerifyPartial(key.poly, msg.body(), msg.Auth)
+		if err == nil {
+			return key, i, nil
+		}
+	}
+	return nil, 0, err
+}
+
+func (m *Machine) checkPeerEnvelope(peer string) bool {
+	m.peerLock.RLock()
+	defer m.peerLock.RUnlock()
+
+	// the sender is unknown without the member id configured
+	return m.self != "" && m.envelopes[peer]
+}
+
+// markPeerEnvelope marks the peer accepts the envelope, and whether it sent
+// the envelope already, the changes are written to the store
+func (m *Machine) markPeerEnvelope(peer string, enveloped bool) {
+	m.peerLock.Lock()
+	defer m.peerLock.Unlock()
+
+	if m.envelopes[peer] && (m.enveloped[peer] || !enveloped) {
+		return
+	}
+	enveloped = m.enveloped[peer] || enveloped
+	m.envelopes[peer] = true
+	m.enveloped[peer] = enveloped
+	logger.Printf("Machine.markPeerEnvelope(%s, %t)", peer, enveloped)
+	err := m.store.WritePeerEnvelope(peer, enveloped)
+	if err != nil {
+		logger.Printf("WritePeerEnvelope(%s, %t) => %v", peer, enveloped, err)
+	}
+}
+
+func (m *Machine) queueMessage(ctx context.Context, peers []string, typ int, evt *encoding.Event) error {
+	for _, p := range peers {
+		err := m.messenger.QueueMessage(ctx, p, m.buildMessage(m.checkPeerEnvelope(p), typ, evt))
+		if err != nil {
+			metrics.MessengerErrors.WithLabelValues(metrics.MessengerQueue).Inc()
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Machine) broadcastMessage(ctx context.Context, typ int, evt *encoding.Event) error {
+	envelope := true
+	for _, id := range m.peers() {
+		envelope = envelope && m.checkPeerEnvelope(id)
+	}
+	return m.messenger.BroadcastMessage(ctx, m.buildMessage(envelope, typ, evt))
+}
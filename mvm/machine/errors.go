@@ -0,0 +1,101 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+)
+
+const (
+	QuarantineStageSign    = "sign"
+	QuarantineStageSend    = "send"
+	QuarantineStageReceive = "receive"
+	QuarantineStageOutput  = "output"
+)
+
+var (
+	ErrorInvalidEvent      = errors.New("invalid event")
+	ErrorEngineUnavailable = errors.New("engine unavailable")
+)
+
+// Error is returned by the machine loops for a failure bound to an event,
+// a poison error will never succeed on retry and the event is quarantined
+type Error struct {
+	Stage  string
+	Event  *encoding.Event
+	Poison bool
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Event == nil {
+		return fmt.Sprintf("machine %s error: %v", e.Stage, e.Err)
+	}
+	return fmt.Sprintf("machine %s error %s: %v", e.Stage, e.Event.ID(), e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func transientEventError(stage string, evt *encoding.Event, err error) *Error {
+	return &Error{Stage: stage, Event: evt, Err: err}
+}
+
+func poisonEventError(stage string, evt *encoding.Event, err error) *Error {
+	return &Error{Stage: stage, Event: evt, Poison: true, Err: err}
+}
+
+// QuarantinedEvent is the poison event skipped by the process, or the output
+// never handled by the machine, which has no event but the output id
+type QuarantinedEvent struct {
+	Process   string
+	Nonce     uint64
+	Stage     string
+	Reason    string
+	Event     *encoding.Event
+	Output    string
+	CreatedAt time.Time
+}
+
+func (m *Machine) quarantineEvent(ctx context.Context, pid string, me *Error) {
+	qe := &QuarantinedEvent{
+		Process:   pid,
+		Stage:     me.Stage,
+		Reason:    me.Err.Error(),
+		Event:     me.Event,
+		CreatedAt: time.Now(),
+	}
+	if me.Event != nil {
+		qe.Nonce = me.Event.Nonce
+	}
+	logger.Printf("Machine.quarantineEvent(%s, %s, %d) => %s", qe.Process, qe.Stage, qe.Nonce, qe.Reason)
+	m.writeQuarantinedEvent(ctx, qe)
+}
+
+// quarantineOutput records the output dropped by its handler, the output is
+// kept by the group for the operator to inspect
+func (m *Machine) quarantineOutput(pid, output string, err error) {
+	qe := &QuarantinedEvent{
+		Process:   pid,
+		Stage:     QuarantineStageOutput,
+		Reason:    err.Error(),
+		Output:    output,
+		CreatedAt: time.Now(),
+	}
+	logger.Printf("Machine.quarantineOutput(%s, %s) => %s", qe.Process, qe.Output, qe.Reason)
+	m.writeQuarantinedEvent(m.ctx, qe)
+}
+
+func (m *Machine) writeQuarantinedEvent(ctx context.Context, qe *QuarantinedEvent) {
+	err := m.retry(ctx, "WriteQuarantinedEvent", func() error {
+		return m.store.WriteQuarantinedEvent(qe)
+	})
+	if err != nil {
+		logger.Printf("WriteQuarantinedEvent(%v) => %v", qe, err)
+	}
+}
@@ -0,0 +1,80 @@
+package machine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/gofrs/uuid"
+)
+
+const (
+	// the event is signed with an all zero signature instead of the group
+	ExemptionZeroSignature = "zero-signature"
+	// the full signature of the event is accepted without verification
+	ExemptionUnverifiedSignature = "unverified-signature"
+)
+
+// Exemption allows the events of a legacy process to bypass the signature
+// rules, for all events with nonce lower than the expiry nonce. All nodes
+// must have the same exemptions, compare them with the digest.
+type Exemption struct {
+	Process string `toml:"process" json:"process"`
+	Kind    string `toml:"kind" json:"kind"`
+	Nonce   uint64 `toml:"nonce" json:"nonce"`
+	Reason  string `toml:"reason" json:"reason"`
+}
+
+func (ex *Exemption) Applies(kind string, evt *encoding.Event) bool {
+	return ex.Kind == kind && ex.Process == evt.Process && evt.Nonce < ex.Nonce
+}
+
+func CheckExemptions(exs []*Exemption) error {
+	filter := make(map[string]bool)
+	for _, ex := range exs {
+		switch ex.Kind {
+		case ExemptionZeroSignature:
+		case ExemptionUnverifiedSignature:
+		default:
+			return fmt.Errorf("invalid exemption kind %s", ex.Kind)
+		}
+		id, err := uuid.FromString(ex.Process)
+		if err != nil || id.String() != ex.Process {
+			return fmt.Errorf("invalid exemption process %s", ex.Process)
+		}
+		if ex.Nonce == 0 {
+			return fmt.Errorf("invalid exemption nonce %s %s", ex.Process, ex.Kind)
+		}
+		if ex.Reason == "" {
+			return fmt.Errorf("empty exemption reason %s %s", ex.Process, ex.Kind)
+		}
+		key := ex.Process + ex.Kind
+		if filter[key] {
+			return fmt.Errorf("duplicated exemption %s %s", ex.Process, ex.Kind)
+		}
+		filter[key] = true
+	}
+	return nil
+}
+
+// ExemptionsDigest hashes the exemptions in the configuration order, the
+// reason is excluded because it doesn't change the behavior
+func ExemptionsDigest(exs []*Exemption) string {
+	h := sha256.New()
+	for _, ex := range exs {
+		fmt.Fprintf(h, "%s:%s:%d;", ex.Process, ex.Kind, ex.Nonce)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (m *Machine) checkExemption(kind string, evt *encoding.Event) bool {
+	for _, ex := range m.exemptions {
+		if ex.Applies(kind, evt) {
+			logger.Printf("Machine.checkExemption(%s, %s, %d) => %s", kind, evt.Process, evt.Nonce, ex.Reason)
+			return true
+		}
+	}
+	return false
+}
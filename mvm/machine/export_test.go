@@ -0,0 +1,20 @@
+package machine
+
+import "time"
+
+// ShortenIntervals makes the machine loops and the backoff run fast for the
+// tests, but the message period is not changed, so the missed partials of
+// the events are still only got by the sync
+func ShortenIntervals() {
+	loopInterval = 100 * time.Millisecond
+	processInterval = 100 * time.Millisecond
+	pauseInterval = time.Second
+	commandPeriod = time.Second
+	rotationPeriod = time.Second
+	backoffMinimum = 10 * time.Millisecond
+	backoffMaximum = time.Second
+	syncPeriod = 500 * time.Millisecond
+	syncTimeout = time.Second
+	syncBackoffMaximum = 4 * time.Second
+	keygenInterval = 100 * time.Millisecond
+}
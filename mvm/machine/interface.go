@@ -1,6 +1,8 @@
 package machine
 
 import (
+	"context"
+
 	"github.com/MixinNetwork/mixin/common"
 	"github.com/MixinNetwork/trusted-group/mvm/encoding"
 )
@@ -9,11 +11,19 @@ type Store interface {
 	CheckPendingGroupEventIdentifier(id string) (bool, error)
 	WritePendingGroupEventAndNonce(event *encoding.Event, id string, signType int) error
 	ListPendingGroupEvents(limit int) ([]*encoding.Event, error)
+	ReadGroupEvent(pid string, nonce uint64) (*encoding.Event, error)
 	ReadGroupEventSignatures(pid string, nonce uint64, signType int) ([][]byte, bool, error)
 	WritePendingGroupEventSignatures(pid string, nonce uint64, partials [][]byte, signType int) error
 	WriteSignedGroupEventAndExpirePending(event *encoding.Event, signType int) error
 	ListSignedGroupEvents(pid string, limit int) ([]*encoding.Event, error)
 	ExpireGroupEventsWithCost(events []*encoding.Event, cost common.Integer) error
+	WriteQuarantinedEvent(qe *QuarantinedEvent) error
+	WritePeerMisbehavior(pm *PeerMisbehavior) error
+	WritePeerEnvelope(peer string, enveloped bool) error
+	ListPeerEnvelopes() (map[string]bool, error)
+
+	ReadGroupRotation(group []byte) (*GroupRotation, error)
+	WriteGroupRotation(r *GroupRotation) error
 
 	CheckAccountSnapshot(as *AccountSnapshot) (bool, error)
 	WriteAccountSnapshot(as *AccountSnapshot) error
@@ -23,17 +33,62 @@ type Store interface {
 
 	ListProcesses() ([]*Process, error)
 	WriteProcess(p *Process) error
+	WriteProcessCredit(pid string, amount common.Integer, id string) (common.Integer, error)
+	WriteProcessState(pid string, address string, halted bool) error
+
+	WriteUserMask(pid, user, mask string) error
+	ReadMaskedUser(pid, mask string) (string, error)
+
+	ReadGroupCommand(id string) (*GroupCommand, error)
+	WriteGroupCommand(c *GroupCommand) error
+	ListGroupCommands() ([]*GroupCommand, error)
 
 	WriteAsset(a *Asset) error
 	ReadAsset(id string) (*Asset, error)
+	WriteCollectibleToken(t *CollectibleToken) error
+	ReadCollectibleToken(id string) (*CollectibleToken, error)
+}
+
+// Group is the MTG group to build the transactions, implemented by mtg.Group
+type Group interface {
+	GenesisId() string
+	GetMembers() []string
+	GetThreshold() int
+	BuildTransaction(ctx context.Context, assetId string, receivers []string, threshold int, amount, memo string, traceId, groupId string) error
+}
+
+// GroupCommander is implemented by the engines whose contracts accept the
+// commands signed by the group, to halt the contract or evolve it to the next
+type GroupCommander interface {
+	// EncodeGroupCommand returns the message of the command to sign
+	EncodeGroupCommand(c *GroupCommand) ([]byte, error)
+	// VerifyEvolveAddress checks the contract at the address can evolve to
+	// the next one, the vote is rejected if any error returned, except the
+	// ErrorEngineUnavailable which is retried until the context is done
+	VerifyEvolveAddress(ctx context.Context, address, next string) error
+	// ExecuteGroupCommand sends the signed command to the contract at the
+	// address, and returns true once the command takes effect on chain
+	ExecuteGroupCommand(address string, c *GroupCommand) (bool, error)
 }
 
 type Engine interface {
-	VerifyAddress(addr string, extra []byte) error
+	// VerifyAddress checks the contract at the address is deployed for the
+	// process pid, the process is rejected if any error returned, except the
+	// ErrorEngineUnavailable which is retried until the context is done
+	VerifyAddress(ctx context.Context, addr, pid string, extra []byte) error
 	SetupNotifier(addr string) error
 	VerifyEvent(address string, event *encoding.Event) bool
 	EstimateCost(events []*encoding.Event) (common.Integer, error)
 	EnsureSendGroupEvents(address string, events []*encoding.Event) error
 	ReceiveGroupEvents(address string, offset uint64, limit int) ([]*encoding.Event, error)
 	SignEvent(address string, event *encoding.Event) []byte
+
+	// Platform is the unique name of the engine used by the processes
+	Platform() string
+	// SignType is the registered signature scheme of the events, the TBLS
+	// events are signed and combined by the machine with the group share
+	SignType() int
+	// CombineSignatures combines the verified partials to the full signature,
+	// it's never called for the TBLS engines
+	CombineSignatures(address string, event *encoding.Event, partials [][]byte) ([]byte, error)
 }
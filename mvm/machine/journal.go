@@ -0,0 +1,48 @@
+package machine
+
+import (
+	"time"
+)
+
+const (
+	TransactionKindGroupEvent      = "group-event"
+	TransactionKindNotifierDeposit = "notifier-deposit"
+	TransactionKindGroupRotation   = "group-rotation"
+	TransactionKindGroupCommand    = "group-command"
+
+	TransactionStatusPending  = "pending"
+	TransactionStatusSuccess  = "success"
+	TransactionStatusReverted = "reverted"
+	TransactionStatusReplaced = "replaced"
+)
+
+// EngineTransaction is an outbound transaction sent by the engine to the
+// chain for the process at the address, tracked until its receipt found
+type EngineTransaction struct {
+	Hash      string    `json:"hash"`
+	Kind      string    `json:"kind"`
+	Address   string    `json:"address"`
+	Sender    string    `json:"sender"`
+	To        string    `json:"to"`
+	Nonce     uint64    `json:"nonce"`
+	Event     uint64    `json:"event"`
+	Payload   []byte    `json:"payload"`
+	Gas       uint64    `json:"gas"`
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason"`
+	Block     uint64    `json:"block"`
+	GasUsed   uint64    `json:"gas_used"`
+	SentAt    time.Time `json:"sent_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TransactionJournal is implemented by the engines recording their outbound
+// transactions, the latest transactions of the address are listed first
+type TransactionJournal interface {
+	ListTransactions(address string, limit int) ([]*EngineTransaction, error)
+}
+
+func (m *Machine) TransactionJournal(platform string) TransactionJournal {
+	tj, _ := m.engines[platform].(TransactionJournal)
+	return tj
+}
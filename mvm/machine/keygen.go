@@ -0,0 +1,829 @@
+package machine
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/tip/crypto"
+	"github.com/MixinNetwork/tip/crypto/en256"
+	"github.com/MixinNetwork/tip/messenger"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/drand/kyber"
+	"github.com/drand/kyber/share"
+	"github.com/drand/kyber/share/dkg"
+	"github.com/drand/kyber/sign/bls"
+	"github.com/drand/kyber/util/random"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	keygenPublic        = 1
+	keygenDeal          = 2
+	keygenResponse      = 3
+	keygenJustification = 4
+	keygenDone          = 5
+
+	// the justification phase only happens with complaints, so it ends by
+	// the timeout after all responses received
+	keygenJustificationTimeout = 5 * time.Minute
+)
+
+var (
+	keygenInterval = 3 * time.Second
+)
+
+// Keygen runs the distributed key generation among the group members over
+// the messenger, the share index is the member position in the sorted
+// members. All the keys and bundles are persisted to the state file, so a
+// member dropped mid-ceremony resumes with the same deals and responses.
+type Keygen struct {
+	messenger messenger.Messenger
+	dealers   []string
+	members   []string
+	peers     []string
+	self      string
+	threshold int
+	session   []byte
+	path      string
+
+	// the old group key to reshare, the share is nil for the new members
+	oldPoly  []kyber.Point
+	oldShare *share.PriShare
+
+	lock  sync.Mutex
+	state *keygenState
+	deals chan dkg.DealBundle
+	resps chan dkg.ResponseBundle
+	justs chan dkg.JustificationBundle
+	feed  bool
+	phase chan dkg.Phase
+}
+
+type keygenState struct {
+	Session  string            `json:"session"`
+	Longterm []byte            `json:"longterm"`
+	Seed     []byte            `json:"seed"`
+	Publics  map[string][]byte `json:"publics"`
+	Bundles  map[string][]byte `json:"bundles"`
+	Poly     []byte            `json:"poly"`
+	Share    []byte            `json:"share"`
+	Done     map[string][]byte `json:"done"`
+}
+
+// NewKeygen prepares the ceremony of the members, the nonce distinguishes
+// the ceremonies of the same members and threshold
+func NewKeygen(msgr messenger.Messenger, members []string, threshold int, self string, nonce uint64, path string) (*Keygen, error) {
+	members = append([]string{}, members...)
+	sort.Strings(members)
+	return newKeygen(msgr, members, members, threshold, self, nonce, path, nil, nil)
+}
+
+// NewReshare prepares the ceremony to reshare the group key of the old
+// members to the new members and threshold. The old members deal with their
+// shares, whose indexes must be their positions in the sorted old members,
+// and the new poly has the same commit as the old one. The share is empty
+// for the new members not in the old group.
+func NewReshare(msgr messenger.Messenger, old []string, poly, priv []byte, members []string, threshold int, self string, nonce uint64, path string) (*Keygen, error) {
+	old = append([]string{}, old...)
+	sort.Strings(old)
+	members = append([]string{}, members...)
+	sort.Strings(members)
+
+	suite := en256.NewSuiteG2()
+	commitments := unmarshalCommitments(poly)
+	if len(commitments) < 1 || len(commitments) > len(old) {
+		return nil, fmt.Errorf("invalid reshare poly %x", poly)
+	}
+	var oldShare *share.PriShare
+	if len(priv) > 0 {
+		oldShare = unmarshalPrivShare(priv)
+		pub := share.NewPubPoly(suite, suite.Point().Base(), commitments)
+		if !pub.Check(oldShare) {
+			return nil, fmt.Errorf("invalid reshare share: poly check failed")
+		}
+		if oldShare.I != keygenIndex(old, self) {
+			return nil, fmt.Errorf("invalid reshare share index %d", oldShare.I)
+		}
+	} else if keygenIndex(old, self) >= 0 {
+		return nil, fmt.Errorf("%s reshare share missing", self)
+	} else if keygenIndex(members, self) < 0 {
+		return nil, fmt.Errorf("%s not a new member", self)
+	}
+	return newKeygen(msgr, old, members, threshold, self, nonce, path, commitments, oldShare)
+}
+
+func newKeygen(msgr messenger.Messenger, dealers, members []string, threshold int, self string, nonce uint64, path string, oldPoly []kyber.Point, oldShare *share.PriShare) (*Keygen, error) {
+	if threshold < 1 || threshold > len(members) {
+		return nil, fmt.Errorf("invalid threshold %d/%d", threshold, len(members))
+	}
+	peers := append([]string{}, dealers...)
+	for _, id := range members {
+		if keygenIndex(peers, id) < 0 {
+			peers = append(peers, id)
+		}
+	}
+	sort.Strings(peers)
+	if keygenIndex(peers, self) < 0 {
+		return nil, fmt.Errorf("%s not a member", self)
+	}
+	h := sha256.New()
+	h.Write([]byte(strings.Join(members, ",")))
+	binary.Write(h, binary.BigEndian, uint64(threshold))
+	binary.Write(h, binary.BigEndian, nonce)
+	if oldPoly != nil {
+		h.Write([]byte(strings.Join(dealers, ",")))
+		h.Write(marshalCommitments(oldPoly))
+	}
+
+	k := &Keygen{
+		messenger: msgr,
+		dealers:   dealers,
+		members:   members,
+		peers:     peers,
+		self:      self,
+		threshold: threshold,
+		session:   h.Sum(nil),
+		path:      path,
+		oldPoly:   oldPoly,
+		oldShare:  oldShare,
+		deals:     make(chan dkg.DealBundle, len(peers)),
+		resps:     make(chan dkg.ResponseBundle, len(peers)),
+		justs:     make(chan dkg.JustificationBundle, len(peers)),
+		phase:     make(chan dkg.Phase, 4),
+	}
+	return k, k.loadState()
+}
+
+// Run returns the HEX encoded poly commitments and the share of the member,
+// in the machine configuration formats, once all members finished. The share
+// is empty for the old member leaving the group.
+func (k *Keygen) Run(ctx context.Context) (string, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() { errs <- k.loopReceiveMessages(ctx) }()
+	go k.loopBroadcastMessages(ctx)
+
+	err := k.runProtocol(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	for {
+		done, err := k.checkDone()
+		if err != nil {
+			return "", "", err
+		} else if done {
+			break
+		}
+		select {
+		case err := <-errs:
+			return "", "", err
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	// serve the lagging members a while before quit
+	sleep(ctx, keygenInterval*3)
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return hex.EncodeToString(k.state.Poly), hex.EncodeToString(k.state.Share), nil
+}
+
+func (k *Keygen) runProtocol(ctx context.Context) error {
+	for {
+		k.lock.Lock()
+		done, publics := k.state.Poly != nil, len(k.state.Publics)
+		k.lock.Unlock()
+		if done {
+			return nil
+		}
+		if publics == len(k.peers) {
+			break
+		}
+		if !sleep(ctx, 100*time.Millisecond) {
+			return ctx.Err()
+		}
+	}
+
+	var err error
+	g2 := en256.NewSuiteG2()
+	suite := &keygenSuite{Suite: g2, seed: k.state.Seed}
+	conf := &dkg.Config{
+		Suite:          suite,
+		Threshold:      k.threshold,
+		Longterm:       suite.Scalar().SetBytes(k.state.Longterm),
+		Nonce:          k.session,
+		Auth:           bls.NewSchemeOnG1(g2),
+		FastSync:       true,
+		Reader:         seedReader(k.state.Seed, "secret"),
+		UserReaderOnly: true,
+	}
+	conf.NewNodes, err = k.buildNodes(k.members)
+	if err != nil {
+		return err
+	}
+	if k.oldPoly != nil {
+		conf.OldNodes, err = k.buildNodes(k.dealers)
+		if err != nil {
+			return err
+		}
+		conf.OldThreshold = len(k.oldPoly)
+		conf.PublicCoeffs = k.oldPoly
+		if k.oldShare != nil {
+			conf.Share = &dkg.DistKeyShare{Commits: k.oldPoly, Share: k.oldShare}
+		}
+	}
+	protocol, err := dkg.NewProtocol(conf, k, k, false)
+	if err != nil {
+		return err
+	}
+	k.phase <- dkg.DealPhase
+	k.replayBundles()
+	go k.loopPhases(ctx)
+
+	var res dkg.OptionResult
+	select {
+	case res = <-protocol.WaitEnd():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if keygenIndex(k.members, k.self) < 0 {
+		// the old member leaving the group gets no result, and just waits
+		// for the new members to finish with its deal
+		logger.Printf("Keygen(%x) => leaving %v", k.session, res.Error)
+		return nil
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	if i := res.Result.Key.PriShare().I; i != keygenIndex(k.members, k.self) {
+		return fmt.Errorf("keygen share index malformed %d", i)
+	}
+	commits := res.Result.Key.Commitments()
+	if k.oldPoly != nil && !commits[0].Equal(k.oldPoly[0]) {
+		return fmt.Errorf("reshare commit malformed %s", commits[0])
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.state.Poly = marshalCommitments(commits)
+	k.state.Share = marshalPrivShare(res.Result.Key.PriShare())
+	k.state.Done[k.self] = k.state.Poly
+	logger.Printf("Keygen(%x) => %x", k.session, k.state.Poly)
+	return k.writeState()
+}
+
+func (k *Keygen) buildNodes(ids []string) ([]dkg.Node, error) {
+	var nodes []dkg.Node
+	for i, id := range ids {
+		pub, err := crypto.PubKeyFromBytes(k.state.Publics[id])
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, dkg.Node{Index: uint32(i), Public: pub})
+	}
+	return nodes, nil
+}
+
+func (k *Keygen) loopPhases(ctx context.Context) {
+	for {
+		k.lock.Lock()
+		var responses int
+		for _, id := range k.members {
+			if k.state.Bundles[keygenBundleKey(keygenResponse, id)] != nil {
+				responses++
+			}
+		}
+		k.lock.Unlock()
+		if responses == len(k.members) {
+			break
+		}
+		if !sleep(ctx, time.Second) {
+			return
+		}
+	}
+	if !sleep(ctx, keygenJustificationTimeout) {
+		return
+	}
+	k.phase <- dkg.ResponsePhase
+	k.phase <- dkg.JustifPhase
+	k.phase <- dkg.FinishPhase
+}
+
+func (k *Keygen) loopReceiveMessages(ctx context.Context) error {
+	for {
+		peer, b, err := k.messenger.ReceiveMessage(ctx)
+		if err == messenger.ErrorDone || ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if keygenIndex(k.peers, peer) < 0 || peer == k.self {
+			continue
+		}
+		kind, data, err := k.decodeMessage(b)
+		if err != nil {
+			logger.Verbosef("Keygen.decodeMessage(%s) => %v", peer, err)
+			continue
+		}
+		err = k.handleMessage(peer, kind, data)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (k *Keygen) handleMessage(peer string, kind int, data []byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	switch kind {
+	case keygenPublic:
+		old := k.state.Publics[peer]
+		if old != nil {
+			if !bytes.Equal(old, data) {
+				logger.Printf("Keygen.handleMessage(%s) => public %x %x", peer, old, data)
+			}
+			return nil
+		}
+		_, err := crypto.PubKeyFromBytes(data)
+		if err != nil {
+			return nil
+		}
+		k.state.Publics[peer] = data
+	case keygenDeal, keygenResponse, keygenJustification:
+		key := keygenBundleKey(kind, peer)
+		if k.state.Bundles[key] != nil {
+			return nil
+		}
+		k.state.Bundles[key] = data
+		if k.feed {
+			k.feedBundle(kind, data)
+		}
+	case keygenDone:
+		if bytes.Equal(k.state.Done[peer], data) {
+			return nil
+		}
+		k.state.Done[peer] = data
+	default:
+		return nil
+	}
+	return k.writeState()
+}
+
+// loopBroadcastMessages sends all messages of the member periodically, so
+// the members resumed get them again
+func (k *Keygen) loopBroadcastMessages(ctx context.Context) {
+	for {
+		k.lock.Lock()
+		msgs := [][]byte{k.encodeMessage(keygenPublic, k.state.Publics[k.self])}
+		for _, kind := range []int{keygenDeal, keygenResponse, keygenJustification} {
+			b := k.state.Bundles[keygenBundleKey(kind, k.self)]
+			if b != nil {
+				msgs = append(msgs, k.encodeMessage(kind, b))
+			}
+		}
+		if k.state.Poly != nil {
+			msgs = append(msgs, k.encodeMessage(keygenDone, k.state.Poly))
+		}
+		k.lock.Unlock()
+
+		for _, b := range msgs {
+			k.broadcast(ctx, b)
+		}
+		if !sleep(ctx, keygenInterval) {
+			return
+		}
+	}
+}
+
+func (k *Keygen) broadcast(ctx context.Context, b []byte) {
+	for _, id := range k.peers {
+		if id == k.self {
+			continue
+		}
+		err := k.messenger.SendMessage(ctx, id, b)
+		if err != nil {
+			logger.Verbosef("Keygen.SendMessage(%s) => %v", id, err)
+		}
+	}
+}
+
+func (k *Keygen) checkDone() (bool, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	poly := k.state.Poly
+	for _, id := range k.members {
+		p := k.state.Done[id]
+		if p == nil {
+			return false, nil
+		}
+		if poly == nil {
+			poly = p
+		}
+		if !bytes.Equal(p, poly) {
+			return false, fmt.Errorf("keygen poly mismatch %s %x %x", id, p, poly)
+		}
+	}
+	if k.state.Poly == nil {
+		group := marshalCommitments(k.oldPoly[:1])
+		if !bytes.HasPrefix(poly, group) {
+			return false, fmt.Errorf("reshare commit malformed %x", poly)
+		}
+		k.state.Poly = poly
+	}
+	return true, nil
+}
+
+func (k *Keygen) PushDeals(db *dkg.DealBundle) {
+	k.pushBundle(keygenDeal, encodeDealBundle(db))
+}
+
+func (k *Keygen) IncomingDeal() <-chan dkg.DealBundle {
+	return k.deals
+}
+
+func (k *Keygen) PushResponses(rb *dkg.ResponseBundle) {
+	k.pushBundle(keygenResponse, encodeResponseBundle(rb))
+}
+
+func (k *Keygen) IncomingResponse() <-chan dkg.ResponseBundle {
+	return k.resps
+}
+
+func (k *Keygen) PushJustifications(jb *dkg.JustificationBundle) {
+	k.pushBundle(keygenJustification, encodeJustificationBundle(jb))
+}
+
+func (k *Keygen) IncomingJustification() <-chan dkg.JustificationBundle {
+	return k.justs
+}
+
+func (k *Keygen) NextPhase() chan dkg.Phase {
+	return k.phase
+}
+
+// pushBundle persists the bundle before sending it, and the bundle persisted
+// before is always sent instead, because the deals are encrypted with random
+// keys and the members reject the different bundles of the same member
+func (k *Keygen) pushBundle(kind int, data []byte) {
+	k.lock.Lock()
+	key := keygenBundleKey(kind, k.self)
+	if old := k.state.Bundles[key]; old != nil {
+		data = old
+	} else {
+		k.state.Bundles[key] = data
+		err := k.writeState()
+		if err != nil {
+			panic(err)
+		}
+	}
+	k.feedBundle(kind, data)
+	k.lock.Unlock()
+
+	k.broadcast(context.Background(), k.encodeMessage(kind, data))
+}
+
+// replayBundles feeds all bundles persisted to the protocol once started
+func (k *Keygen) replayBundles() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.feed = true
+	for _, kind := range []int{keygenDeal, keygenResponse, keygenJustification} {
+		for _, id := range k.peers {
+			if id == k.self {
+				continue
+			}
+			b := k.state.Bundles[keygenBundleKey(kind, id)]
+			if b != nil {
+				k.feedBundle(kind, b)
+			}
+		}
+	}
+}
+
+func (k *Keygen) feedBundle(kind int, data []byte) {
+	var err error
+	switch kind {
+	case keygenDeal:
+		var db *dkg.DealBundle
+		db, err = decodeDealBundle(data)
+		if err == nil {
+			go func() { k.deals <- *db }()
+		}
+	case keygenResponse:
+		var rb *dkg.ResponseBundle
+		rb, err = decodeResponseBundle(data)
+		if err == nil {
+			go func() { k.resps <- *rb }()
+		}
+	case keygenJustification:
+		var jb *dkg.JustificationBundle
+		jb, err = decodeJustificationBundle(data)
+		if err == nil {
+			go func() { k.justs <- *jb }()
+		}
+	}
+	if err != nil {
+		logger.Verbosef("Keygen.feedBundle(%d) => %v", kind, err)
+	}
+}
+
+// session || kind || data
+func (k *Keygen) encodeMessage(kind int, data []byte) []byte {
+	enc := common.NewEncoder()
+	enc.Write(k.session)
+	enc.WriteInt(kind)
+	writeKeygenBytes(enc, data)
+	return enc.Bytes()
+}
+
+func (k *Keygen) decodeMessage(b []byte) (int, []byte, error) {
+	if len(b) < len(k.session) || !bytes.Equal(b[:len(k.session)], k.session) {
+		return 0, nil, fmt.Errorf("invalid session")
+	}
+	dec := common.NewDecoder(b[len(k.session):])
+	kind, err := dec.ReadInt()
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := dec.ReadBytes()
+	return kind, data, err
+}
+
+// keygenSuite makes the member poly from the seed, because the dealer
+// evaluates its own share and justifications with the poly, which must be the
+// same one in the deal persisted
+type keygenSuite struct {
+	dkg.Suite
+	seed []byte
+}
+
+func (s *keygenSuite) RandomStream() cipher.Stream {
+	return random.New(seedReader(s.seed, "poly"))
+}
+
+func seedReader(seed []byte, domain string) sha3.ShakeHash {
+	h := sha3.NewShake256()
+	h.Write(seed)
+	h.Write([]byte(domain))
+	return h
+}
+
+func (k *Keygen) loadState() error {
+	b, err := os.ReadFile(k.path)
+	if err == nil {
+		var s keygenState
+		err = encoding.JSONUnmarshal(b, &s)
+		if err != nil {
+			return err
+		}
+		if s.Session != hex.EncodeToString(k.session) {
+			return fmt.Errorf("keygen session mismatch %s", s.Session)
+		}
+		k.state = &s
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	suite := en256.NewSuiteG2()
+	longterm := suite.Scalar().Pick(suite.RandomStream())
+	seed := make([]byte, 32)
+	_, err = rand.Read(seed)
+	if err != nil {
+		panic(err)
+	}
+	k.state = &keygenState{
+		Session:  hex.EncodeToString(k.session),
+		Longterm: crypto.PrivateKeyBytes(longterm),
+		Seed:     seed,
+		Publics:  map[string][]byte{k.self: crypto.PublicKeyBytes(crypto.PublicKey(longterm))},
+		Bundles:  make(map[string][]byte),
+		Done:     make(map[string][]byte),
+	}
+	return k.writeState()
+}
+
+func (k *Keygen) writeState() error {
+	tmp := k.path + ".tmp"
+	err := os.WriteFile(tmp, encoding.JSONMarshalPanic(k.state), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
+
+func keygenIndex(members []string, id string) int {
+	for i, m := range members {
+		if m == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func keygenBundleKey(kind int, member string) string {
+	return fmt.Sprintf("%d:%s", kind, member)
+}
+
+func marshalPrivShare(ps *share.PriShare) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(ps.I))
+	return append(buf[:], crypto.PrivateKeyBytes(ps.V)...)
+}
+
+func marshalCommitments(commits []kyber.Point) []byte {
+	var data []byte
+	for _, p := range commits {
+		data = append(data, crypto.PublicKeyBytes(p)...)
+	}
+	return data
+}
+
+func encodeDealBundle(db *dkg.DealBundle) []byte {
+	enc := common.NewEncoder()
+	enc.WriteInt(int(db.DealerIndex))
+	enc.WriteInt(len(db.Deals))
+	for _, d := range db.Deals {
+		enc.WriteInt(int(d.ShareIndex))
+		writeKeygenBytes(enc, d.EncryptedShare)
+	}
+	enc.WriteInt(len(db.Public))
+	for _, p := range db.Public {
+		writeKeygenBytes(enc, crypto.PublicKeyBytes(p))
+	}
+	writeKeygenBytes(enc, db.SessionID)
+	writeKeygenBytes(enc, db.Signature)
+	return enc.Bytes()
+}
+
+func decodeDealBundle(b []byte) (*dkg.DealBundle, error) {
+	db := &dkg.DealBundle{}
+	dec := common.NewDecoder(b)
+	di, err := dec.ReadInt()
+	if err != nil {
+		return nil, err
+	}
+	db.DealerIndex = uint32(di)
+
+	dl, err := dec.ReadInt()
+	if err != nil {
+		return nil, err
+	}
+	for ; dl > 0; dl-- {
+		si, err := dec.ReadInt()
+		if err != nil {
+			return nil, err
+		}
+		es, err := dec.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		db.Deals = append(db.Deals, dkg.Deal{ShareIndex: uint32(si), EncryptedShare: es})
+	}
+
+	pl, err := dec.ReadInt()
+	if err != nil {
+		return nil, err
+	}
+	for ; pl > 0; pl-- {
+		pb, err := dec.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		point, err := crypto.PubKeyFromBytes(pb)
+		if err != nil {
+			return nil, err
+		}
+		db.Public = append(db.Public, point)
+	}
+
+	db.SessionID, err = dec.ReadBytes()
+	if err != nil {
+		return nil, err
+	}
+	db.Signature, err = dec.ReadBytes()
+	return db, err
+}
+
+func encodeResponseBundle(rb *dkg.ResponseBundle) []byte {
+	enc := common.NewEncoder()
+	enc.WriteInt(int(rb.ShareIndex))
+	enc.WriteInt(len(rb.Responses))
+	for _, r := range rb.Responses {
+		enc.WriteInt(int(r.DealerIndex))
+		if r.Status {
+			enc.WriteInt(1)
+		} else {
+			enc.WriteInt(0)
+		}
+	}
+	writeKeygenBytes(enc, rb.SessionID)
+	writeKeygenBytes(enc, rb.Signature)
+	return enc.Bytes()
+}
+
+func decodeResponseBundle(b []byte) (*dkg.ResponseBundle, error) {
+	rb := &dkg.ResponseBundle{}
+	dec := common.NewDecoder(b)
+	si, err := dec.ReadInt()
+	if err != nil {
+		return nil, err
+	}
+	rb.ShareIndex = uint32(si)
+
+	rl, err := dec.ReadInt()
+	if err != nil {
+		return nil, err
+	}
+	for ; rl > 0; rl-- {
+		di, err := dec.ReadInt()
+		if err != nil {
+			return nil, err
+		}
+		status, err := dec.ReadInt()
+		if err != nil {
+			return nil, err
+		}
+		rb.Responses = append(rb.Responses, dkg.Response{DealerIndex: uint32(di), Status: status == 1})
+	}
+
+	rb.SessionID, err = dec.ReadBytes()
+	if err != nil {
+		return nil, err
+	}
+	rb.Signature, err = dec.ReadBytes()
+	return rb, err
+}
+
+func encodeJustificationBundle(jb *dkg.JustificationBundle) []byte {
+	enc := common.NewEncoder()
+	enc.WriteInt(int(jb.DealerIndex))
+	enc.WriteInt(len(jb.Justifications))
+	for _, j := range jb.Justifications {
+		enc.WriteInt(int(j.ShareIndex))
+		writeKeygenBytes(enc, crypto.PrivateKeyBytes(j.Share))
+	}
+	writeKeygenBytes(enc, jb.SessionID)
+	writeKeygenBytes(enc, jb.Signature)
+	return enc.Bytes()
+}
+
+func decodeJustificationBundle(b []byte) (*dkg.JustificationBundle, error) {
+	jb := &dkg.JustificationBundle{}
+	dec := common.NewDecoder(b)
+	di, err := dec.ReadInt()
+	if err != nil {
+		return nil, err
+	}
+	jb.DealerIndex = uint32(di)
+
+	jl, err := dec.ReadInt()
+	if err != nil {
+		return nil, err
+	}
+	suite := en256.NewSuiteG2()
+	for ; jl > 0; jl-- {
+		si, err := dec.ReadInt()
+		if err != nil {
+			return nil, err
+		}
+		sb, err := dec.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		jb.Justifications = append(jb.Justifications, dkg.Justification{
+			ShareIndex: uint32(si),
+			Share:      suite.Scalar().SetBytes(sb),
+		})
+	}
+
+	jb.SessionID, err = dec.ReadBytes()
+	if err != nil {
+		return nil, err
+	}
+	jb.Signature, err = dec.ReadBytes()
+	return jb, err
+}
+
+func writeKeygenBytes(enc *common.Encoder, b []byte) {
+	enc.WriteInt(len(b))
+	enc.Write(b)
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/MixinNetwork/mixin/common"
 	"github.com/MixinNetwork/mixin/logger"
@@ -19,32 +22,48 @@ import (
 	"github.com/drand/kyber/group/mod"
 	"github.com/drand/kyber/share"
 	"github.com/fox-one/mixin-sdk-go"
+	"github.com/gofrs/uuid"
 	"github.com/shopspring/decimal"
 )
 
 type Configuration struct {
-	Poly             string `toml:"poly"`
-	Share            string `toml:"share"`
-	ProcessFeeAsset  string `toml:"process-fee-asset"`
-	ProcessFeeAmount string `toml:"process-fee-amount"`
+	Poly             string       `toml:"poly"`
+	Share            string       `toml:"share"`
+	ProcessFeeAsset  string       `toml:"process-fee-asset"`
+	ProcessFeeAmount string       `toml:"process-fee-amount"`
+	Exemptions       []*Exemption `toml:"exemptions"`
+	Member           string       `toml:"member"`
+	MaskKey          string       `toml:"mask-key"`
+
+	Rotation *RotationConfiguration `toml:"rotation"`
 }
 
 type Machine struct {
+	ctx        context.Context
 	store      Store
 	mixin      *mixin.Client
-	group      *mtg.Group
-	share      *share.PriShare
-	poly       *share.PubPoly
+	group      Group
+	key        *groupKey
+	rotation   *rotation
+	maskKey    []byte
+	self       string
 	feeAssetId string
 	feeAmount  decimal.Decimal
+	exemptions []*Exemption
 	messenger  messenger.Messenger
 	engines    map[string]Engine
 	processes  map[string]*Process
 	procLock   *sync.RWMutex
 	signerLock *sync.Mutex
+	workLock   *sync.Mutex
+	peerLock   *sync.RWMutex
+	envelopes  map[string]bool
+	enveloped  map[string]bool
+	reported   map[string]time.Time
+	loops      *sync.WaitGroup
 }
 
-func Boot(conf *Configuration, group *mtg.Group, store Store, m messenger.Messenger, mixin *mixin.Client) (*Machine, error) {
+func Boot(ctx context.Context, conf *Configuration, group Group, store Store, m messenger.Messenger, mixin *mixin.Client) (*Machine, error) {
 	pb, err := hex.DecodeString(conf.Poly)
 	if err != nil {
 		return nil, err
@@ -53,57 +72,136 @@ func Boot(conf *Configuration, group *mtg.Group, store Store, m messenger.Messen
 	if feeAmount.Sign() <= 0 {
 		return nil, fmt.Errorf("invalid process fee amount %s", conf.ProcessFeeAmount)
 	}
+	err = CheckExemptions(conf.Exemptions)
+	if err != nil {
+		return nil, err
+	}
+	maskKey, err := parseMaskKey(conf.MaskKey, store)
+	if err != nil {
+		return nil, err
+	}
 	commitments := unmarshalCommitments(pb)
 	suite := en256.NewSuiteG2()
 	poly := share.NewPubPoly(suite, suite.Point().Base(), commitments)
-	sb, err := hex.DecodeString(conf.Share)
+	key := newGroupKey(poly, group.GetThreshold(), group.GetMembers())
+	logger.Printf("Machine.Boot(%s, %d, %s, %s)", poly.Commit().String(), len(conf.Exemptions), ExemptionsDigest(conf.Exemptions), maskKeyDigest(maskKey))
+
+	// the new members of the rotation have no share of the group key
+	if conf.Share != "" {
+		sb, err := hex.DecodeString(conf.Share)
+		if err != nil {
+			return nil, err
+		}
+		key.share = unmarshalPrivShare(sb)
+		if !poly.Check(key.share) {
+			panic("invalid machine.share: poly check failed")
+		}
+	}
+	rotation, err := parseRotation(conf.Rotation, group.GetMembers())
 	if err != nil {
 		return nil, err
 	}
-	share := unmarshalPrivShare(sb)
-	logger.Printf("Machine.Boot(%s)", poly.Commit().String())
-
-	if !poly.Check(share) {
-		panic("invalid machine.share: poly check failed")
+	if rotation != nil {
+		rotation.reshare = rotation.key.poly.Commit().Equal(poly.Commit())
+		logger.Printf("Machine.Boot() => rotation %x %d %t", rotation.group, rotation.nonce, rotation.reshare)
+	}
+	if key.share == nil && (rotation == nil || rotation.key.share == nil) {
+		return nil, fmt.Errorf("invalid machine.share: neither the share nor the rotation share")
+	}
+	// the peers accepting the envelope are remembered across the restarts,
+	// otherwise the legacy messages would be rejected by the envelope peers
+	enveloped, err := store.ListPeerEnvelopes()
+	if err != nil {
+		return nil, err
+	}
+	envelopes := make(map[string]bool)
+	for peer := range enveloped {
+		envelopes[peer] = true
 	}
 
 	return &Machine{
+		ctx:        ctx,
 		store:      store,
 		mixin:      mixin,
 		group:      group,
-		share:      share,
-		poly:       poly,
+		key:        key,
+		rotation:   rotation,
+		maskKey:    maskKey,
+		self:       conf.Member,
 		feeAssetId: conf.ProcessFeeAsset,
 		feeAmount:  feeAmount,
+		exemptions: conf.Exemptions,
 		messenger:  m,
 		engines:    make(map[string]Engine),
 		processes:  make(map[string]*Process),
 		procLock:   new(sync.RWMutex),
 		signerLock: new(sync.Mutex),
+		workLock:   new(sync.Mutex),
+		peerLock:   new(sync.RWMutex),
+		envelopes:  envelopes,
+		enveloped:  enveloped,
+		reported:   make(map[string]time.Time),
+		loops:      new(sync.WaitGroup),
 	}, nil
 }
 
 func (m *Machine) Loop(ctx context.Context) {
-	processes, err := m.store.ListProcesses()
+	var processes []*Process
+	err := m.retry(ctx, "ListProcesses", func() (err error) {
+		processes, err = m.store.ListProcesses()
+		return err
+	})
 	if err != nil {
-		panic(err)
+		return
 	}
+	m.procLock.Lock()
 	for _, p := range processes {
+		if m.engines[p.Platform] == nil {
+			logger.Printf("Machine.Loop() => process %s engine %s not added", p.Identifier, p.Platform)
+			continue
+		}
+		// the process may be added by the group output already
+		if m.processes[p.Identifier] != nil {
+			continue
+		}
 		m.processes[p.Identifier] = p
 		m.Spawn(ctx, p)
 	}
-	go m.loopReceiveGroupMessages(ctx)
+	m.procLock.Unlock()
+	m.spawn(func() { m.loopReceiveGroupMessages(ctx) })
+	if m.rotation != nil && !m.rotation.reshare {
+		m.spawn(func() { m.loopRotateGroup(ctx) })
+	}
+	m.spawn(func() { m.loopGroupCommands(ctx) })
+	m.spawn(func() { m.loopSyncGroupEvents(ctx) })
 	m.loopSignGroupEvents(ctx)
+
+	// the group can't be stopped, so the work lock is held forever to
+	// wait the output in progress and block all later outputs
+	logger.Printf("Machine.Loop() => shutting down")
+	m.workLock.Lock()
+	m.loops.Wait()
 }
 
-func (m *Machine) AddEngine(platform string, engine Engine) {
-	switch platform {
-	case ProcessPlatformQuorum:
-	case ProcessPlatformEOS:
-	default:
-		return
+func (m *Machine) spawn(loop func()) {
+	m.loops.Add(1)
+	go func() {
+		defer m.loops.Done()
+		loop()
+	}()
+}
+
+func (m *Machine) AddEngine(engine Engine) error {
+	platform := engine.Platform()
+	if m.engines[platform] != nil {
+		return fmt.Errorf("engine %s added", platform)
+	}
+	err := registerPlatform(platform, engine.SignType())
+	if err != nil {
+		return err
 	}
 	m.engines[platform] = engine
+	return nil
 }
 
 func (m *Machine) AddProcess(ctx context.Context, pid string, platform, address string, out *mtg.Output, extra []byte) bool {
@@ -119,82 +217,157 @@ func (m *Machine) AddProcess(ctx context.Context, pid string, platform, address
 		logger.Verbosef("AddProcess(%s, %s, %s) => amount %s", pid, platform, address, out.Amount)
 		return false
 	}
-	m.procLock.Lock()
-	defer m.procLock.Unlock()
-
+	// the new process is masked, so the output is handled again after the
+	// restart with the key configured, the same as the other members
+	if m.maskKey == nil {
+		logger.Printf("AddProcess(%s, %s, %s) => machine.mask-key not configured", pid, platform, address)
+		m.blockOutput()
+	}
 	engine := m.engines[platform]
 	if engine == nil {
 		logger.Verbosef("AddProcess(%s, %s, %s) => engine %s", pid, platform, address, platform)
 		return false
 	}
-	for _, old := range m.processes {
+	// the engine RPC is called without the process lock, so an outage blocks
+	// only this output instead of all process loops
+	err := m.verifyProcessAddress(engine, address, pid, extra)
+	if err != nil {
+		logger.Printf("AddProcess(%s, %s, %s) => VerifyAddress => %v", pid, platform, address, err)
+		return false
+	}
+	for _, old := range m.listProcesses() {
 		if old.Identifier == out.Sender {
 			logger.Verbosef("AddProcess(%s, %s, %s) => sender %s", pid, platform, address, out.Sender)
 			return false
 		}
-		if old.Address == address {
+		if old.Platform == platform && old.Address == address {
 			logger.Verbosef("AddProcess(%s, %s, %s) => address %s", pid, platform, address, address)
 			return false
 		}
 	}
-
-	err := engine.VerifyAddress(address, extra)
-	if err != nil {
-		logger.Verbosef("VerifyAddress(%s) => %s", address, err)
-		return false
-	}
-	err = engine.SetupNotifier(address)
+	err = m.retryEngine("SetupNotifier", func() error {
+		return engine.SetupNotifier(address)
+	})
 	if err != nil {
 		logger.Verbosef("SetupNotifier(%s) => %s", address, err)
 		return false
 	}
+
+	m.procLock.Lock()
+	defer m.procLock.Unlock()
+
 	proc := &Process{
 		Identifier: out.Sender,
 		Platform:   platform,
 		Address:    address,
 		Credit:     common.Zero,
 		Nonce:      0,
+		Masked:     true,
 	}
 	proc.Asset = strings.Contains(string(extra), "META")
-	err = m.store.WriteProcess(proc)
+	err = m.retryOutput(m.procLock, "WriteProcess", func() error {
+		return m.store.WriteProcess(proc)
+	})
 	if err != nil {
-		panic(err)
+		m.quarantineOutput(pid, out.UTXOID, err)
+		return false
 	}
 	m.processes[proc.Identifier] = proc
-	m.Spawn(ctx, proc)
+	// the process loops stop with the machine instead of the group output
+	m.Spawn(m.ctx, proc)
 
 	return true
 }
 
-func (m *Machine) WriteGroupEvent(ctx context.Context, pid string, out *mtg.Output, extra []byte) {
+func (m *Machine) verifyProcessAddress(engine Engine, address, pid string, extra []byte) error {
+	return m.retryEngine("VerifyAddress", func() error {
+		return engine.VerifyAddress(m.ctx, address, pid, extra)
+	})
+}
+
+// retryEngine retries the engine call of the output handler while the engine
+// is unavailable, and blocks the output if the machine is shutting down, the
+// call must not be made with the process lock
+func (m *Machine) retryEngine(op string, fn func() error) error {
+	var bo backoff
+	for {
+		err := fn()
+		if !errors.Is(err, ErrorEngineUnavailable) {
+			return err
+		}
+		logger.Printf("Machine.retryEngine(%s) => %v", op, err)
+		if !bo.wait(m.ctx) {
+			m.blockOutput()
+		}
+	}
+}
+
+// blockOutput never returns the output handler interrupted by the shutdown,
+// so the output is not marked as done by the group and handled again after
+// restart, and the work lock is released for the machine loop to finish
+func (m *Machine) blockOutput() {
+	m.workLock.Unlock()
+	select {}
+}
+
+// SendersGroup is implemented by the groups able to read the senders of the
+// output from the network, i.e. the receivers and threshold of the UTXO it
+// spent, so a multisig deposit is owned by all its owners. The output proves
+// the sender only, so the events to a group without it are owned by the
+// sender alone.
+type SendersGroup interface {
+	ReadOutputSenders(ctx context.Context, out *mtg.Output) ([]string, int, error)
+}
+
+// the output handlers retry until the machine is shutting down, because the
+// output will be marked as done by the group once returned
+func (m *Machine) WriteGroupEvent(ctx context.Context, op *encoding.Operation, out *mtg.Output) {
+	// the senders are read from the network, so not with the process lock
+	members, threshold, err := m.readOutputOwners(ctx, out)
+	if err != nil {
+		m.quarantineOutput(op.Process, out.UTXOID, err)
+		return
+	}
+
 	m.procLock.RLock()
 	defer m.procLock.RUnlock()
 
-	proc := m.processes[pid]
+	proc := m.processes[op.Process]
 	if proc == nil {
 		return
 	}
+	err = m.retryOutput(m.procLock.RLocker(), "WriteGroupEvent", func() error {
+		return m.writeGroupEvent(ctx, proc, out, op.Extra, members, threshold)
+	})
+	if err != nil {
+		m.quarantineOutput(proc.Identifier, out.UTXOID, err)
+	}
+}
+
+func (m *Machine) writeGroupEvent(ctx context.Context, proc *Process, out *mtg.Output, extra []byte, members []string, threshold int) error {
 	if proc.Asset {
 		meta, err := m.fetchAssetMeta(ctx, out.AssetID)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		extra = append(meta, extra...)
 	}
 
 	done, err := m.store.CheckPendingGroupEventIdentifier(out.UTXOID)
+	if err != nil || done {
+		return err
+	}
+	members, err = m.maskGroupEventMembers(proc, members)
 	if err != nil {
-		panic(err)
-	} else if done {
-		return
+		return err
 	}
 
 	amount := common.NewIntegerFromString(out.Amount.String())
 	evt := &encoding.Event{
 		Process:   proc.Identifier,
 		Asset:     out.AssetID,
-		Members:   []string{out.Sender},
-		Threshold: 1,
+		Members:   members,
+		Threshold: threshold,
 		Amount:    amount,
 		Extra:     extra,
 		Timestamp: uint64(out.CreatedAt.UnixNano()),
@@ -203,13 +376,93 @@ func (m *Machine) WriteGroupEvent(ctx context.Context, pid string, out *mtg.Outp
 	as := proc.buildAccountSnapshot(evt, true)
 	err = m.store.WriteAccountSnapshot(as)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	err = m.store.WritePendingGroupEventAndNonce(evt, out.UTXOID, proc.SignType())
 	if err != nil {
-		panic(err)
+		return err
 	}
 	proc.Nonce = proc.Nonce + 1
+	return nil
+}
+
+// readOutputOwners returns the senders of the output read by the group, or
+// the sender alone if the group can't read them or they are invalid
+func (m *Machine) readOutputOwners(ctx context.Context, out *mtg.Output) ([]string, int, error) {
+	members, threshold := []string{out.Sender}, 1
+	sg, ok := m.group.(SendersGroup)
+	if !ok {
+		return members, threshold, nil
+	}
+	err := m.retryOutput(nil, "ReadOutputSenders", func() error {
+		senders, t, err := sg.ReadOutputSenders(ctx, out)
+		if err != nil || len(senders) == 0 {
+			return err
+		}
+		owners, err := sortGroupEventOwners(senders, t)
+		if err != nil {
+			logger.Verbosef("ReadOutputSenders(%s) => %v", out.UTXOID, err)
+			return nil
+		}
+		members, threshold = owners, t
+		return nil
+	})
+	return members, threshold, err
+}
+
+// sortGroupEventOwners validates and sorts the owners, so the same owners
+// always have the same contract user identity
+func sortGroupEventOwners(owners []string, threshold int) ([]string, error) {
+	if len(owners) == 0 || len(owners) > 64 || threshold <= 0 || threshold > len(owners) {
+		return nil, fmt.Errorf("threshold %d/%d", threshold, len(owners))
+	}
+	members := make([]string, len(owners))
+	copy(members, owners)
+	sort.Strings(members)
+	for i, id := range members {
+		uid, err := uuid.FromString(id)
+		if err != nil || uid == uuid.Nil || (i > 0 && members[i-1] == id) {
+			return nil, fmt.Errorf("member %s", id)
+		}
+	}
+	return members, nil
+}
+
+// CreditGroupId groups the outputs of all credit top-ups, so the refund of a
+// top-up never spends the outputs grouped by the process the sender named
+const CreditGroupId = "MVM:CREDIT"
+
+func (m *Machine) CreditProcess(ctx context.Context, pid string, out *mtg.Output) {
+	if out.AssetID != m.feeAssetId {
+		m.refundOutput(ctx, CreditGroupId, out, "CREDIT:ASSET")
+		return
+	}
+	amount := common.NewIntegerFromString(out.Amount.String())
+	if amount.Sign() <= 0 {
+		return
+	}
+
+	// the refund may take long, so it's not blocking the process readers
+	m.procLock.Lock()
+	proc := m.processes[pid]
+	if proc == nil {
+		m.procLock.Unlock()
+		m.refundOutput(ctx, CreditGroupId, out, "CREDIT:PROCESS")
+		return
+	}
+	defer m.procLock.Unlock()
+
+	var credit common.Integer
+	err := m.retryOutput(m.procLock, "WriteProcessCredit", func() (err error) {
+		credit, err = m.store.WriteProcessCredit(pid, amount, out.UTXOID)
+		return err
+	})
+	if err != nil {
+		m.quarantineOutput(pid, out.UTXOID, err)
+		return
+	}
+	logger.Printf("CreditProcess(%s, %s) => %s", pid, amount, credit)
+	proc.Credit = credit
 }
 
 func OutputGrouper(out *mtg.Output) string {
@@ -217,6 +470,9 @@ func OutputGrouper(out *mtg.Output) string {
 	if err != nil {
 		return ""
 	}
+	if op.Purpose == encoding.OperationPurposeCreditProcess {
+		return CreditGroupId
+	}
 	return op.Process
 }
 
@@ -0,0 +1,1366 @@
+package machine_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/nfo/mtg"
+	"github.com/MixinNetwork/tip/crypto"
+	"github.com/MixinNetwork/tip/crypto/en256"
+	"github.com/MixinNetwork/tip/messenger"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/MixinNetwork/trusted-group/mvm/store"
+	"github.com/drand/kyber"
+	"github.com/drand/kyber/share"
+	"github.com/drand/kyber/sign/tbls"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/gofrs/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testFeeAsset  = "965e5c6e-434c-3fa9-b780-c50f43cd955c"
+	testAsset     = "c94ac88f-4671-3976-b60a-09064f1811e8"
+	testAddress   = "memory-contract"
+	testThreshold = 3
+	testMembers   = 4
+	testTimeout   = 60 * time.Second
+	testMaskKey   = "5a5c8b8e0c5f4f8f9d3a6b1e2c7d4f0a1b2c3d4e5f60718293a4b5c6d7e8f901"
+)
+
+func TestMain(m *testing.M) {
+	machine.ShortenIntervals()
+	os.Exit(m.Run())
+}
+
+type testNode struct {
+	id      string
+	conf    *machine.Configuration
+	machine *machine.Machine
+	store   *store.BadgerStore
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+type testNetwork struct {
+	nodes   []*testNode
+	group   *fakeGroup
+	chain   *memoryChain
+	l2      *memoryChain
+	network *loopbackNetwork
+	members []string
+	dir     string
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// setupTestNetwork boots the machines of the first running members, the
+// other members only join the loopback network
+func setupTestNetwork(t *testing.T, running int) *testNetwork {
+	return setupTestNetworkWith(t, running, nil)
+}
+
+func setupTestNetworkWith(t *testing.T, running int, configure func(i int, conf *machine.Configuration)) *testNetwork {
+	return setupTestNetworkWithKeys(t, generateTBLSKeys(testThreshold, testMembers), running, configure)
+}
+
+func setupTestNetworkWithKeys(t *testing.T, keys *tblsKeys, running int, configure func(i int, conf *machine.Configuration)) *testNetwork {
+	var members []string
+	for i := 0; i < testMembers; i++ {
+		members = append(members, uuid.Must(uuid.NewV4()).String())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	tn := &testNetwork{
+		group:   newFakeGroup(members, testThreshold),
+		chain:   newMemoryChain(keys.commit),
+		l2:      newMemoryChain(keys.commit),
+		network: newLoopbackNetwork(),
+		members: members,
+		dir:     t.TempDir(),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	// the stores are closed before the temporary directory removed
+	t.Cleanup(tn.teardown)
+
+	for i := 0; i < running; i++ {
+		conf := &machine.Configuration{
+			Poly:    keys.poly,
+			Share:   keys.shares[i],
+			Member:  members[i],
+			MaskKey: testMaskKey,
+		}
+		if configure != nil {
+			configure(i, conf)
+		}
+		tn.bootNode(t, conf)
+	}
+	return tn
+}
+
+// bootNode boots the machine of the member in the configuration, with the
+// test fee and engines
+func (tn *testNetwork) bootNode(t *testing.T, conf *machine.Configuration) *testNode {
+	dir, err := os.MkdirTemp(tn.dir, "node")
+	require.Nil(t, err)
+	db, err := store.OpenBadger(tn.ctx, dir)
+	require.Nil(t, err)
+	conf.ProcessFeeAsset = testFeeAsset
+	conf.ProcessFeeAmount = "1"
+
+	node := &testNode{id: conf.Member, conf: conf, store: db}
+	tn.runNode(t, node)
+	tn.nodes = append(tn.nodes, node)
+	return node
+}
+
+// restartNode stops the machine of the node and boots it again with the same
+// store, the in-memory states of the machine are all lost
+func (tn *testNetwork) restartNode(t *testing.T, node *testNode) {
+	node.cancel()
+	<-node.done
+	tn.runNode(t, node)
+}
+
+func (tn *testNetwork) runNode(t *testing.T, node *testNode) {
+	require := require.New(t)
+
+	ctx, cancel := context.WithCancel(tn.ctx)
+	im, err := machine.Boot(ctx, node.conf, tn.group, node.store, tn.network.join(node.id), nil)
+	require.Nil(err)
+	err = im.AddEngine(&memoryEngine{chain: tn.chain})
+	require.Nil(err)
+	err = im.AddEngine(&memoryEngine{chain: tn.l2, platform: memoryL2Platform})
+	require.Nil(err)
+
+	done := make(chan struct{})
+	node.machine, node.cancel, node.done = im, cancel, done
+	go func() {
+		im.Loop(ctx)
+		close(done)
+	}()
+}
+
+func (tn *testNetwork) teardown() {
+	tn.cancel()
+	for _, n := range tn.nodes {
+		<-n.done
+		n.store.Close()
+	}
+}
+
+// processOutput delivers the output to all machines, as the group does
+func (tn *testNetwork) processOutput(sender, asset, amount string, op *encoding.Operation) *mtg.Output {
+	out := &mtg.Output{
+		UTXOID:    uuid.Must(uuid.NewV4()).String(),
+		AssetID:   asset,
+		Sender:    sender,
+		Amount:    decimal.RequireFromString(amount),
+		Memo:      base64.RawURLEncoding.EncodeToString(op.Encode()),
+		CreatedAt: time.Now(),
+	}
+	out.GroupId = machine.OutputGrouper(out)
+	for _, n := range tn.nodes {
+		o := *out
+		n.machine.ProcessOutput(context.Background(), &o)
+	}
+	return out
+}
+
+func (tn *testNetwork) addProcess(t *testing.T) string {
+	pid := uuid.Must(uuid.NewV4()).String()
+	tn.processOutput(pid, testFeeAsset, "1", &encoding.Operation{
+		Purpose:  encoding.OperationPurposeAddProcess,
+		Process:  pid,
+		Platform: memoryPlatform,
+		Address:  testAddress,
+	})
+	for _, n := range tn.nodes {
+		p, err := n.store.ReadProcess(pid)
+		require.Nil(t, err)
+		require.NotNil(t, p)
+		require.Equal(t, memoryPlatform, p.Platform)
+		require.Equal(t, testAddress, p.Address)
+	}
+	return pid
+}
+
+func (tn *testNetwork) deposit(pid, user, amount string, extra []byte) *mtg.Output {
+	return tn.processOutput(user, testAsset, amount, &encoding.Operation{
+		Purpose: encoding.OperationPurposeGroupEvent,
+		Process: pid,
+		Extra:   extra,
+	})
+}
+
+func (tn *testNetwork) waitBalance(t *testing.T, pid, balance string) {
+	t.Helper()
+	waitFor(t, func() bool {
+		for _, n := range tn.nodes {
+			b, err := n.store.ReadAccountBalance(pid, testAsset)
+			if err != nil || b.String() != balance {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func maskUserId(pid, user string) string {
+	key, _ := hex.DecodeString(testMaskKey)
+	return machine.MaskUserId(key, pid, user)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func verifyEventSignature(t *testing.T, tn *testNetwork, evt *encoding.Event) {
+	msg := *evt
+	msg.Signature = nil
+	err := crypto.Verify(tn.chain.commit, msg.Encode(), evt.Signature)
+	require.Nil(t, err)
+}
+
+func TestMachineGroupEvents(t *testing.T) {
+	require := require.New(t)
+	tn := setupTestNetwork(t, testMembers)
+
+	pid := tn.addProcess(t)
+	user := uuid.Must(uuid.NewV4()).String()
+	tn.deposit(pid, user, "2.5", []byte("hello"))
+	tn.deposit(pid, user, "1", []byte("world"))
+
+	// the group events signed by 3/4 members are sent to the contract
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 2 })
+	sent := tn.chain.listSent(testAddress)
+	for i, evt := range sent {
+		require.Equal(uint64(i), evt.Nonce)
+		require.Equal(pid, evt.Process)
+		require.Equal(testAsset, evt.Asset)
+		require.Equal([]string{maskUserId(pid, user)}, evt.Members)
+		require.Equal(1, evt.Threshold)
+		require.Len(evt.Signature, 64)
+		verifyEventSignature(t, tn, evt)
+	}
+	require.Equal("2.50000000", sent[0].Amount.String())
+	require.Equal([]byte("hello"), sent[0].Extra)
+	require.Equal("1.00000000", sent[1].Amount.String())
+	require.Equal([]byte("world"), sent[1].Extra)
+
+	for _, n := range tn.nodes {
+		p, err := n.store.ReadProcess(pid)
+		require.Nil(err)
+		require.Equal(uint64(2), p.Nonce)
+		balance, err := n.store.ReadAccountBalance(pid, testAsset)
+		require.Nil(err)
+		require.Equal("3.50000000", balance.String())
+		waitFor(t, func() bool {
+			evts, err := n.store.ListSignedGroupEvents(pid, 10)
+			return err == nil && len(evts) == 0
+		})
+	}
+
+	// the contract event builds the same group transaction on all members,
+	// the masked user is reversed, and the event with an id never masked
+	// by the process is skipped
+	receiver := uuid.Must(uuid.NewV4()).String()
+	tn.chain.emit(testAddress, &encoding.Event{
+		Process:   pid,
+		Asset:     testAsset,
+		Members:   []string{maskUserId(pid, user), receiver},
+		Threshold: 1,
+		Amount:    common.NewIntegerFromString("1"),
+		Extra:     []byte("unknown"),
+		Timestamp: uint64(time.Now().UnixNano()),
+		Nonce:     0,
+	})
+	tn.chain.emit(testAddress, &encoding.Event{
+		Process:   pid,
+		Asset:     testAsset,
+		Members:   []string{maskUserId(pid, user)},
+		Threshold: 1,
+		Amount:    common.NewIntegerFromString("1.5"),
+		Extra:     []byte("withdrawal"),
+		Timestamp: uint64(time.Now().UnixNano()),
+		Nonce:     1,
+	})
+	tn.waitBalance(t, pid, "2.00000000")
+	txs := tn.group.listTransactions()
+	require.Len(txs, 1)
+	require.Equal(testAsset, txs[0].Asset)
+	require.Equal([]string{user}, txs[0].Receivers)
+	require.Equal(1, txs[0].Threshold)
+	require.Equal("1.50000000", txs[0].Amount)
+	require.Equal(pid, txs[0].GroupId)
+	require.Equal(base64.RawURLEncoding.EncodeToString([]byte("withdrawal")), txs[0].Memo)
+	require.Equal(testMembers, tn.group.countBuilds(txs[0].TraceId))
+	for _, n := range tn.nodes {
+		waitFor(t, func() bool {
+			offset, err := n.store.ReadEngineGroupEventsOffset(pid)
+			return err == nil && offset == 1
+		})
+		qes, err := n.store.ListQuarantinedEvents(pid, 10)
+		require.Nil(err)
+		require.Len(qes, 1)
+		require.Equal(uint64(0), qes[0].Event.Nonce)
+	}
+}
+
+func TestMachineEngineOutage(t *testing.T) {
+	tn := setupTestNetwork(t, testThreshold)
+
+	// the process is added after the outage instead of rejected
+	tn.chain.Lock()
+	tn.chain.outages = 2
+	tn.chain.Unlock()
+	pid := tn.addProcess(t)
+
+	user := uuid.Must(uuid.NewV4()).String()
+	tn.deposit(pid, user, "1", nil)
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 1 })
+}
+
+func TestMachineCreditRefund(t *testing.T) {
+	require := require.New(t)
+	tn := setupTestNetwork(t, testThreshold)
+	pid := tn.addProcess(t)
+	user := uuid.Must(uuid.NewV4()).String()
+
+	credit := func(pid, asset string) *mtg.Output {
+		return tn.processOutput(user, asset, "2", &encoding.Operation{
+			Purpose: encoding.OperationPurposeCreditProcess,
+			Process: pid,
+		})
+	}
+	credit(pid, testFeeAsset)
+	wrong := credit(pid, testAsset)
+	unknown := credit(uuid.Must(uuid.NewV4()).String(), testFeeAsset)
+
+	for _, n := range tn.nodes {
+		p, err := n.store.ReadProcess(pid)
+		require.Nil(err)
+		require.Equal("2.00000000", p.Credit.String())
+	}
+	for _, out := range []*mtg.Output{wrong, unknown} {
+		traceId := mixin.UniqueConversationID(out.UTXOID, "REFUND")
+		require.Equal(len(tn.nodes), tn.group.countBuilds(traceId))
+		tx := tn.group.transactions[traceId]
+		require.Equal(out.AssetID, tx.Asset)
+		require.Equal([]string{user}, tx.Receivers)
+		require.Equal("2", tx.Amount)
+		require.Equal(machine.CreditGroupId, out.GroupId)
+		require.Equal(out.GroupId, tx.GroupId)
+	}
+}
+
+func TestMachineOutputFailures(t *testing.T) {
+	require := require.New(t)
+	tn := setupTestNetwork(t, 1)
+	node := tn.nodes[0]
+	user := uuid.Must(uuid.NewV4()).String()
+	credit := &encoding.Operation{
+		Purpose: encoding.OperationPurposeCreditProcess,
+		Process: uuid.Must(uuid.NewV4()).String(),
+	}
+
+	// the poison failure is quarantined instead of retried forever
+	tn.group.failure = &machine.Error{Stage: "group", Poison: true, Err: fmt.Errorf("poison")}
+	out := tn.processOutput(user, testFeeAsset, "1", credit)
+	qes, err := node.store.ListQuarantinedEvents(machine.CreditGroupId, 10)
+	require.Nil(err)
+	require.Len(qes, 1)
+	require.Equal(machine.QuarantineStageOutput, qes[0].Stage)
+	require.Equal(out.UTXOID, qes[0].Output)
+
+	// the transient failure is retried until the machine shutting down,
+	// then the output is blocked without blocking the machine loop
+	tn.group.Lock()
+	tn.group.failure = fmt.Errorf("transient")
+	tn.group.Unlock()
+	go tn.processOutput(user, testFeeAsset, "1", credit)
+	waitFor(t, func() bool {
+		tn.group.Lock()
+		defer tn.group.Unlock()
+		return len(tn.group.builds) == 2
+	})
+	tn.cancel()
+	select {
+	case <-node.done:
+	case <-time.After(testTimeout):
+		require.Fail("machine loop blocked by the output")
+	}
+}
+
+func TestMachineInvalidPartials(t *testing.T) {
+	require := require.New(t)
+	tn := setupTestNetwork(t, testThreshold)
+	faulty := tn.members[testThreshold]
+	peer := tn.network.join(faulty)
+
+	pid := tn.addProcess(t)
+	user := uuid.Must(uuid.NewV4()).String()
+	out := tn.deposit(pid, user, "1", nil)
+
+	// the faulty member signs with a share of another poly, so all honest
+	// members are required to recover the signature
+	forged := generateTBLSKeys(testThreshold, testMembers).priShares[testThreshold]
+	evt := &encoding.Event{
+		Process:   pid,
+		Asset:     testAsset,
+		Members:   []string{user},
+		Threshold: 1,
+		Amount:    common.NewIntegerFromString("1"),
+		Timestamp: uint64(out.CreatedAt.UnixNano()),
+		Nonce:     0,
+	}
+	sendForgedPartial(t, tn, peer, evt, forged)
+
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 1 })
+	sent := tn.chain.listSent(testAddress)
+	require.Equal(uint64(0), sent[0].Nonce)
+	verifyEventSignature(t, tn, sent[0])
+
+	for _, n := range tn.nodes {
+		pms, err := n.store.ListPeerMisbehaviors(faulty, 10)
+		require.Nil(err)
+		require.Len(pms, 1)
+		require.Equal(machine.PeerMisbehaviorInvalidPartial, pms[0].Kind)
+		require.Equal(pid, pms[0].Process)
+	}
+}
+
+func sendForgedPartial(t *testing.T, tn *testNetwork, peer messenger.Messenger, evt *encoding.Event, forged *share.PriShare) {
+	scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
+	partial, err := scheme.Sign(forged, evt.Encode())
+	require.Nil(t, err)
+
+	msg := *evt
+	msg.Signature = partial
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().UnixNano()))
+	for _, n := range tn.nodes {
+		err = peer.QueueMessage(context.Background(), n.id, append(msg.Encode(), ts...))
+		require.Nil(t, err)
+	}
+}
+
+func TestMachineGroupRotation(t *testing.T) {
+	require := require.New(t)
+	next := generateTBLSKeys(testThreshold, testMembers)
+	tn := setupTestNetworkWith(t, testMembers, func(i int, conf *machine.Configuration) {
+		conf.Rotation = &machine.RotationConfiguration{
+			Poly:  next.poly,
+			Share: next.shares[i],
+			Nonce: 1,
+		}
+		// the last member leaves the new group
+		if i == testMembers-1 {
+			conf.Rotation.Share = ""
+		}
+	})
+
+	pid := tn.addProcess(t)
+	user := uuid.Must(uuid.NewV4()).String()
+	tn.deposit(pid, user, "1", nil)
+	tn.deposit(pid, user, "2", nil)
+
+	// the old and new groups co-sign the new key before the rotation nonce
+	waitFor(t, func() bool { return tn.chain.rotation(testAddress) != nil })
+	r := tn.chain.rotation(testAddress)
+	require.Equal(uint64(1), r.nonce)
+	require.True(r.commit.Equal(next.commit))
+	group, err := r.commit.MarshalBinary()
+	require.Nil(err)
+	for _, n := range tn.nodes {
+		waitFor(t, func() bool {
+			gr, err := n.store.ReadGroupRotation(group)
+			return err == nil && gr != nil && gr.Payload() != nil
+		})
+	}
+
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 2 })
+	sent := tn.chain.listSent(testAddress)
+	verifyEventSignature(t, tn, sent[0])
+	for _, n := range tn.nodes {
+		waitFor(t, func() bool {
+			gr, err := n.store.ReadGroupRotation(group)
+			return err == nil && len(gr.Rotated) == 1 && gr.Rotated[0] == pid
+		})
+	}
+	msg := *sent[1]
+	msg.Signature = nil
+	require.NotNil(crypto.Verify(tn.chain.commit, msg.Encode(), sent[1].Signature))
+	require.Nil(crypto.Verify(next.commit, msg.Encode(), sent[1].Signature))
+}
+
+func TestMachineGroupCommands(t *testing.T) {
+	require := require.New(t)
+	tn := setupTestNetwork(t, testMembers)
+
+	pid := tn.addProcess(t)
+	user := uuid.Must(uuid.NewV4()).String()
+	tn.deposit(pid, user, "1", nil)
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 1 })
+	// all members have sent the event, otherwise a member would send it to
+	// the next contract after evolved
+	for _, n := range tn.nodes {
+		waitFor(t, func() bool {
+			_, full, err := n.store.ReadGroupEventSignatures(pid, 0, machine.SignTypeTBLS)
+			if err != nil || !full {
+				return false
+			}
+			events, err := n.store.ListSignedGroupEvents(pid, 10)
+			return err == nil && len(events) == 0
+		})
+	}
+
+	// the votes from the non-members are ignored
+	vote := func(sender string, op *encoding.Operation) {
+		tn.processOutput(sender, testFeeAsset, "0.00000001", op)
+	}
+	halt := &encoding.Operation{Purpose: encoding.OperationPurposeHaltProcess, Process: pid}
+	vote(user, halt)
+	for _, m := range tn.members[:testThreshold-1] {
+		vote(m, halt)
+		vote(m, halt)
+	}
+	p, err := tn.nodes[0].store.ReadProcess(pid)
+	require.Nil(err)
+	require.False(p.Halted)
+	vote(tn.members[testThreshold-1], halt)
+	for _, n := range tn.nodes {
+		p, err := n.store.ReadProcess(pid)
+		require.Nil(err)
+		require.True(p.Halted)
+	}
+	waitFor(t, func() bool {
+		halted, _ := tn.chain.state(testAddress)
+		return halted
+	})
+
+	// the events are kept until the process evolved to the next contract
+	tn.deposit(pid, user, "2", nil)
+
+	// the registry evolves only to the next one deployed with another PID
+	tn.chain.deploy(testAddress, pid)
+	forged := "memory-forged-contract"
+	tn.chain.deploy(forged, pid)
+	evolve := &encoding.Operation{Purpose: encoding.OperationPurposeEvolveProcess, Process: pid, Address: forged}
+	for _, m := range tn.members {
+		vote(m, evolve)
+	}
+	for _, n := range tn.nodes {
+		p, err := n.store.ReadProcess(pid)
+		require.Nil(err)
+		require.Equal(testAddress, p.Address)
+	}
+	_, evolved := tn.chain.state(testAddress)
+	require.Equal("", evolved)
+
+	next := "memory-next-contract"
+	tn.chain.deploy(next, uuid.Must(uuid.NewV4()).String())
+	evolve = &encoding.Operation{Purpose: encoding.OperationPurposeEvolveProcess, Process: pid, Address: next}
+	for _, m := range tn.members[1:] {
+		vote(m, evolve)
+	}
+	waitFor(t, func() bool { return len(tn.chain.listSent(next)) == 1 })
+	_, evolved = tn.chain.state(testAddress)
+	require.Equal(next, evolved)
+	require.Len(tn.chain.listSent(testAddress), 1)
+	sent := tn.chain.listSent(next)
+	require.Equal(uint64(1), sent[0].Nonce)
+	require.Equal("2.00000000", sent[0].Amount.String())
+	for _, n := range tn.nodes {
+		waitFor(t, func() bool {
+			p, err := n.store.ReadProcess(pid)
+			return err == nil && p.Address == next && !p.Halted
+		})
+	}
+}
+
+func TestMachineMultisigOwners(t *testing.T) {
+	require := require.New(t)
+	tn := setupTestNetwork(t, testMembers)
+
+	pid := tn.addProcess(t)
+	var owners []string
+	for i := 0; i < 3; i++ {
+		owners = append(owners, uuid.Must(uuid.NewV4()).String())
+	}
+	// the output proves the sender only, so each deposit is owned by it alone
+	for _, o := range owners {
+		tn.deposit(pid, o, "1", nil)
+	}
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 3 })
+	for i, evt := range tn.chain.listSent(testAddress) {
+		require.Equal([]string{maskUserId(pid, owners[i])}, evt.Members)
+		require.Equal(1, evt.Threshold)
+	}
+
+	// the 2/3 multisig deposit is owned by the senders read by the group,
+	// and the invalid senders fall back to the sender alone
+	multisig := uuid.Must(uuid.NewV4()).String()
+	tn.group.sendFrom(multisig, owners, 2)
+	tn.deposit(pid, multisig, "1", nil)
+	invalid := uuid.Must(uuid.NewV4()).String()
+	tn.group.sendFrom(invalid, owners, 4)
+	tn.deposit(pid, invalid, "1", nil)
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 5 })
+	sent := tn.chain.listSent(testAddress)
+	var masks []string
+	for _, o := range owners {
+		masks = append(masks, maskUserId(pid, o))
+	}
+	sort.Strings(masks)
+	require.Equal(masks, sent[3].Members)
+	require.Equal(2, sent[3].Threshold)
+	require.Equal([]string{maskUserId(pid, invalid)}, sent[4].Members)
+	require.Equal(1, sent[4].Threshold)
+
+	// the contract withdraws to the multisig owners
+	tn.chain.emit(testAddress, &encoding.Event{
+		Process:   pid,
+		Asset:     testAsset,
+		Members:   sent[3].Members,
+		Threshold: 2,
+		Amount:    common.NewIntegerFromString("2"),
+		Timestamp: uint64(time.Now().UnixNano()),
+		Nonce:     0,
+	})
+	tn.waitBalance(t, pid, "3.00000000")
+	txs := tn.group.listTransactions()
+	require.Len(txs, 1)
+	require.ElementsMatch(owners, txs[0].Receivers)
+	require.Equal(2, txs[0].Threshold)
+}
+
+func TestMachineCollectibles(t *testing.T) {
+	require := require.New(t)
+	tn := setupTestNetwork(t, testMembers)
+
+	pid := tn.addProcess(t)
+	token := &machine.CollectibleToken{
+		Id: uuid.Must(uuid.NewV4()).String(),
+	}
+	hash := sha256.Sum256([]byte("collectible"))
+	token.Hash = hash[:]
+	for _, n := range tn.nodes {
+		require.Nil(n.store.WriteCollectibleToken(token))
+	}
+	user := uuid.Must(uuid.NewV4()).String()
+	op := &encoding.Operation{
+		Purpose: encoding.OperationPurposeGroupEvent,
+		Process: pid,
+		Extra:   []byte("nft"),
+	}
+	out := &mtg.CollectibleOutput{
+		OutputId:         uuid.Must(uuid.NewV4()).String(),
+		TokenId:          token.Id,
+		Amount:           "1",
+		SendersThreshold: 1,
+		Senders:          []string{user},
+		Memo:             base64.RawURLEncoding.EncodeToString(op.Encode()),
+		CreatedAt:        time.Now(),
+	}
+	for _, n := range tn.nodes {
+		o := *out
+		n.machine.ProcessCollectibleOutput(context.Background(), &o)
+		n.machine.ProcessCollectibleOutput(context.Background(), &o)
+	}
+
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 1 })
+	evt := tn.chain.listSent(testAddress)[0]
+	verifyEventSignature(t, tn, evt)
+	require.True(evt.IsCollectible())
+	require.Equal("1.00000000", evt.Amount.String())
+	require.Equal([]string{maskUserId(pid, user)}, evt.Members)
+	c, err := encoding.DecodeCollectible(evt.Extra)
+	require.Nil(err)
+	require.Equal(token.Id, c.Token)
+	require.Equal(token.Hash, c.Hash)
+	require.Equal([]byte("nft"), c.Extra)
+	for _, n := range tn.nodes {
+		b, err := n.store.ReadAccountBalance(pid, token.Id)
+		require.Nil(err)
+		require.Equal("1.00000000", b.String())
+	}
+
+	// the contract sends the collectible back to the user
+	tn.chain.emit(testAddress, &encoding.Event{
+		Process:   pid,
+		Asset:     encoding.CollectibleAsset,
+		Members:   evt.Members,
+		Threshold: 1,
+		Amount:    common.NewInteger(1),
+		Extra:     (&encoding.Collectible{Token: token.Id, Hash: token.Hash}).Encode(),
+		Timestamp: uint64(time.Now().UnixNano()),
+		Nonce:     0,
+	})
+	waitFor(t, func() bool { return len(tn.group.listTransactions()) == 1 })
+	tx := tn.group.listTransactions()[0]
+	require.Equal(token.Id, tx.Asset)
+	require.Equal("1", tx.Amount)
+	require.Equal([]string{user}, tx.Receivers)
+	waitFor(t, func() bool {
+		for _, n := range tn.nodes {
+			b, err := n.store.ReadAccountBalance(pid, token.Id)
+			if err != nil || b.Sign() != 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// the L2 contracts don't encode collectibles, so the deposit is refunded
+	l2 := uuid.Must(uuid.NewV4()).String()
+	tn.processOutput(l2, testFeeAsset, "1", &encoding.Operation{
+		Purpose:  encoding.OperationPurposeAddProcess,
+		Process:  l2,
+		Platform: memoryL2Platform,
+		Address:  testAddress,
+	})
+	op.Process = l2
+	out.OutputId = uuid.Must(uuid.NewV4()).String()
+	out.Memo = base64.RawURLEncoding.EncodeToString(op.Encode())
+	for _, n := range tn.nodes {
+		o := *out
+		n.machine.ProcessCollectibleOutput(context.Background(), &o)
+	}
+	refund := mixin.UniqueConversationID(out.OutputId, "REFUND")
+	waitFor(t, func() bool { return tn.group.countBuilds(refund) == len(tn.nodes) })
+	for _, tx := range tn.group.listTransactions() {
+		if tx.TraceId == refund {
+			require.Equal(token.Id, tx.Asset)
+			require.Equal([]string{user}, tx.Receivers)
+		}
+	}
+	require.Len(tn.l2.listSent(testAddress), 0)
+	for _, n := range tn.nodes {
+		b, err := n.store.ReadAccountBalance(l2, token.Id)
+		require.Nil(err)
+		require.Equal(0, b.Sign())
+	}
+
+	// the outputs can't be refunded are quarantined instead of dropped
+	op.Process = pid
+	out.Memo = base64.RawURLEncoding.EncodeToString(op.Encode())
+	amount, senders := *out, *out
+	amount.OutputId, amount.Amount = uuid.Must(uuid.NewV4()).String(), "2"
+	senders.OutputId, senders.SendersThreshold = uuid.Must(uuid.NewV4()).String(), 2
+	for _, n := range tn.nodes {
+		for _, invalid := range []mtg.CollectibleOutput{amount, senders} {
+			o := invalid
+			n.machine.ProcessCollectibleOutput(context.Background(), &o)
+		}
+		qes, err := n.store.ListQuarantinedEvents(pid, 10)
+		require.Nil(err)
+		require.Len(qes, 2)
+		var outputs []string
+		for _, qe := range qes {
+			require.Equal(machine.QuarantineStageOutput, qe.Stage)
+			outputs = append(outputs, qe.Output)
+		}
+		require.ElementsMatch([]string{amount.OutputId, senders.OutputId}, outputs)
+	}
+	require.Len(tn.chain.listSent(testAddress), 1)
+}
+
+func TestMachineProcessPlatforms(t *testing.T) {
+	require := require.New(t)
+	tn := setupTestNetwork(t, testMembers)
+
+	pid := tn.addProcess(t)
+	// the same contract address is another process on another chain
+	l2 := uuid.Must(uuid.NewV4()).String()
+	tn.processOutput(l2, testFeeAsset, "1", &encoding.Operation{
+		Purpose:  encoding.OperationPurposeAddProcess,
+		Process:  l2,
+		Platform: memoryL2Platform,
+		Address:  testAddress,
+	})
+	for _, n := range tn.nodes {
+		p, err := n.store.ReadProcess(l2)
+		require.Nil(err)
+		require.NotNil(p)
+		require.Equal(memoryL2Platform, p.Platform)
+	}
+	dup := uuid.Must(uuid.NewV4()).String()
+	tn.processOutput(dup, testFeeAsset, "1", &encoding.Operation{
+		Purpose:  encoding.OperationPurposeAddProcess,
+		Process:  dup,
+		Platform: memoryL2Platform,
+		Address:  testAddress,
+	})
+	p, err := tn.nodes[0].store.ReadProcess(dup)
+	require.Nil(err)
+	require.Nil(p)
+
+	user := uuid.Must(uuid.NewV4()).String()
+	tn.deposit(l2, user, "2", nil)
+	tn.deposit(pid, user, "1", nil)
+	waitFor(t, func() bool {
+		return len(tn.l2.listSent(testAddress)) == 1 && len(tn.chain.listSent(testAddress)) == 1
+	})
+	require.Equal(l2, tn.l2.listSent(testAddress)[0].Process)
+	require.Equal(pid, tn.chain.listSent(testAddress)[0].Process)
+}
+
+func TestMachineMaskKey(t *testing.T) {
+	require := require.New(t)
+	tn := setupTestNetworkWith(t, testMembers, func(i int, conf *machine.Configuration) {
+		conf.MaskKey = ""
+	})
+
+	// the key is optional until the first masked process added
+	node := tn.nodes[0]
+	node.cancel()
+	<-node.done
+	node.conf.MaskKey = "invalid"
+	_, err := machine.Boot(tn.ctx, node.conf, tn.group, node.store, tn.network.join(node.id), nil)
+	require.NotNil(err)
+	require.Contains(err.Error(), "invalid machine.mask-key")
+
+	pid := uuid.Must(uuid.NewV4()).String()
+	err = node.store.WriteProcess(&machine.Process{
+		Identifier: pid,
+		Platform:   memoryPlatform,
+		Address:    testAddress,
+		Credit:     common.Zero,
+		Masked:     true,
+	})
+	require.Nil(err)
+	node.conf.MaskKey = ""
+	_, err = machine.Boot(tn.ctx, node.conf, tn.group, node.store, tn.network.join(node.id), nil)
+	require.NotNil(err)
+	require.Contains(err.Error(), "required by the masked process "+pid)
+	node.conf.MaskKey = testMaskKey
+	tn.runNode(t, node)
+}
+
+func TestMachineKeygen(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := newLoopbackNetwork()
+	var members []string
+	for i := 0; i < testMembers; i++ {
+		members = append(members, uuid.Must(uuid.NewV4()).String())
+	}
+	sort.Strings(members)
+
+	results := make(chan *keygenResult, testMembers)
+	run := func(ctx context.Context, id, path string) {
+		kg, err := machine.NewKeygen(network.join(id), members, testThreshold, id, 1, path)
+		require.Nil(err)
+		poly, share, err := kg.Run(ctx)
+		results <- &keygenResult{id: id, poly: poly, share: share, err: err}
+	}
+
+	// the last member quits once its deal persisted, then resumes
+	paths := make([]string, testMembers)
+	for i, id := range members {
+		paths[i] = filepath.Join(t.TempDir(), "keygen.json")
+		if i < testMembers-1 {
+			go run(ctx, id, paths[i])
+		}
+	}
+	dropped, drop := context.WithCancel(ctx)
+	go run(dropped, members[testMembers-1], paths[testMembers-1])
+	waitFor(t, func() bool {
+		b, _ := os.ReadFile(paths[testMembers-1])
+		return bytes.Contains(b, []byte(fmt.Sprintf(`"2:%s"`, members[testMembers-1])))
+	})
+	drop()
+	r := <-results
+	require.Equal(members[testMembers-1], r.id)
+	require.NotNil(r.err)
+	go run(ctx, members[testMembers-1], paths[testMembers-1])
+
+	verifyKeygenResults(t, results, members, members, testThreshold)
+}
+
+func TestMachineReshare(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := newLoopbackNetwork()
+	keys := generateTBLSKeys(testThreshold, testMembers)
+	var old []string
+	for i := 0; i < testMembers; i++ {
+		old = append(old, uuid.Must(uuid.NewV4()).String())
+	}
+	sort.Strings(old)
+	poly, err := hex.DecodeString(keys.poly)
+	require.Nil(err)
+
+	// the first member leaves, and two members join with a higher threshold
+	members := append([]string{}, old[1:]...)
+	members = append(members, uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String())
+	sort.Strings(members)
+	threshold := testThreshold + 1
+
+	peers := append([]string{old[0]}, members...)
+	results := make(chan *keygenResult, len(peers))
+	for _, id := range peers {
+		var priv []byte
+		if i := sort.SearchStrings(old, id); i < len(old) && old[i] == id {
+			priv, err = hex.DecodeString(keys.shares[i])
+			require.Nil(err)
+		}
+		path := filepath.Join(t.TempDir(), "reshare.json")
+		kg, err := machine.NewReshare(network.join(id), old, poly, priv, members, threshold, id, 1, path)
+		require.Nil(err)
+		go func(id string) {
+			poly, share, err := kg.Run(ctx)
+			results <- &keygenResult{id: id, poly: poly, share: share, err: err}
+		}(id)
+	}
+
+	commit := verifyKeygenResults(t, results, peers, members, threshold)
+	require.True(commit.Equal(keys.commit))
+}
+
+func TestMachineShareRefresh(t *testing.T) {
+	require := require.New(t)
+	keys := generateTBLSKeys(testThreshold, testMembers)
+	next := refreshTBLSKeys(keys)
+	tn := setupTestNetworkWithKeys(t, keys, testThreshold, func(i int, conf *machine.Configuration) {
+		conf.Rotation = &machine.RotationConfiguration{
+			Poly:  next.poly,
+			Share: next.shares[i],
+			Nonce: 1,
+		}
+	})
+	require.True(next.commit.Equal(keys.commit))
+	spy := tn.network.join(tn.members[testThreshold])
+
+	pid := tn.addProcess(t)
+	user := uuid.Must(uuid.NewV4()).String()
+	tn.deposit(pid, user, "1", nil)
+	tn.deposit(pid, user, "2", nil)
+
+	// the same group key signs the events before and after the nonce, and
+	// the contract needs no rotation
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 2 })
+	for _, evt := range tn.chain.listSent(testAddress) {
+		verifyEventSignature(t, tn, evt)
+	}
+	require.Nil(tn.chain.rotation(testAddress))
+
+	// the partials from the nonce are signed with the new shares
+	scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
+	for partials := 0; partials < testThreshold; {
+		_, b, err := spy.ReceiveMessage(context.Background())
+		require.Nil(err)
+		evt, err := encoding.DecodeEvent(b[:len(b)-8])
+		if err != nil || evt.Process != pid || evt.Nonce != 1 || len(evt.Signature) == 64 {
+			continue
+		}
+		partial := evt.Signature
+		evt.Signature = nil
+		require.Nil(scheme.VerifyPartial(next.pubPoly, evt.Encode(), partial))
+		require.NotNil(scheme.VerifyPartial(keys.pubPoly, evt.Encode(), partial))
+		partials++
+	}
+}
+
+func TestMachineReshareMembers(t *testing.T) {
+	require := require.New(t)
+	keys := generateTBLSKeys(testThreshold, testMembers)
+	next := reshareTBLSKeys(keys, testThreshold+1, testMembers+1)
+	tn := setupTestNetworkWithKeys(t, keys, 0, nil)
+
+	// the last old member is offline, so the new member's partial is needed
+	// to reach the higher threshold of the larger new group
+	joining := uuid.Must(uuid.NewV4()).String()
+	members := append(append([]string{}, tn.members...), joining)
+	rotation := func(i int) *machine.RotationConfiguration {
+		return &machine.RotationConfiguration{
+			Poly:    next.poly,
+			Share:   next.shares[i],
+			Nonce:   1,
+			Members: members,
+		}
+	}
+	for i := 0; i < testThreshold; i++ {
+		tn.bootNode(t, &machine.Configuration{
+			Poly:     keys.poly,
+			Share:    keys.shares[i],
+			Member:   tn.members[i],
+			MaskKey:  testMaskKey,
+			Rotation: rotation(i),
+		})
+	}
+	tn.network.join(tn.members[testThreshold])
+	node := tn.bootNode(t, &machine.Configuration{
+		Poly:     keys.poly,
+		Member:   joining,
+		MaskKey:  testMaskKey,
+		Rotation: rotation(testMembers),
+	})
+
+	pid := tn.addProcess(t)
+	user := uuid.Must(uuid.NewV4()).String()
+	tn.deposit(pid, user, "1", nil)
+	tn.deposit(pid, user, "2", nil)
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 2 })
+	for _, evt := range tn.chain.listSent(testAddress) {
+		verifyEventSignature(t, tn, evt)
+	}
+	require.Nil(tn.chain.rotation(testAddress))
+
+	// the new member signs the event from the nonce with the new share, and
+	// gets the signature of the event before the nonce from the old group
+	for nonce := uint64(0); nonce < 2; nonce++ {
+		waitFor(t, func() bool {
+			_, full, err := node.store.ReadGroupEventSignatures(pid, nonce, machine.SignTypeTBLS)
+			return err == nil && full
+		})
+	}
+	pms, err := node.store.ListPeerMisbehaviors(tn.members[0], 10)
+	require.Nil(err)
+	require.Len(pms, 0)
+	pms, err = tn.nodes[0].store.ListPeerMisbehaviors(joining, 10)
+	require.Nil(err)
+	require.Len(pms, 0)
+}
+
+func TestMachineMessageEnvelope(t *testing.T) {
+	require := require.New(t)
+	keys := generateTBLSKeys(testThreshold, testMembers)
+	tn := setupTestNetworkWithKeys(t, keys, testThreshold, nil)
+	legacy := tn.network.join(tn.members[testThreshold])
+
+	pid := tn.addProcess(t)
+	user := uuid.Must(uuid.NewV4()).String()
+	tn.deposit(pid, user, "1", nil)
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 1 })
+
+	// the peer not known to accept the envelope gets the legacy messages
+	msg, evt := receiveGroupMessage(t, legacy, pid, 0)
+	require.Equal(0, msg.Version)
+	require.Equal(machine.MessageTypePartial, msg.Type)
+	require.Equal(uint64(1), msg.Timestamp>>63)
+	require.Len(evt.Signature, 66)
+
+	// the legacy message flagged by the upgraded peer switches the envelope
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().UnixNano())|1<<63)
+	full := tn.chain.listSent(testAddress)[0]
+	for _, n := range tn.nodes {
+		err := legacy.QueueMessage(context.Background(), n.id, append(full.Encode(), ts...))
+		require.Nil(err)
+	}
+	for _, n := range tn.nodes {
+		waitFor(t, func() bool {
+			envelopes, err := n.store.ListPeerEnvelopes()
+			_, found := envelopes[tn.members[testThreshold]]
+			return err == nil && found
+		})
+	}
+	tn.deposit(pid, user, "2", nil)
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 2 })
+	msg, evt = receiveGroupMessage(t, legacy, pid, 1)
+	require.Equal(machine.MessageVersion, msg.Version)
+	require.Equal(machine.MessageTypePartial, msg.Type)
+	require.Contains(tn.members[:testThreshold], msg.Sender)
+	require.Len(msg.Auth, 66)
+	require.Len(evt.Signature, 66)
+	verifyEventSignature(t, tn, tn.chain.listSent(testAddress)[1])
+
+	encoded := msg.Encode()
+	decoded, _, err := machine.DecodeMessage(encoded)
+	require.Nil(err)
+	require.Equal(msg, decoded)
+	_, _, err = machine.DecodeMessage(encoded[:len(encoded)/2])
+	require.NotNil(err)
+
+	// the stale envelope is dropped, and the legacy message from the peer
+	// sent the envelope is a misbehavior
+	envelope := &machine.Message{
+		Version:   machine.MessageVersion,
+		Type:      machine.MessageTypeFull,
+		Sender:    tn.members[testThreshold],
+		Timestamp: uint64(time.Now().UnixNano()),
+		Payload:   full.Encode(),
+	}
+	require.Nil(envelope.Sign(keys.priShares[testThreshold]))
+	// the stale one is signed by another share, which is a misbehavior if
+	// the envelope were not dropped
+	stale := *envelope
+	stale.Timestamp = uint64(time.Now().Add(-time.Hour).UnixNano())
+	require.Nil(stale.Sign(keys.priShares[0]))
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().UnixNano()))
+	for _, n := range tn.nodes {
+		for _, b := range [][]byte{envelope.Encode(), stale.Encode(), append(full.Encode(), ts...)} {
+			err = legacy.QueueMessage(context.Background(), n.id, b)
+			require.Nil(err)
+		}
+	}
+	for _, n := range tn.nodes {
+		var pms []*machine.PeerMisbehavior
+		waitFor(t, func() bool {
+			pms, err = n.store.ListPeerMisbehaviors(tn.members[testThreshold], 10)
+			return err == nil && len(pms) > 0
+		})
+		require.Len(pms, 1)
+		require.Equal(machine.PeerMisbehaviorInvalidMessage, pms[0].Kind)
+		require.Contains(pms[0].Reason, "legacy message")
+	}
+}
+
+func TestMachinePeerFiltering(t *testing.T) {
+	require := require.New(t)
+	keys := generateTBLSKeys(testThreshold, testMembers)
+	tn := setupTestNetworkWithKeys(t, keys, testThreshold, nil)
+	faulty := tn.members[testThreshold]
+	peer := tn.network.join(faulty)
+	outsider := uuid.Must(uuid.NewV4()).String()
+	stranger := tn.network.join(outsider)
+
+	pid := tn.addProcess(t)
+	evt := &encoding.Event{
+		Process:   pid,
+		Asset:     testAsset,
+		Members:   []string{uuid.Must(uuid.NewV4()).String()},
+		Threshold: 1,
+		Amount:    common.NewIntegerFromString("1"),
+		Timestamp: uint64(time.Now().UnixNano()),
+		Nonce:     100,
+	}
+
+	// the forged partial of a non-member is dropped without any record
+	forged := generateTBLSKeys(testThreshold, testMembers).priShares[0]
+	sendForgedPartial(t, tn, stranger, evt, forged)
+
+	// the envelope binds the faulty member to its share index, then the
+	// valid partial of another share relayed by it is rejected
+	msg := &machine.Message{
+		Version:   machine.MessageVersion,
+		Type:      machine.MessageTypePartial,
+		Sender:    faulty,
+		Timestamp: uint64(time.Now().UnixNano()),
+	}
+	scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
+	partial, err := scheme.Sign(keys.priShares[testThreshold], evt.Encode())
+	require.Nil(err)
+	signed := *evt
+	signed.Signature = partial
+	msg.Payload = signed.Encode()
+	require.Nil(msg.Sign(keys.priShares[testThreshold]))
+	for _, n := range tn.nodes {
+		err = peer.QueueMessage(context.Background(), n.id, msg.Encode())
+		require.Nil(err)
+	}
+	partial, err = scheme.Sign(keys.priShares[0], evt.Encode())
+	require.Nil(err)
+	signed.Signature = partial
+	msg.Payload = signed.Encode()
+	require.Nil(msg.Sign(keys.priShares[testThreshold]))
+	for _, n := range tn.nodes {
+		err = peer.QueueMessage(context.Background(), n.id, msg.Encode())
+		require.Nil(err)
+	}
+
+	// the flood exceeding the burst is dropped and recorded once
+	for i := 0; i < 2000; i++ {
+		err = peer.QueueMessage(context.Background(), tn.nodes[0].id, []byte("flood"))
+		require.Nil(err)
+	}
+
+	waitFor(t, func() bool {
+		pms, err := tn.nodes[0].store.ListPeerMisbehaviors(faulty, 10)
+		return err == nil && len(pms) == 2
+	})
+	for i, n := range tn.nodes {
+		pms, err := n.store.ListPeerMisbehaviors(outsider, 10)
+		require.Nil(err)
+		require.Len(pms, 0)
+
+		waitFor(t, func() bool {
+			pms, err = n.store.ListPeerMisbehaviors(faulty, 10)
+			return err == nil && len(pms) > 0
+		})
+		kinds := make(map[string]bool)
+		for _, pm := range pms {
+			kinds[pm.Kind] = true
+		}
+		require.True(kinds[machine.PeerMisbehaviorInvalidPartial])
+		require.Equal(i == 0, kinds[machine.PeerMisbehaviorRateLimit])
+		require.Len(pms, len(kinds))
+	}
+}
+
+func TestMachineSyncGroupEvents(t *testing.T) {
+	require := require.New(t)
+	tn := setupTestNetwork(t, testMembers)
+	lagging := tn.nodes[testMembers-1]
+
+	pid := tn.addProcess(t)
+	user := uuid.Must(uuid.NewV4()).String()
+	tn.deposit(pid, user, "1", nil)
+	waitFor(t, func() bool {
+		_, full, err := lagging.store.ReadGroupEventSignatures(pid, 0, machine.SignTypeTBLS)
+		return err == nil && full
+	})
+
+	// the member misses all broadcasts of the event, so it has only its own
+	// partial, and the peers won't send the signature again in an hour
+	tn.network.disconnect(lagging.id, true)
+	tn.deposit(pid, user, "2", nil)
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 2 })
+	waitFor(t, func() bool {
+		partials, full, err := lagging.store.ReadGroupEventSignatures(pid, 1, machine.SignTypeTBLS)
+		return err == nil && !full && len(partials) == 1
+	})
+	tn.network.disconnect(lagging.id, false)
+
+	var sigs [][]byte
+	waitFor(t, func() bool {
+		var full bool
+		var err error
+		sigs, full, err = lagging.store.ReadGroupEventSignatures(pid, 1, machine.SignTypeTBLS)
+		return err == nil && full
+	})
+	require.Equal(tn.chain.listSent(testAddress)[1].Signature, sigs[0])
+	pms, err := lagging.store.ListPeerMisbehaviors(tn.members[0], 10)
+	require.Nil(err)
+	require.Len(pms, 0)
+}
+
+func TestMachineSyncRestartedNode(t *testing.T) {
+	require := require.New(t)
+	tn := setupTestNetwork(t, testMembers)
+	lagging := tn.nodes[testMembers-1]
+
+	pid := tn.addProcess(t)
+	user := uuid.Must(uuid.NewV4()).String()
+	tn.deposit(pid, user, "1", nil)
+	waitFor(t, func() bool {
+		_, full, err := lagging.store.ReadGroupEventSignatures(pid, 0, machine.SignTypeTBLS)
+		return err == nil && full
+	})
+
+	// the member restarts after missing all broadcasts of the event, so it
+	// must remember the envelope peers to sync and send its partial
+	tn.network.disconnect(lagging.id, true)
+	tn.deposit(pid, user, "2", nil)
+	waitFor(t, func() bool { return len(tn.chain.listSent(testAddress)) == 2 })
+	waitFor(t, func() bool {
+		partials, full, err := lagging.store.ReadGroupEventSignatures(pid, 1, machine.SignTypeTBLS)
+		return err == nil && !full && len(partials) == 1
+	})
+	tn.restartNode(t, lagging)
+	tn.network.disconnect(lagging.id, false)
+
+	var sigs [][]byte
+	waitFor(t, func() bool {
+		var full bool
+		var err error
+		sigs, full, err = lagging.store.ReadGroupEventSignatures(pid, 1, machine.SignTypeTBLS)
+		return err == nil && full
+	})
+	require.Equal(tn.chain.listSent(testAddress)[1].Signature, sigs[0])
+	for _, n := range tn.nodes[:testMembers-1] {
+		pms, err := n.store.ListPeerMisbehaviors(lagging.id, 10)
+		require.Nil(err)
+		require.Len(pms, 0)
+		pms, err = lagging.store.ListPeerMisbehaviors(n.id, 10)
+		require.Nil(err)
+		require.Len(pms, 0)
+	}
+}
+
+// receiveGroupMessage returns the first message of the event from the peer
+func receiveGroupMessage(t *testing.T, peer messenger.Messenger, pid string, nonce uint64) (*machine.Message, *encoding.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	for {
+		_, b, err := peer.ReceiveMessage(ctx)
+		require.Nil(t, err)
+		msg, evt, err := machine.DecodeMessage(b)
+		if err == nil && evt.Process == pid && evt.Nonce == nonce && msg.Type < machine.MessageTypeSyncRequest {
+			return msg, evt
+		}
+	}
+}
+
+type keygenResult struct {
+	id, poly, share string
+	err             error
+}
+
+// verifyKeygenResults waits the results of all peers, then checks the poly
+// and shares of the members by a recovered signature
+func verifyKeygenResults(t *testing.T, results chan *keygenResult, peers, members []string, threshold int) kyber.Point {
+	require := require.New(t)
+	polys := make(map[string]bool)
+	scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
+	msg := []byte("keygen")
+	var partials [][]byte
+	for range peers {
+		var r *keygenResult
+		select {
+		case r = <-results:
+		case <-time.After(testTimeout):
+			t.Fatal("timeout")
+		}
+		require.Nil(r.err)
+		polys[r.poly] = true
+
+		i := sort.SearchStrings(members, r.id)
+		if i == len(members) || members[i] != r.id {
+			require.Equal("", r.share)
+			continue
+		}
+		b, err := hex.DecodeString(r.share)
+		require.Nil(err)
+		require.Equal(i, int(binary.BigEndian.Uint32(b[:4])))
+		ps := &share.PriShare{I: i, V: en256.NewSuiteG2().Scalar().SetBytes(b[4:])}
+		partial, err := scheme.Sign(ps, msg)
+		require.Nil(err)
+		partials = append(partials, partial)
+	}
+	require.Len(polys, 1)
+	require.Len(partials, len(members))
+
+	var commits []kyber.Point
+	for p := range polys {
+		b, err := hex.DecodeString(p)
+		require.Nil(err)
+		require.Len(b, threshold*128)
+		for i := 0; i < threshold; i++ {
+			point, err := crypto.PubKeyFromBytes(b[i*128 : (i+1)*128])
+			require.Nil(err)
+			commits = append(commits, point)
+		}
+	}
+	pub := share.NewPubPoly(en256.NewSuiteG2(), nil, commits)
+	sig, err := scheme.Recover(pub, msg, partials[1:], threshold, len(members))
+	require.Nil(err)
+	require.Nil(crypto.Verify(pub.Commit(), msg, sig))
+	return pub.Commit()
+}
@@ -0,0 +1,99 @@
+package machine
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/gofrs/uuid"
+)
+
+// parseMaskKey returns nil if the key is not configured, which is allowed
+// only before the first masked process added
+func parseMaskKey(conf string, store Store) ([]byte, error) {
+	if conf != "" {
+		key, err := hex.DecodeString(conf)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("invalid machine.mask-key %s", conf)
+		}
+		return key, nil
+	}
+	processes, err := store.ListProcesses()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range processes {
+		if p.Masked {
+			return nil, fmt.Errorf("machine.mask-key required by the masked process %s", p.Identifier)
+		}
+	}
+	return nil, nil
+}
+
+// maskKeyDigest is logged for the members to check they have the same key
+func maskKeyDigest(key []byte) string {
+	if key == nil {
+		return ""
+	}
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:8])
+}
+
+// MaskUserId returns the deterministic masked id of the user in the process,
+// keyed by the group mask key, so the ids published by different processes
+// can't be linked to each other, or to a guessed user id without the key
+func MaskUserId(key []byte, pid, user string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(pid + ":MASK:" + user))
+	h := mac.Sum(nil)
+	h[6] = (h[6] & 0x0f) | 0x40
+	h[8] = (h[8] & 0x3f) | 0x80
+	id, err := uuid.FromBytes(h[:16])
+	if err != nil {
+		panic(err)
+	}
+	return id.String()
+}
+
+// maskGroupEventMembers persists the masks of the members, and returns the
+// masks sorted, which are the contract user identity of the members
+func (m *Machine) maskGroupEventMembers(p *Process, members []string) ([]string, error) {
+	if !p.Masked {
+		return members, nil
+	}
+	masks := make([]string, len(members))
+	for i, user := range members {
+		masks[i] = MaskUserId(m.maskKey, p.Identifier, user)
+		err := m.store.WriteUserMask(p.Identifier, user, masks[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(masks)
+	return masks, nil
+}
+
+// unmaskGroupEvent returns a copy of the event to the real users, the event
+// is invalid if any id is never masked by the process
+func (m *Machine) unmaskGroupEvent(p *Process, evt *encoding.Event) (*encoding.Event, error) {
+	if !p.Masked {
+		return evt, nil
+	}
+	members := make([]string, len(evt.Members))
+	for i, mask := range evt.Members {
+		user, err := m.store.ReadMaskedUser(p.Identifier, mask)
+		if err != nil {
+			return nil, err
+		}
+		if user == "" {
+			return nil, poisonEventError(QuarantineStageReceive, evt, fmt.Errorf("%w: unknown mask %s", ErrorInvalidEvent, mask))
+		}
+		members[i] = user
+	}
+	e := *evt
+	e.Members = members
+	return &e, nil
+}
@@ -0,0 +1,577 @@
+package machine_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/nfo/mtg"
+	"github.com/MixinNetwork/tip/crypto"
+	"github.com/MixinNetwork/tip/crypto/en256"
+	"github.com/MixinNetwork/tip/messenger"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/drand/kyber"
+	"github.com/drand/kyber/share"
+	"github.com/drand/kyber/util/random"
+)
+
+const (
+	memoryPlatform   = "memory"
+	memoryL2Platform = "memory-l2"
+)
+
+// memoryChain is the contract storage shared by all memory engines, it
+// accepts the group events with valid full signatures only
+type memoryChain struct {
+	sync.Mutex
+	commit    kyber.Point
+	sent      map[string]map[uint64]*encoding.Event
+	events    map[string][]*encoding.Event
+	rotations map[string]*memoryRotation
+	halted    map[string]bool
+	evolved   map[string]string
+	// pids are the processes of the contracts deployed for a process only
+	pids map[string]string
+	// outages is the count of the following RPC calls failed
+	outages int
+}
+
+type memoryRotation struct {
+	nonce  uint64
+	commit kyber.Point
+}
+
+func newMemoryChain(commit kyber.Point) *memoryChain {
+	return &memoryChain{
+		commit:    commit,
+		sent:      make(map[string]map[uint64]*encoding.Event),
+		events:    make(map[string][]*encoding.Event),
+		rotations: make(map[string]*memoryRotation),
+		halted:    make(map[string]bool),
+		evolved:   make(map[string]string),
+		pids:      make(map[string]string),
+	}
+}
+
+func (c *memoryChain) deploy(address, pid string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.pids[address] = pid
+}
+
+// rotate accepts the new group key signed by both the old and new groups,
+// just like the registry contract iterate
+func (c *memoryChain) rotate(address string, nonce uint64, payload []byte) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(payload) != 256 {
+		return fmt.Errorf("invalid payload %x", payload)
+	}
+	group := payload[:128]
+	next, err := crypto.PubKeyFromBytes(group)
+	if err != nil {
+		return err
+	}
+	err = crypto.Verify(c.commit, group, payload[128:192])
+	if err != nil {
+		return err
+	}
+	err = crypto.Verify(next, group, payload[192:])
+	if err != nil {
+		return err
+	}
+	c.rotations[address] = &memoryRotation{nonce: nonce, commit: next}
+	return nil
+}
+
+func (c *memoryChain) rotation(address string) *memoryRotation {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.rotations[address]
+}
+
+func (c *memoryChain) state(address string) (bool, string) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.halted[address], c.evolved[address]
+}
+
+// emit makes the contract at the address produce an event to the group
+func (c *memoryChain) emit(address string, evt *encoding.Event) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.events[address] = append(c.events[address], evt)
+}
+
+func (c *memoryChain) listSent(address string) []*encoding.Event {
+	c.Lock()
+	defer c.Unlock()
+
+	var evts []*encoding.Event
+	for _, e := range c.sent[address] {
+		evts = append(evts, e)
+	}
+	sort.Slice(evts, func(i, j int) bool {
+		return evts[i].Nonce < evts[j].Nonce
+	})
+	return evts
+}
+
+// memoryEngine is an instance of the memory chain, the platform is the
+// memory platform if not set
+type memoryEngine struct {
+	chain    *memoryChain
+	platform string
+}
+
+func (e *memoryEngine) VerifyAddress(ctx context.Context, addr, pid string, extra []byte) error {
+	if addr == "" {
+		return fmt.Errorf("invalid address")
+	}
+	e.chain.Lock()
+	defer e.chain.Unlock()
+
+	if e.chain.outages > 0 {
+		e.chain.outages--
+		return fmt.Errorf("%w: memory chain outage", machine.ErrorEngineUnavailable)
+	}
+	if p := e.chain.pids[addr]; p != "" && p != pid {
+		return fmt.Errorf("invalid contract process %s %s", p, pid)
+	}
+	return nil
+}
+
+func (e *memoryEngine) SetupNotifier(addr string) error {
+	return nil
+}
+
+func (e *memoryEngine) VerifyEvent(address string, event *encoding.Event) bool {
+	return false
+}
+
+func (e *memoryEngine) EstimateCost(events []*encoding.Event) (common.Integer, error) {
+	return common.Zero, nil
+}
+
+func (e *memoryEngine) EnsureSendGroupEvents(address string, events []*encoding.Event) error {
+	e.chain.Lock()
+	defer e.chain.Unlock()
+
+	if e.chain.halted[address] {
+		return fmt.Errorf("contract %s halted", address)
+	}
+	for _, evt := range events {
+		commit := e.chain.commit
+		if r := e.chain.rotations[address]; r != nil && evt.Nonce >= r.nonce {
+			commit = r.commit
+		}
+		msg := *evt
+		msg.Signature = nil
+		err := crypto.Verify(commit, msg.Encode(), evt.Signature)
+		if err != nil {
+			return err
+		}
+		if e.chain.sent[address] == nil {
+			e.chain.sent[address] = make(map[uint64]*encoding.Event)
+		}
+		e.chain.sent[address][evt.Nonce] = evt
+	}
+	return nil
+}
+
+func (e *memoryEngine) ReceiveGroupEvents(address string, offset uint64, limit int) ([]*encoding.Event, error) {
+	e.chain.Lock()
+	defer e.chain.Unlock()
+
+	var evts []*encoding.Event
+	for _, evt := range e.chain.events[address] {
+		if evt.Nonce < offset {
+			continue
+		}
+		evts = append(evts, evt)
+		if len(evts) == limit {
+			break
+		}
+	}
+	return evts, nil
+}
+
+func (e *memoryEngine) SignEvent(address string, event *encoding.Event) []byte {
+	return nil
+}
+
+func (e *memoryEngine) RotateGroup(address string, nonce uint64, payload []byte) error {
+	return e.chain.rotate(address, nonce, payload)
+}
+
+func (e *memoryEngine) EncodeGroupCommand(c *machine.GroupCommand) ([]byte, error) {
+	switch c.Kind {
+	case machine.GroupCommandHalt:
+		return []byte("HALT"), nil
+	case machine.GroupCommandEvolve:
+		return []byte(c.Next), nil
+	}
+	return nil, fmt.Errorf("invalid command %d", c.Kind)
+}
+
+// VerifyEvolveAddress follows the registry evolve, the next contract must be
+// deployed with another process
+func (e *memoryEngine) VerifyEvolveAddress(ctx context.Context, address, next string) error {
+	e.chain.Lock()
+	defer e.chain.Unlock()
+
+	if e.chain.outages > 0 {
+		e.chain.outages--
+		return fmt.Errorf("%w: memory chain outage", machine.ErrorEngineUnavailable)
+	}
+	if p := e.chain.pids[next]; p == "" || p == e.chain.pids[address] {
+		return fmt.Errorf("invalid next contract %s %s", next, p)
+	}
+	return nil
+}
+
+func (e *memoryEngine) ExecuteGroupCommand(address string, c *machine.GroupCommand) (bool, error) {
+	msg, err := e.EncodeGroupCommand(c)
+	if err != nil {
+		return false, err
+	}
+	e.chain.Lock()
+	defer e.chain.Unlock()
+
+	err = crypto.Verify(e.chain.commit, msg, c.Signature)
+	if err != nil {
+		return false, err
+	}
+	switch c.Kind {
+	case machine.GroupCommandHalt:
+		e.chain.halted[address] = true
+	case machine.GroupCommandEvolve:
+		if !e.chain.halted[address] {
+			return false, nil
+		}
+		e.chain.evolved[address] = c.Next
+	}
+	return true, nil
+}
+
+// SupportsCollectibles is false for the L2 chain, whose contracts don't
+// encode the collectible events
+func (e *memoryEngine) SupportsCollectibles() bool {
+	return e.platform == ""
+}
+
+func (e *memoryEngine) Platform() string {
+	if e.platform != "" {
+		return e.platform
+	}
+	return memoryPlatform
+}
+
+func (e *memoryEngine) SignType() int {
+	return machine.SignTypeTBLS
+}
+
+func (e *memoryEngine) CombineSignatures(address string, event *encoding.Event, partials [][]byte) ([]byte, error) {
+	return nil, fmt.Errorf("memory signatures combined by the machine")
+}
+
+type loopbackMessage struct {
+	sender string
+	data   []byte
+}
+
+// loopbackNetwork connects the messengers of all in-process machines
+type loopbackNetwork struct {
+	sync.Mutex
+	inboxes map[string]chan *loopbackMessage
+	offline map[string]bool
+}
+
+func newLoopbackNetwork() *loopbackNetwork {
+	return &loopbackNetwork{
+		inboxes: make(map[string]chan *loopbackMessage),
+		offline: make(map[string]bool),
+	}
+}
+
+// disconnect drops all messages to the receiver until connected again
+func (n *loopbackNetwork) disconnect(id string, offline bool) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.offline[id] = offline
+}
+
+func (n *loopbackNetwork) join(id string) messenger.Messenger {
+	n.Lock()
+	defer n.Unlock()
+
+	n.inboxes[id] = make(chan *loopbackMessage, 1024)
+	return &loopbackMessenger{id: id, network: n}
+}
+
+func (n *loopbackNetwork) inbox(id string) chan *loopbackMessage {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.inboxes[id]
+}
+
+func (n *loopbackNetwork) dropped(id string) bool {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.offline[id]
+}
+
+type loopbackMessenger struct {
+	id      string
+	network *loopbackNetwork
+}
+
+func (m *loopbackMessenger) ReceiveMessage(ctx context.Context) (string, []byte, error) {
+	select {
+	case msg := <-m.network.inbox(m.id):
+		return msg.sender, msg.data, nil
+	case <-ctx.Done():
+		return "", nil, messenger.ErrorDone
+	}
+}
+
+func (m *loopbackMessenger) SendMessage(ctx context.Context, receiver string, b []byte) error {
+	inbox := m.network.inbox(receiver)
+	if inbox == nil {
+		return fmt.Errorf("loopback receiver %s not found", receiver)
+	}
+	if m.network.dropped(receiver) {
+		return nil
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	select {
+	case inbox <- &loopbackMessage{sender: m.id, data: data}:
+		return nil
+	case <-ctx.Done():
+		return messenger.ErrorDone
+	}
+}
+
+func (m *loopbackMessenger) QueueMessage(ctx context.Context, receiver string, b []byte) error {
+	return m.SendMessage(ctx, receiver, b)
+}
+
+func (m *loopbackMessenger) BroadcastMessage(ctx context.Context, b []byte) error {
+	m.network.Lock()
+	var receivers []string
+	for id := range m.network.inboxes {
+		receivers = append(receivers, id)
+	}
+	m.network.Unlock()
+
+	for _, id := range receivers {
+		err := m.SendMessage(ctx, id, b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type groupTransaction struct {
+	Asset     string
+	Receivers []string
+	Threshold int
+	Amount    string
+	Memo      string
+	TraceId   string
+	GroupId   string
+}
+
+// fakeGroup records the transactions built by the machine, shared by all
+// machines just like the multisig transactions are built by every member,
+// all builds fail with the failure if set
+type fakeGroup struct {
+	sync.Mutex
+	members      []string
+	threshold    int
+	transactions map[string]*groupTransaction
+	builds       map[string]int
+	failure      error
+	// the senders of the multisig outputs by the output sender
+	senders map[string]*outputSenders
+}
+
+type outputSenders struct {
+	members   []string
+	threshold int
+}
+
+func newFakeGroup(members []string, threshold int) *fakeGroup {
+	return &fakeGroup{
+		members:      members,
+		threshold:    threshold,
+		transactions: make(map[string]*groupTransaction),
+		builds:       make(map[string]int),
+		senders:      make(map[string]*outputSenders),
+	}
+}
+
+func (g *fakeGroup) GenesisId() string {
+	return "fake-group-genesis-id"
+}
+
+func (g *fakeGroup) GetMembers() []string {
+	return g.members
+}
+
+func (g *fakeGroup) GetThreshold() int {
+	return g.threshold
+}
+
+func (g *fakeGroup) BuildTransaction(ctx context.Context, assetId string, receivers []string, threshold int, amount, memo string, traceId, groupId string) error {
+	g.Lock()
+	defer g.Unlock()
+
+	g.builds[traceId] = g.builds[traceId] + 1
+	if g.failure != nil {
+		return g.failure
+	}
+	if old := g.transactions[traceId]; old != nil {
+		if old.Asset != assetId || old.Amount != amount || old.GroupId != groupId {
+			return fmt.Errorf("malformed transaction %s", traceId)
+		}
+		return nil
+	}
+	g.transactions[traceId] = &groupTransaction{
+		Asset:     assetId,
+		Receivers: receivers,
+		Threshold: threshold,
+		Amount:    amount,
+		Memo:      memo,
+		TraceId:   traceId,
+		GroupId:   groupId,
+	}
+	return nil
+}
+
+// BuildCollectibleTransaction records the collectible transfers with the
+// token as the asset and the amount 1
+func (g *fakeGroup) BuildCollectibleTransaction(ctx context.Context, tokenId string, receivers []string, threshold int, traceId string) error {
+	return g.BuildTransaction(ctx, tokenId, receivers, threshold, "1", "", traceId, "")
+}
+
+// ReadOutputSenders returns the senders of the multisig outputs sent by the
+// sender, and nothing for the outputs of a single user
+func (g *fakeGroup) ReadOutputSenders(ctx context.Context, out *mtg.Output) ([]string, int, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	s := g.senders[out.Sender]
+	if s == nil {
+		return nil, 0, nil
+	}
+	return s.members, s.threshold, nil
+}
+
+func (g *fakeGroup) sendFrom(sender string, members []string, threshold int) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.senders[sender] = &outputSenders{members: members, threshold: threshold}
+}
+
+func (g *fakeGroup) countBuilds(traceId string) int {
+	g.Lock()
+	defer g.Unlock()
+
+	return g.builds[traceId]
+}
+
+func (g *fakeGroup) listTransactions() []*groupTransaction {
+	g.Lock()
+	defer g.Unlock()
+
+	var txs []*groupTransaction
+	for _, tx := range g.transactions {
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+type tblsKeys struct {
+	poly      string
+	shares    []string
+	priShares []*share.PriShare
+	pubPoly   *share.PubPoly
+	commit    kyber.Point
+}
+
+// generateTBLSKeys deals the threshold shares, the poly and shares are HEX
+// encoded in the machine configuration formats
+func generateTBLSKeys(threshold, n int) *tblsKeys {
+	suite := en256.NewSuiteG2()
+	secret := suite.Scalar().Pick(random.New())
+	priPoly := share.NewPriPoly(suite, threshold, secret, random.New())
+	return buildTBLSKeys(priPoly.Commit(suite.Point().Base()), priPoly.Shares(n))
+}
+
+// refreshTBLSKeys adds a poly of the zero secret to the shares, so the new
+// shares have the same group public key
+func refreshTBLSKeys(keys *tblsKeys) *tblsKeys {
+	suite := en256.NewSuiteG2()
+	zero := share.NewPriPoly(suite, keys.pubPoly.Threshold(), suite.Scalar().Zero(), random.New())
+	pubPoly, err := keys.pubPoly.Add(zero.Commit(suite.Point().Base()))
+	if err != nil {
+		panic(err)
+	}
+	var shares []*share.PriShare
+	for _, s := range keys.priShares {
+		v := suite.Scalar().Add(s.V, zero.Eval(s.I).V)
+		shares = append(shares, &share.PriShare{I: s.I, V: v})
+	}
+	return buildTBLSKeys(pubPoly, shares)
+}
+
+// reshareTBLSKeys deals the shares of the same group secret to n members
+// with the new threshold
+func reshareTBLSKeys(keys *tblsKeys, threshold, n int) *tblsKeys {
+	suite := en256.NewSuiteG2()
+	secret, err := share.RecoverSecret(suite, keys.priShares, keys.pubPoly.Threshold(), len(keys.priShares))
+	if err != nil {
+		panic(err)
+	}
+	priPoly := share.NewPriPoly(suite, threshold, secret, random.New())
+	return buildTBLSKeys(priPoly.Commit(suite.Point().Base()), priPoly.Shares(n))
+}
+
+func buildTBLSKeys(pubPoly *share.PubPoly, shares []*share.PriShare) *tblsKeys {
+	_, commits := pubPoly.Info()
+	var poly []byte
+	for _, c := range commits {
+		b, err := c.MarshalBinary()
+		if err != nil {
+			panic(err)
+		}
+		poly = append(poly, b...)
+	}
+
+	keys := &tblsKeys{poly: hex.EncodeToString(poly), pubPoly: pubPoly, commit: pubPoly.Commit()}
+	for _, s := range shares {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(s.I))
+		b = append(b, crypto.PrivateKeyBytes(s.V)...)
+		keys.shares = append(keys.shares, hex.EncodeToString(b))
+		keys.priShares = append(keys.priShares, s)
+	}
+	return keys
+}
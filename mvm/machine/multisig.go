@@ -0,0 +1,168 @@
+package machine
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/crypto"
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/nfo/mtg"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/shopspring/decimal"
+)
+
+// MultisigGroup is the MTG group able to transfer the collectibles it holds.
+// The transfer is signed by the multisig collectible request of the member,
+// then the group drains the signed output, co-signs and publishes it just
+// like its own collectible mint transactions.
+type MultisigGroup struct {
+	*mtg.Group
+	store  mtg.Store
+	client *mixin.Client
+	pin    string
+}
+
+func NewMultisigGroup(group *mtg.Group, store mtg.Store, conf *mtg.Configuration) (*MultisigGroup, error) {
+	s := &mixin.Keystore{
+		ClientID:   conf.App.ClientId,
+		SessionID:  conf.App.SessionId,
+		PrivateKey: conf.App.PrivateKey,
+		PinToken:   conf.App.PinToken,
+	}
+	client, err := mixin.NewFromKeystore(s)
+	if err != nil {
+		return nil, err
+	}
+	return &MultisigGroup{Group: group, store: store, client: client, pin: conf.App.PIN}, nil
+}
+
+// BuildCollectibleTransaction signs the transfer of the token output held by
+// the group, the ghost keys are hinted by the trace id so all members build
+// the same transaction. It's done once the output is signed or spent by the
+// same transaction, which may be signed by the other members already.
+func (g *MultisigGroup) BuildCollectibleTransaction(ctx context.Context, tokenId string, receivers []string, threshold int, traceId string) error {
+	outputs, err := g.store.ListCollectibleOutputsForTransaction(traceId)
+	if err != nil || len(outputs) > 0 {
+		return err
+	}
+	token, err := g.client.ReadCollectiblesToken(ctx, tokenId)
+	if err != nil {
+		return err
+	}
+	keys, err := g.client.BatchReadGhostKeys(ctx, []*mixin.GhostInput{{
+		Receivers: receivers,
+		Index:     0,
+		Hint:      traceId,
+	}})
+	if err != nil {
+		return err
+	}
+
+	for _, state := range []string{mixin.UTXOStateUnspent, mixin.UTXOStateSigned, mixin.UTXOStateSpent} {
+		outputs, err := g.store.ListCollectibleOutputsForToken(state, tokenId, 16)
+		if err != nil {
+			return err
+		}
+		for _, out := range outputs {
+			ver := buildCollectibleTransferTransaction(out, token.NFO, keys[0], threshold)
+			if state != mixin.UTXOStateUnspent && !checkSignedTransaction(out.SignedTx, ver) {
+				continue
+			}
+			if state == mixin.UTXOStateSpent {
+				return nil
+			}
+			return g.signCollectibleTransfer(ctx, out, ver, traceId)
+		}
+	}
+	return fmt.Errorf("collectible %s output not found", tokenId)
+}
+
+// multisigSenders is the multisig output read from the network with the
+// senders of the UTXO it spent, just like the collectible outputs
+type multisigSenders struct {
+	UTXOID           string   `json:"utxo_id"`
+	Senders          []string `json:"senders"`
+	SendersThreshold int      `json:"senders_threshold"`
+}
+
+// ReadOutputSenders reads the multisig outputs of the group from the update
+// time of the output, and returns the senders of the output, which never
+// change once the output is created. The output not found in the batch is
+// an error, because another member may find it, and the output should be
+// handled the same by all members.
+func (g *MultisigGroup) ReadOutputSenders(ctx context.Context, out *mtg.Output) ([]string, int, error) {
+	members := append([]string{}, g.GetMembers()...)
+	params := map[string]string{
+		"members":   mixin.HashMembers(members),
+		"threshold": fmt.Sprint(g.GetThreshold()),
+		"offset":    out.UpdatedAt.UTC().Format(time.RFC3339Nano),
+		"limit":     "500",
+	}
+	var outputs []*multisigSenders
+	err := g.client.Get(ctx, "/multisigs/outputs", params, &outputs)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, o := range outputs {
+		if o.UTXOID == out.UTXOID {
+			return o.Senders, o.SendersThreshold, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("multisig output %s not found", out.UTXOID)
+}
+
+func (g *MultisigGroup) signCollectibleTransfer(ctx context.Context, out *mtg.CollectibleOutput, ver *common.VersionedTransaction, traceId string) error {
+	raw := hex.EncodeToString(ver.Marshal())
+	req, err := g.client.CreateCollectibleRequest(ctx, mixin.CollectibleRequestActionSign, raw)
+	if err != nil {
+		return err
+	}
+	req, err = g.client.SignCollectibleRequest(ctx, req.RequestID, g.pin)
+	if err != nil {
+		return err
+	}
+	logger.Verbosef("MultisigGroup.signCollectibleTransfer(%s, %s) => %s", out.OutputId, traceId, req.RawTransaction)
+	out.State = mtg.OutputStateSigned
+	out.SignedBy = ver.PayloadHash().String()
+	out.SignedTx = req.RawTransaction
+	return g.store.WriteCollectibleOutputs([]*mtg.CollectibleOutput{out}, traceId)
+}
+
+func buildCollectibleTransferTransaction(out *mtg.CollectibleOutput, nfo []byte, key *mixin.GhostKeys, threshold int) *common.VersionedTransaction {
+	assetId, err := crypto.HashFromString(mtg.CollectibleMixinAssetId)
+	if err != nil {
+		panic(err)
+	}
+	ver := common.NewTransaction(assetId)
+	ver.Extra = nfo
+	ver.AddInput(out.TransactionHash, out.OutputIndex)
+
+	o := key.DumpOutput(uint8(threshold), decimal.NewFromInt(1))
+	cout := &common.Output{
+		Type:   common.OutputTypeScript,
+		Amount: common.NewIntegerFromString(o.Amount.String()),
+		Script: common.Script(o.Script),
+		Mask:   crypto.Key(o.Mask),
+	}
+	for _, k := range o.Keys {
+		ck := crypto.Key(k)
+		cout.Keys = append(cout.Keys, &ck)
+	}
+	ver.Outputs = append(ver.Outputs, cout)
+	return ver.AsLatestVersion()
+}
+
+func checkSignedTransaction(signed string, ver *common.VersionedTransaction) bool {
+	raw, err := hex.DecodeString(signed)
+	if err != nil {
+		return false
+	}
+	tx, err := common.UnmarshalVersionedTransaction(raw)
+	if err != nil {
+		return false
+	}
+	return tx.PayloadHash() == ver.PayloadHash()
+}
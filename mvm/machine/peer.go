@@ -0,0 +1,158 @@
+package machine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/tip/crypto/en256"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/metrics"
+	"github.com/drand/kyber/sign/tbls"
+)
+
+const (
+	PeerMisbehaviorInvalidPartial   = "invalid-partial"
+	PeerMisbehaviorInvalidSignature = "invalid-signature"
+	PeerMisbehaviorInvalidMessage   = "invalid-message"
+	PeerMisbehaviorRateLimit        = "rate-limit"
+
+	// each member sends the partials of at most 100 events to all members in
+	// a sign loop, so the burst allows a few loops at once
+	peerMessageRate  = 100
+	peerMessageBurst = 1000
+	peerReportPeriod = time.Minute
+)
+
+type PeerMisbehavior struct {
+	Peer      string
+	Kind      string
+	Process   string
+	Nonce     uint64
+	Reason    string
+	CreatedAt time.Time
+}
+
+// peerLimiter is the token bucket of the messages from a member
+type peerLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// recordPeerMisbehavior writes the misbehavior at most once in a report
+// period for each kind of the peer, so a faulty member flooding the invalid
+// messages can't flood the store
+func (m *Machine) recordPeerMisbehavior(peer, kind string, evt *encoding.Event, err error) {
+	if !m.reportPeerMisbehavior(peer, kind) {
+		return
+	}
+	pm := &PeerMisbehavior{
+		Peer:      peer,
+		Kind:      kind,
+		Reason:    err.Error(),
+		CreatedAt: time.Now(),
+	}
+	if evt != nil {
+		pm.Process, pm.Nonce = evt.Process, evt.Nonce
+	}
+	logger.Printf("Machine.recordPeerMisbehavior(%s, %s, %s, %d) => %s", pm.Peer, pm.Kind, pm.Process, pm.Nonce, pm.Reason)
+	err = m.store.WritePeerMisbehavior(pm)
+	if err != nil {
+		logger.Printf("WritePeerMisbehavior(%v) => %v", pm, err)
+	}
+}
+
+func (m *Machine) reportPeerMisbehavior(peer, kind string) bool {
+	m.peerLock.Lock()
+	defer m.peerLock.Unlock()
+
+	key := peer + ":" + kind
+	now := time.Now()
+	if now.Sub(m.reported[key]) < peerReportPeriod {
+		return false
+	}
+	m.reported[key] = now
+	return true
+}
+
+// admitPeerMessage drops the messages from the non-members, and from the
+// members exceeding the rate limit
+func (m *Machine) admitPeerMessage(peer string, limiters map[string]*peerLimiter) bool {
+	if !m.checkMember(peer) {
+		metrics.MessagesDropped.WithLabelValues(metrics.DropNonMember).Inc()
+		logger.Verbosef("Machine.admitPeerMessage(%s) => not a member", peer)
+		return false
+	}
+	now := time.Now()
+	l := limiters[peer]
+	if l == nil {
+		l = &peerLimiter{tokens: peerMessageBurst, last: now}
+		limiters[peer] = l
+	}
+	l.tokens += now.Sub(l.last).Seconds() * peerMessageRate
+	if l.tokens > peerMessageBurst {
+		l.tokens = peerMessageBurst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		metrics.MessagesDropped.WithLabelValues(metrics.DropRateLimit).Inc()
+		err := fmt.Errorf("more than %d messages in a burst", peerMessageBurst)
+		m.recordPeerMisbehavior(peer, PeerMisbehaviorRateLimit, nil, err)
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func (m *Machine) checkMember(peer string) bool {
+	for _, id := range m.peers() {
+		if id == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// peers returns the members of the group, and the new members of the
+// rotation, who sign the events from the nonce with the new shares
+func (m *Machine) peers() []string {
+	if m.rotation == nil {
+		return m.group.GetMembers()
+	}
+	return m.rotationMembers()
+}
+
+// bindPeerIndex binds the member to the share index of its envelope auth,
+// the index of a member never changes with the same group key
+func (m *Machine) bindPeerIndex(key *groupKey, peer string, i int) error {
+	m.peerLock.Lock()
+	defer m.peerLock.Unlock()
+
+	old, bound := key.indexes[peer]
+	if bound && old != i {
+		return fmt.Errorf("peer share index %d bound to %d", i, old)
+	}
+	key.indexes[peer] = i
+	return nil
+}
+
+// verifyPeerPartial verifies the partial and its index is the share index
+// bound to the peer by the envelope auth of the same key, or the first valid
+// partial of the peer, so the legacy messages can't avoid the binding
+func (m *Machine) verifyPeerPartial(peer string, key *groupKey, msg, partial []byte) error {
+	err := verifyPartial(key, msg, partial)
+	if err != nil {
+		return err
+	}
+	m.peerLock.RLock()
+	bound, ok := key.indexes[peer]
+	m.peerLock.RUnlock()
+	i, _ := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2()).IndexOf(partial)
+	if !ok {
+		return m.bindPeerIndex(key, peer, i)
+	}
+	if i != bound {
+		return fmt.Errorf("partial index %d of peer share %d", i, bound)
+	}
+	return nil
+}
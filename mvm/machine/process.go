@@ -8,9 +8,10 @@ import (
 
 	"github.com/MixinNetwork/mixin/common"
 	"github.com/MixinNetwork/mixin/logger"
-	"github.com/MixinNetwork/nfo/mtg"
 	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/metrics"
 	"github.com/fox-one/mixin-sdk-go"
+	"github.com/gofrs/uuid"
 )
 
 const (
@@ -26,71 +27,79 @@ type Process struct {
 	Credit     common.Integer
 	Nonce      uint64
 
-	Asset bool
+	Asset  bool
+	Halted bool
+	// Masked processes publish the masked user ids, it's false for the
+	// processes added before the masking to keep their user contracts
+	Masked bool
 }
 
 func (m *Machine) Spawn(ctx context.Context, p *Process) {
 	logger.Verbosef("Spawn(%s, %s, %s, %d)", p.Identifier, p.Platform, p.Address, p.Nonce)
-	go m.loopSendEvents(ctx, p)
-	go m.loopReceiveEvents(ctx, p)
+	m.spawn(func() { m.loopSendEvents(ctx, p) })
+	m.spawn(func() { m.loopReceiveEvents(ctx, p) })
 }
 
+// SignType returns zero if the engine of the platform is not added
 func (p *Process) SignType() int {
-	switch p.Platform {
-	case ProcessPlatformQuorum:
-		return SignTypeTBLS
-	case ProcessPlatformEOS:
-		return SignTypeSECP256K1
-	}
-	panic(p.Platform)
+	return platformSignType(p.Platform)
 }
 
 func (m *Machine) loopSendEvents(ctx context.Context, p *Process) {
 	engine := m.engines[p.Platform]
-	for {
+	m.superviseProcess(ctx, p, QuarantineStageSend, func() (time.Duration, error) {
 		events, err := m.store.ListSignedGroupEvents(p.Identifier, 100)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 		if len(events) == 0 {
-			time.Sleep(5 * time.Second)
-			continue
+			return processInterval, nil
+		}
+		address, halted := m.readProcessState(p)
+		if halted {
+			logger.Verbosef("Process(%s) => halted at %s", p.Identifier, address)
+			return processInterval, nil
 		}
 		cost, err := engine.EstimateCost(events)
 		if err != nil {
-			panic(err)
+			return 0, transientEventError(QuarantineStageSend, events[0], err)
 		}
-		if p.Credit.Cmp(cost.Mul(ProcessCreditMulplifier)) < 0 {
-			time.Sleep(1 * time.Minute)
-			continue
+		credit := m.readProcessCredit(p)
+		if credit.Cmp(cost.Mul(ProcessCreditMulplifier)) < 0 {
+			logger.Printf("Process(%s) => credit %s insufficient for %d events cost %s", p.Identifier, credit, len(events), cost)
+			return pauseInterval, nil
 		}
 
-		err = engine.EnsureSendGroupEvents(p.Address, events)
+		err = engine.EnsureSendGroupEvents(address, events)
 		if err != nil {
-			panic(err)
+			metrics.SendGroupEventsFailures.WithLabelValues(p.Identifier).Inc()
+			return 0, err
 		}
 		err = m.store.ExpireGroupEventsWithCost(events, cost)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 		if cost.Sign() > 0 {
+			m.procLock.Lock()
 			p.Credit = p.Credit.Sub(cost)
+			m.procLock.Unlock()
 		}
-	}
+		return 0, nil
+	})
 }
 
 func (m *Machine) loopReceiveEvents(ctx context.Context, p *Process) {
 	engine := m.engines[p.Platform]
 	processed := make(map[uint64]bool)
-	for {
+	m.superviseProcess(ctx, p, QuarantineStageReceive, func() (time.Duration, error) {
 		offset, err := m.store.ReadEngineGroupEventsOffset(p.Identifier)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
-		events, err := engine.ReceiveGroupEvents(p.Address, offset, 100)
+		address, _ := m.readProcessState(p)
+		events, err := engine.ReceiveGroupEvents(address, offset, 100)
 		if err != nil {
-			time.Sleep(1 * time.Minute)
-			continue
+			return 0, err
 		}
 		for _, e := range events {
 			if e.Process != p.Identifier {
@@ -102,44 +111,124 @@ func (m *Machine) loopReceiveEvents(ctx context.Context, p *Process) {
 			if e.Amount.Sign() <= 0 {
 				continue
 			}
+			err = checkGroupTransactionEvent(e)
+			if err != nil {
+				err = m.skipPoisonGroupEvent(ctx, p, poisonEventError(QuarantineStageReceive, e, err))
+				if err != nil {
+					return 0, err
+				}
+				processed[e.Nonce] = true
+				continue
+			}
+			e, err = m.unmaskGroupEvent(p, e)
+			if me, ok := err.(*Error); ok && me.Poison {
+				err = m.skipPoisonGroupEvent(ctx, p, me)
+				if err != nil {
+					return 0, err
+				}
+				processed[me.Event.Nonce] = true
+				continue
+			} else if err != nil {
+				return 0, err
+			}
 			as := p.buildAccountSnapshot(e, false)
 			enough, err := m.store.CheckAccountSnapshot(as)
 			if err != nil {
-				panic(err)
+				return 0, err
 			} else if !enough {
 				logger.Verbosef("Process(%s, %d) => balance %s %s", p.Identifier, p.Nonce, e.Asset, e.Amount)
-				time.Sleep(1 * time.Minute)
-				break
-			}
-			processed[e.Nonce] = true
-			err = m.store.WriteAccountSnapshot(as)
-			if err != nil {
-				panic(err)
+				return pauseInterval, nil
 			}
 
 			err = p.buildGroupTransaction(ctx, m.group, e)
-			if err != nil {
-				logger.Printf("Process.buildGroupTransaction(%v) => %s", e, err)
+			if me, ok := err.(*Error); ok && me.Poison {
+				err = m.skipPoisonGroupEvent(ctx, p, me)
+				if err != nil {
+					return 0, err
+				}
+				processed[e.Nonce] = true
 				continue
+			} else if err != nil {
+				logger.Printf("Process.buildGroupTransaction(%v) => %s", e, err)
+				return 0, transientEventError(QuarantineStageReceive, e, err)
+			}
+			err = m.store.WriteAccountSnapshot(as)
+			if err != nil {
+				return 0, err
 			}
 			err = m.store.WriteEngineGroupEventsOffset(p.Identifier, e.Nonce)
 			if err != nil {
-				panic(err)
+				return 0, err
 			}
+			processed[e.Nonce] = true
 		}
 		if len(events) < 100 {
-			time.Sleep(5 * time.Second)
+			return processInterval, nil
 		}
+		return 0, nil
+	})
+}
+
+func (m *Machine) readProcessCredit(p *Process) common.Integer {
+	m.procLock.RLock()
+	defer m.procLock.RUnlock()
+
+	return p.Credit
+}
+
+// skipPoisonGroupEvent quarantines an event from the engine that will never
+// make a valid group transaction, the balance is not touched for this event
+func (m *Machine) skipPoisonGroupEvent(ctx context.Context, p *Process, me *Error) error {
+	m.quarantineEvent(ctx, p.Identifier, me)
+	return m.store.WriteEngineGroupEventsOffset(p.Identifier, me.Event.Nonce)
+}
+
+// skipPoisonEvent quarantines the poison event of the stage, and advances
+// the stage past it, i.e. the received event offset, or the signed event
+// expired without cost
+func (m *Machine) skipPoisonEvent(ctx context.Context, p *Process, me *Error) error {
+	switch me.Stage {
+	case QuarantineStageReceive:
+		return m.skipPoisonGroupEvent(ctx, p, me)
+	case QuarantineStageSend:
+		m.quarantineEvent(ctx, p.Identifier, me)
+		return m.store.ExpireGroupEventsWithCost([]*encoding.Event{me.Event}, common.Zero)
 	}
+	return fmt.Errorf("unknown stage %s", me.Stage)
 }
 
-func (p *Process) buildGroupTransaction(ctx context.Context, group *mtg.Group, evt *encoding.Event) error {
+func checkGroupTransactionEvent(evt *encoding.Event) error {
+	if evt.Threshold <= 0 || evt.Threshold > len(evt.Members) {
+		return fmt.Errorf("%w: threshold %d/%d", ErrorInvalidEvent, evt.Threshold, len(evt.Members))
+	}
+	for _, m := range evt.Members {
+		id, err := uuid.FromString(m)
+		if err != nil || id == uuid.Nil {
+			return fmt.Errorf("%w: member %s", ErrorInvalidEvent, m)
+		}
+	}
+	if evt.IsCollectible() {
+		return checkCollectibleEvent(evt)
+	}
+	return nil
+}
+
+func (p *Process) buildGroupTransaction(ctx context.Context, group Group, evt *encoding.Event) (err error) {
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			err = poisonEventError(QuarantineStageReceive, evt, fmt.Errorf("%w: %v", ErrorInvalidEvent, rcv))
+		}
+	}()
+
 	if p.Identifier != evt.Process {
 		panic(evt)
 	}
 	traceId := mixin.UniqueConversationID(group.GenesisId(), fmt.Sprintf("%s:EVENT#%d", p.Identifier, evt.Nonce))
 	logger.Verbosef("Process(%s, %d) => buildGroupTransaction(%s, %v, %d, %s) => %s",
 		p.Identifier, evt.Nonce, evt.Asset, evt.Members, evt.Threshold, evt.Amount, traceId)
+	if evt.IsCollectible() {
+		return buildCollectibleTransaction(ctx, group, evt, traceId)
+	}
 	amount := evt.Amount.String()
 	memo := base64.RawURLEncoding.EncodeToString(evt.Extra)
 	return group.BuildTransaction(ctx, evt.Asset, evt.Members, evt.Threshold, amount, memo, traceId, p.Identifier)
@@ -8,6 +8,8 @@ import (
 	"github.com/MixinNetwork/mixin/logger"
 	"github.com/MixinNetwork/nfo/mtg"
 	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/gofrs/uuid"
 )
 
 type Asset struct {
@@ -17,6 +19,9 @@ type Asset struct {
 }
 
 func (m *Machine) ProcessOutput(ctx context.Context, out *mtg.Output) {
+	m.workLock.Lock()
+	defer m.workLock.Unlock()
+
 	op, err := parseOperation(out.Memo)
 	if err != nil {
 		logger.Verbosef("parseOperation(%s) => %s", out.Memo, err)
@@ -26,14 +31,49 @@ func (m *Machine) ProcessOutput(ctx context.Context, out *mtg.Output) {
 	case encoding.OperationPurposeAddProcess:
 		ok := m.AddProcess(ctx, op.Process, op.Platform, op.Address, out, op.Extra)
 		if ok && op.Platform == ProcessPlatformEOS {
-			m.WriteGroupEvent(ctx, op.Process, out, op.Extra)
+			m.WriteGroupEvent(ctx, op, out)
 		}
 	case encoding.OperationPurposeGroupEvent:
-		m.WriteGroupEvent(ctx, op.Process, out, op.Extra)
+		m.WriteGroupEvent(ctx, op, out)
+	case encoding.OperationPurposeCreditProcess:
+		m.CreditProcess(ctx, op.Process, out)
+	case encoding.OperationPurposeHaltProcess, encoding.OperationPurposeEvolveProcess:
+		m.VoteGroupCommand(ctx, op, out)
 	}
 }
 
-func (m *Machine) ProcessCollectibleOutput(context.Context, *mtg.CollectibleOutput) {
+func (m *Machine) ProcessCollectibleOutput(ctx context.Context, out *mtg.CollectibleOutput) {
+	m.workLock.Lock()
+	defer m.workLock.Unlock()
+
+	op, err := parseOperation(out.Memo)
+	if err != nil {
+		logger.Verbosef("parseOperation(%s) => %s", out.Memo, err)
+		return
+	}
+	switch op.Purpose {
+	case encoding.OperationPurposeGroupEvent:
+		m.WriteCollectibleEvent(ctx, op, out)
+	}
+}
+
+// refundOutput sends the output not accepted back to the sender, the trace
+// id is derived from the output so all members build the same transaction.
+// The output without a valid sender is kept by the group and logged.
+func (m *Machine) refundOutput(ctx context.Context, groupId string, out *mtg.Output, reason string) {
+	sender, err := uuid.FromString(out.Sender)
+	if err != nil || sender == uuid.Nil {
+		logger.Printf("refundOutput(%s, %s, %s) => sender %s", out.UTXOID, out.AssetID, reason, out.Sender)
+		return
+	}
+	traceId := mixin.UniqueConversationID(out.UTXOID, "REFUND")
+	logger.Printf("refundOutput(%s, %s, %s) => %s %s", out.UTXOID, out.AssetID, reason, out.Sender, traceId)
+	err = m.retryOutput(nil, "BuildRefundTransaction", func() error {
+		return m.group.BuildTransaction(ctx, out.AssetID, []string{out.Sender}, 1, out.Amount.String(), reason, traceId, groupId)
+	})
+	if err != nil {
+		m.quarantineOutput(groupId, out.UTXOID, err)
+	}
 }
 
 func parseOperation(memo string) (*encoding.Operation, error) {
@@ -0,0 +1,385 @@
+package machine
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/tip/crypto"
+	"github.com/MixinNetwork/tip/crypto/en256"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/drand/kyber/share"
+	"github.com/drand/kyber/sign/tbls"
+)
+
+const (
+	// RotationProcess is the pseudo process of the group rotation messages,
+	// the message nonce is the signer group, and the timestamp is the nonce
+	// from which the events are signed by the new group
+	RotationProcess = "00000000-0000-0000-0000-000000000000"
+
+	RotationSignerOld = 0
+	RotationSignerNew = 1
+)
+
+var (
+	rotationPeriod = time.Minute
+)
+
+type RotationConfiguration struct {
+	Poly    string   `toml:"poly"`
+	Share   string   `toml:"share"`
+	Nonce   uint64   `toml:"nonce"`
+	Members []string `toml:"members"`
+}
+
+// GroupRotation is the handover of the group key, the new group public key
+// signed by both the old and the new groups
+type GroupRotation struct {
+	Group      []byte      `json:"group"`
+	Nonce      uint64      `json:"nonce"`
+	Partials   [2][][]byte `json:"partials"`
+	Signatures [2][]byte   `json:"signatures"`
+	// the processes whose contracts accepted the payload, so the handover is
+	// not sent again after a restart
+	Rotated []string `json:"rotated,omitempty"`
+}
+
+// GroupRotator is implemented by the engines whose contracts accept the new
+// group key by the handover payload, the engine should switch the contract
+// to the new key before sending the events from the nonce
+type GroupRotator interface {
+	RotateGroup(address string, nonce uint64, payload []byte) error
+}
+
+type groupKey struct {
+	share     *share.PriShare
+	poly      *share.PubPoly
+	threshold int
+	members   []string
+	// the share indexes bound to the members by their envelope auth
+	indexes map[string]int
+}
+
+type rotation struct {
+	nonce uint64
+	group []byte
+	key   *groupKey
+	// the shares are reshared with the same group public key, so the
+	// contracts need no handover, and the machine just signs with the new
+	// shares from the nonce
+	reshare bool
+}
+
+// Payload is the new group public key followed by the signatures of the
+// old and new groups, it's nil before both signatures recovered
+func (r *GroupRotation) Payload() []byte {
+	old, next := r.Signatures[RotationSignerOld], r.Signatures[RotationSignerNew]
+	if len(old) != 64 || len(next) != 64 {
+		return nil
+	}
+	payload := append([]byte{}, r.Group...)
+	payload = append(payload, old...)
+	return append(payload, next...)
+}
+
+// Group returns the new group public key in the contract format
+func (conf *RotationConfiguration) Group() ([]byte, error) {
+	pb, err := hex.DecodeString(conf.Poly)
+	if err != nil {
+		return nil, err
+	}
+	commitments := unmarshalCommitments(pb)
+	if len(commitments) == 0 {
+		return nil, fmt.Errorf("invalid rotation poly %s", conf.Poly)
+	}
+	return commitments[0].MarshalBinary()
+}
+
+// parseRotation parses the new group key, whose members are the old ones if
+// not configured
+func parseRotation(conf *RotationConfiguration, members []string) (*rotation, error) {
+	if conf == nil || conf.Poly == "" {
+		return nil, nil
+	}
+	pb, err := hex.DecodeString(conf.Poly)
+	if err != nil {
+		return nil, err
+	}
+	commitments := unmarshalCommitments(pb)
+	suite := en256.NewSuiteG2()
+	poly := share.NewPubPoly(suite, suite.Point().Base(), commitments)
+	group, err := poly.Commit().MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.Members) > 0 {
+		members = conf.Members
+	}
+	if len(members) < poly.Threshold() {
+		return nil, fmt.Errorf("invalid machine.rotation.members %d %d", len(members), poly.Threshold())
+	}
+	r := &rotation{
+		nonce: conf.Nonce,
+		group: group,
+		key:   newGroupKey(poly, poly.Threshold(), members),
+	}
+	if conf.Share == "" {
+		return r, nil
+	}
+	sb, err := hex.DecodeString(conf.Share)
+	if err != nil {
+		return nil, err
+	}
+	r.key.share = unmarshalPrivShare(sb)
+	if !poly.Check(r.key.share) {
+		return nil, fmt.Errorf("invalid machine.rotation.share: poly check failed")
+	}
+	return r, nil
+}
+
+func newGroupKey(poly *share.PubPoly, threshold int, members []string) *groupKey {
+	return &groupKey{poly: poly, threshold: threshold, members: members, indexes: make(map[string]int)}
+}
+
+func (k *groupKey) hasMember(id string) bool {
+	for _, m := range k.members {
+		if m == id {
+			return true
+		}
+	}
+	return false
+}
+
+// groupKey returns the key to sign the events of the nonce, the share is
+// nil if the node leaves the new group, or joins it by the rotation
+func (m *Machine) groupKey(nonce uint64) *groupKey {
+	if m.rotation != nil && nonce >= m.rotation.nonce {
+		return m.rotation.key
+	}
+	return m.key
+}
+
+// authKey returns the key to sign the envelope auth, the new members of the
+// rotation have only the new share
+func (m *Machine) authKey() *groupKey {
+	if m.key.share == nil && m.rotation != nil {
+		return m.rotation.key
+	}
+	return m.key
+}
+
+func (m *Machine) rotationKey(signer uint64) *groupKey {
+	if signer == RotationSignerOld {
+		return m.groupKey(0)
+	}
+	return m.rotation.key
+}
+
+func (m *Machine) loopRotateGroup(ctx context.Context) {
+	var sent time.Time
+	for sleep(ctx, loopInterval) {
+		r, err := m.readGroupRotation()
+		if err != nil {
+			logger.Printf("ReadGroupRotation() => %v", err)
+			continue
+		}
+		payload := r.Payload()
+		if payload == nil {
+			if time.Since(sent) < rotationPeriod {
+				continue
+			}
+			err = m.signGroupRotation(ctx, r)
+			if err != nil {
+				logger.Printf("signGroupRotation(%x) => %v", r.Group, err)
+				continue
+			}
+			sent = time.Now()
+			continue
+		}
+
+		for _, p := range m.listProcesses() {
+			if r.rotated(p.Identifier) || p.SignType() != SignTypeTBLS {
+				continue
+			}
+			rotator, ok := m.engines[p.Platform].(GroupRotator)
+			if !ok {
+				continue
+			}
+			err = rotator.RotateGroup(p.Address, r.Nonce, payload)
+			logger.Printf("RotateGroup(%s, %s, %d) => %v", p.Identifier, p.Address, r.Nonce, err)
+			if err != nil {
+				continue
+			}
+			err = m.writeGroupRotationProcess(p.Identifier)
+			if err != nil {
+				logger.Printf("writeGroupRotationProcess(%s) => %v", p.Identifier, err)
+			}
+		}
+	}
+}
+
+func (m *Machine) listProcesses() []*Process {
+	m.procLock.RLock()
+	defer m.procLock.RUnlock()
+
+	var processes []*Process
+	for _, p := range m.processes {
+		processes = append(processes, p)
+	}
+	return processes
+}
+
+// rotationMembers returns the members of both the old and new groups, all
+// of them collect the partials of both groups
+func (m *Machine) rotationMembers() []string {
+	members := append([]string{}, m.group.GetMembers()...)
+	for _, id := range m.rotation.key.members {
+		if !m.isGroupMember(id) {
+			members = append(members, id)
+		}
+	}
+	return members
+}
+
+func (m *Machine) readGroupRotation() (*GroupRotation, error) {
+	r, err := m.store.ReadGroupRotation(m.rotation.group)
+	if err != nil || r != nil {
+		return r, err
+	}
+	return &GroupRotation{Group: m.rotation.group, Nonce: m.rotation.nonce}, nil
+}
+
+// signGroupRotation sends the partials of the groups this node belongs to,
+// and the recovered signatures to help the slow peers
+func (m *Machine) signGroupRotation(ctx context.Context, r *GroupRotation) error {
+	scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
+	for _, signer := range []uint64{RotationSignerOld, RotationSignerNew} {
+		sig, typ := r.Signatures[signer], MessageTypeFull
+		if sig == nil {
+			key := m.rotationKey(signer)
+			if key.share == nil {
+				continue
+			}
+			partial, err := scheme.Sign(key.share, r.Group)
+			if err != nil {
+				return err
+			}
+			err = m.appendGroupRotationPartial(signer, partial)
+			if err != nil {
+				return err
+			}
+			sig, typ = partial, MessageTypePartial
+		}
+		evt := buildRotationEvent(r, signer, sig)
+		err := m.queueMessage(ctx, m.rotationMembers(), typ, evt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Machine) handleRotationMessage(peer string, typ int, evt *encoding.Event) error {
+	if m.rotation == nil {
+		return nil
+	}
+	if !bytes.Equal(evt.Extra, m.rotation.group) || evt.Timestamp != m.rotation.nonce {
+		logger.Verbosef("handleRotationMessage(%s) => %x %d", peer, evt.Extra, evt.Timestamp)
+		return nil
+	}
+	if evt.Nonce != RotationSignerOld && evt.Nonce != RotationSignerNew {
+		return nil
+	}
+	key := m.rotationKey(evt.Nonce)
+
+	if typ == MessageTypeFull {
+		err := crypto.Verify(key.poly.Commit(), m.rotation.group, evt.Signature)
+		if err != nil {
+			logger.Verbosef("handleRotationMessage(%s) => crypto.Verify() => %v", peer, err)
+			return nil
+		}
+		return m.writeGroupRotationSignature(evt.Nonce, evt.Signature)
+	}
+
+	err := m.verifyPeerPartial(peer, key, m.rotation.group, evt.Signature)
+	if err != nil {
+		m.recordPeerMisbehavior(peer, PeerMisbehaviorInvalidPartial, evt, err)
+		return nil
+	}
+	return m.appendGroupRotationPartial(evt.Nonce, evt.Signature)
+}
+
+func (m *Machine) appendGroupRotationPartial(signer uint64, partial []byte) error {
+	m.signerLock.Lock()
+	defer m.signerLock.Unlock()
+
+	r, err := m.readGroupRotation()
+	if err != nil || r.Signatures[signer] != nil {
+		return err
+	}
+	if checkSignedWith(r.Partials[signer], partial) {
+		return nil
+	}
+	key := m.rotationKey(signer)
+	partials := validPartials(key, r.Group, append(r.Partials[signer], partial))
+	r.Partials[signer] = partials
+	if len(partials) >= key.threshold {
+		sig, err := recoverSignature(key, r.Group, partials)
+		if err != nil {
+			return err
+		}
+		r.Signatures[signer] = sig
+		logger.Printf("appendGroupRotationPartial(%x, %d) => %x", r.Group, signer, sig)
+	}
+	return m.store.WriteGroupRotation(r)
+}
+
+func (m *Machine) writeGroupRotationSignature(signer uint64, sig []byte) error {
+	m.signerLock.Lock()
+	defer m.signerLock.Unlock()
+
+	r, err := m.readGroupRotation()
+	if err != nil || r.Signatures[signer] != nil {
+		return err
+	}
+	r.Signatures[signer] = sig
+	return m.store.WriteGroupRotation(r)
+}
+
+func (m *Machine) writeGroupRotationProcess(pid string) error {
+	m.signerLock.Lock()
+	defer m.signerLock.Unlock()
+
+	r, err := m.readGroupRotation()
+	if err != nil || r.rotated(pid) {
+		return err
+	}
+	r.Rotated = append(r.Rotated, pid)
+	return m.store.WriteGroupRotation(r)
+}
+
+func (r *GroupRotation) rotated(pid string) bool {
+	for _, id := range r.Rotated {
+		if id == pid {
+			return true
+		}
+	}
+	return false
+}
+
+func buildRotationEvent(r *GroupRotation, signer uint64, sig []byte) *encoding.Event {
+	return &encoding.Event{
+		Process:   RotationProcess,
+		Asset:     RotationProcess,
+		Amount:    common.Zero,
+		Extra:     r.Group,
+		Timestamp: r.Nonce,
+		Nonce:     signer,
+		Signature: sig,
+	}
+}
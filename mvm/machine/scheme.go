@@ -0,0 +1,118 @@
+package machine
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	SignTypeTBLS      = 1
+	SignTypeSECP256K1 = 2
+)
+
+// SignatureScheme describes how the signatures of an engine are stored, the
+// pending partials are concatenated and replaced by the full signature once
+// combined. The TBLS partials are signed and combined by the machine with the
+// group share, the other schemes by the engine.
+type SignatureScheme struct {
+	SignType    int
+	Name        string
+	PartialSize int
+	// CheckFull tells the full signature from the concatenated partials
+	CheckFull func(val []byte) bool
+	// SplitFull splits the full signature to the partials, or nil if the
+	// full signature is not made of partials
+	SplitFull func(val []byte) [][]byte
+}
+
+var (
+	schemes   = make(map[int]*SignatureScheme)
+	platforms = make(map[string]int)
+	registry  = new(sync.RWMutex)
+)
+
+func init() {
+	RegisterSignatureScheme(&SignatureScheme{
+		SignType:    SignTypeTBLS,
+		Name:        "tbls",
+		PartialSize: 66,
+		CheckFull: func(val []byte) bool {
+			return len(val) == 64
+		},
+	})
+	RegisterSignatureScheme(&SignatureScheme{
+		SignType:    SignTypeSECP256K1,
+		Name:        "secp256k1",
+		PartialSize: 65,
+		CheckFull: func(val []byte) bool {
+			return len(val)%65 == 1
+		},
+		SplitFull: func(val []byte) [][]byte {
+			return splitPartials(val[:len(val)-1], 65)
+		},
+	})
+}
+
+func RegisterSignatureScheme(s *SignatureScheme) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if s.SignType <= 0 || s.PartialSize <= 0 || s.CheckFull == nil {
+		panic(fmt.Errorf("invalid signature scheme %s", s.Name))
+	}
+	if schemes[s.SignType] != nil {
+		panic(fmt.Errorf("signature scheme %d registered", s.SignType))
+	}
+	schemes[s.SignType] = s
+}
+
+func GetSignatureScheme(signType int) *SignatureScheme {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	return schemes[signType]
+}
+
+func registerPlatform(platform string, signType int) error {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if platform == "" {
+		return fmt.Errorf("invalid engine platform")
+	}
+	if schemes[signType] == nil {
+		return fmt.Errorf("invalid engine %s sign type %d", platform, signType)
+	}
+	if old, found := platforms[platform]; found && old != signType {
+		return fmt.Errorf("engine %s sign type %d registered as %d", platform, signType, old)
+	}
+	platforms[platform] = signType
+	return nil
+}
+
+func platformSignType(platform string) int {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	return platforms[platform]
+}
+
+// DecodeSignatures decodes the stored signatures to the partials, the full
+// signature is returned as the only element if it can't be split
+func (s *SignatureScheme) DecodeSignatures(val []byte) ([][]byte, bool) {
+	if !s.CheckFull(val) {
+		return splitPartials(val, s.PartialSize), false
+	}
+	if s.SplitFull != nil {
+		return s.SplitFull(val), true
+	}
+	return [][]byte{val}, true
+}
+
+func splitPartials(val []byte, size int) [][]byte {
+	sigs := make([][]byte, len(val)/size)
+	for i := 0; i < len(sigs); i++ {
+		sigs[i] = val[i*size : (i+1)*size]
+	}
+	return sigs
+}
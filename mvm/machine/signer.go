@@ -3,21 +3,19 @@ package machine
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
-	"sort"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/MixinNetwork/mixin/logger"
 	"github.com/MixinNetwork/tip/crypto"
 	"github.com/MixinNetwork/tip/crypto/en256"
 	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/metrics"
 	"github.com/drand/kyber/sign/tbls"
 )
 
 const (
-	SignTypeTBLS      = 1
-	SignTypeSECP256K1 = 2
-
 	messagePeriod = time.Hour
 )
 
@@ -30,125 +28,256 @@ func (m *Machine) getProcess(pid string) *Process {
 
 func (m *Machine) loopSignGroupEvents(ctx context.Context) {
 	sm := make(map[string]time.Time)
-	for {
-		time.Sleep(3 * time.Second)
+	quarantined := make(map[string]bool)
+	var bo backoff
+	for sleep(ctx, loopInterval) {
 		events, err := m.store.ListPendingGroupEvents(100)
 		if err != nil {
-			panic(err)
+			logger.Printf("ListPendingGroupEvents() => %v", err)
+			bo.wait(ctx)
+			continue
 		}
 
 		for _, e := range events {
-			if e.Process == "b2a47a3a-99ff-33a8-8c7b-d7fae9821509" { // FIXME remove this hack
-				e.Signature = make([]byte, 64)
-				m.writeSignedGroupEventAndExpirePending(e, SignTypeTBLS)
+			if quarantined[e.ID()] {
 				continue
 			}
 			lst := sm[e.ID()].Add(messagePeriod)
 			if lst.After(time.Now()) {
 				continue
 			}
-			sm[e.ID()] = time.Now()
-			logger.Verbosef("Machine.loopSignGroupEvents() => %d, %v", e.Nonce, e)
-
-			if e.Signature != nil {
-				panic(e)
+			// the partial sent again asks the peers for their signatures
+			typ := MessageTypePartial
+			if !sm[e.ID()].IsZero() {
+				typ = MessageTypeSignatureRequest
 			}
-			msg := e.Encode()
-			process := m.getProcess(e.Process)
-			if process.Platform == ProcessPlatformEOS {
-				e.Signature = m.engines[ProcessPlatformEOS].SignEvent(process.Address, e)
-			} else {
-				scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
-				partial, err := scheme.Sign(m.share, msg)
-				if err != nil {
-					panic(err)
-				}
-				e.Signature = partial
+			_, err := runStep(QuarantineStageSign, func() (time.Duration, error) {
+				return 0, m.signGroupEvent(ctx, e, typ)
+			})
+			if me, ok := err.(*Error); ok && me.Poison {
+				me.Event = e
+				m.quarantineEvent(ctx, e.Process, me)
+				quarantined[e.ID()] = true
+				continue
+			} else if err != nil {
+				logger.Printf("Machine.signGroupEvent(%v) => %v", e, err)
+				bo.wait(ctx)
+				break
 			}
+			bo.reset()
+			sm[e.ID()] = time.Now()
+		}
+	}
+}
 
-			threshold := make([]byte, 8)
-			binary.BigEndian.PutUint64(threshold, uint64(time.Now().UnixNano()))
-			err = m.queueMessage(ctx, append(e.Encode(), threshold...))
-			if err != nil {
-				panic(err)
-			}
-			err = m.appendPendingGroupEventSignature(e, msg, e.Signature, process.SignType())
-			if err != nil {
-				panic(err)
-			}
+func (m *Machine) signGroupEvent(ctx context.Context, e *encoding.Event, typ int) error {
+	if m.checkExemption(ExemptionZeroSignature, e) {
+		e.Signature = make([]byte, 64)
+		return m.writeSignedGroupEventAndExpirePending(e, SignTypeTBLS)
+	}
+	logger.Verbosef("Machine.loopSignGroupEvents() => %d, %v", e.Nonce, e)
+
+	process := m.getProcess(e.Process)
+	if process == nil {
+		return poisonEventError(QuarantineStageSign, e, fmt.Errorf("process %s not found", e.Process))
+	}
+	if e.Signature != nil {
+		return poisonEventError(QuarantineStageSign, e, fmt.Errorf("%w: pending signature %x", ErrorInvalidEvent, e.Signature))
+	}
+	msg := e.Encode()
+	if process.SignType() == SignTypeTBLS {
+		key := m.groupKey(e.Nonce)
+		if key.share == nil {
+			logger.Verbosef("Machine.signGroupEvent(%v) => not in the group", e)
+			return nil
 		}
+		scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
+		partial, err := scheme.Sign(key.share, msg)
+		if err != nil {
+			return poisonEventError(QuarantineStageSign, e, err)
+		}
+		e.Signature = partial
+	} else {
+		e.Signature = m.engines[process.Platform].SignEvent(process.Address, e)
 	}
+
+	err := m.queueMessage(ctx, m.peers(), typ, e)
+	if err != nil {
+		return err
+	}
+	return m.appendPendingGroupEventSignature(process, e, msg, e.Signature)
 }
 
 func (m *Machine) loopReceiveGroupMessages(ctx context.Context) {
 	sm := make(map[string]time.Time)
+	limiters := make(map[string]*peerLimiter)
+	var bo backoff
 	for {
 		peer, b, err := m.messenger.ReceiveMessage(ctx)
-		if err != nil {
-			logger.Verbosef("Machine.ReceiveMessage() => %s", err)
-			panic(err)
-		}
-		evt, err := encoding.DecodeEvent(b[:len(b)-8])
-		if err != nil {
-			logger.Verbosef("DecodeEvent(%x) => %s", b, err)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			metrics.MessengerErrors.WithLabelValues(metrics.MessengerReceive).Inc()
+			logger.Printf("Machine.ReceiveMessage() => %s", err)
+			bo.wait(ctx)
 			continue
 		}
-		process := m.getProcess(evt.Process)
-		if process == nil {
-			logger.Verbosef("getProcess(%s) => %v", evt.Process, evt)
+		bo.reset()
+		if !m.admitPeerMessage(peer, limiters) {
 			continue
 		}
-		if process.Platform == ProcessPlatformEOS {
-			m.handleEOSGroupMessages(ctx, process.Address, evt, sm)
-			continue
+		_, err = runStep("message", func() (time.Duration, error) {
+			return 0, m.handleGroupMessage(ctx, peer, b, sm)
+		})
+		if err != nil {
+			logger.Printf("Machine.handleGroupMessage(%s, %x) => %v", peer, b, err)
 		}
+	}
+}
 
-		sig := evt.Signature
-		evt.Signature = nil
-		msg := evt.Encode()
+func (m *Machine) handleGroupMessage(ctx context.Context, peer string, b []byte, sm map[string]time.Time) error {
+	gm, evt, err := DecodeMessage(b)
+	if err != nil {
+		logger.Verbosef("DecodeMessage(%x) => %s", b, err)
+		return nil
+	}
+	err = m.verifyMessage(peer, gm)
+	if errors.Is(err, errStaleMessage) {
+		logger.Verbosef("verifyMessage(%s, %x) => %s", peer, b, err)
+		metrics.MessagesDropped.WithLabelValues(metrics.DropStaleMessage).Inc()
+		return nil
+	} else if err != nil {
+		logger.Verbosef("verifyMessage(%s, %x) => %s", peer, b, err)
+		metrics.MessagesDropped.WithLabelValues(metrics.DropInvalidMessage).Inc()
+		m.recordPeerMisbehavior(peer, PeerMisbehaviorInvalidMessage, evt, err)
+		return nil
+	}
+	switch gm.Type {
+	case MessageTypeSyncRequest:
+		return m.handleSyncRequest(ctx, peer, evt, sm)
+	case MessageTypeSyncResponse:
+		return m.handleSyncResponse(peer, evt)
+	}
+	switch evt.Process {
+	case RotationProcess:
+		return m.handleRotationMessage(peer, gm.Type, evt)
+	case CommandProcess:
+		return m.handleCommandMessage(peer, evt)
+	}
+	process := m.getProcess(evt.Process)
+	if process == nil {
+		logger.Verbosef("getProcess(%s) => %v", evt.Process, evt)
+		return nil
+	}
+	if process.SignType() != SignTypeTBLS {
+		return m.handleEngineGroupMessages(ctx, process, evt, sm)
+	}
+
+	sig := evt.Signature
+	evt.Signature = nil
+	msg := evt.Encode()
+	key := m.groupKey(evt.Nonce)
+
+	partials, fullSignature, err := m.store.ReadGroupEventSignatures(evt.Process, evt.Nonce, SignTypeTBLS)
+	logger.Verbosef("ReadGroupEventSignatures(%s, %d) => %v %v %v", evt.Process, evt.Nonce, partials, fullSignature, err)
+	if err != nil {
+		return err
+	}
 
-		partials, fullSignature, err := m.store.ReadGroupEventSignatures(evt.Process, evt.Nonce, SignTypeTBLS)
-		logger.Verbosef("ReadGroupEventSignatures(%s, %d) => %v %v %v", evt.Process, evt.Nonce, partials, fullSignature, err)
+	switch true {
+	case gm.Type == MessageTypeFull:
+		err = crypto.Verify(key.poly.Commit(), msg, sig)
+		if err != nil && !m.checkExemption(ExemptionUnverifiedSignature, evt) {
+			logger.Verbosef("crypto.Verify(%x, %x) => %v %v", msg, sig, evt, err)
+			return nil
+		}
+		evt.Signature = sig
+		logger.Verbosef("loopReceiveGroupMessages(%x) => WriteSignedGroupEventAndExpirePending(%v)", b, evt)
+		return m.writeSignedGroupEventAndExpirePending(evt, SignTypeTBLS)
+	case fullSignature:
+		if sm[evt.ID()].Add(messagePeriod).After(time.Now()) {
+			return nil
+		}
+		evt.Signature = partials[0]
+		sm[evt.ID()] = time.Now()
+		return m.queueMessage(ctx, []string{peer}, MessageTypeFull, evt)
+	default:
+		err = m.verifyPeerPartial(peer, key, msg, sig)
 		if err != nil {
-			panic(err)
+			metrics.PartialsReceived.WithLabelValues(peer, metrics.PartialInvalid).Inc()
+			m.recordPeerMisbehavior(peer, PeerMisbehaviorInvalidPartial, evt, err)
+			return nil
 		}
+		metrics.PartialsReceived.WithLabelValues(peer, metrics.PartialValid).Inc()
+		err = m.appendPendingGroupEventSignature(process, evt, msg, sig)
+		if err != nil || gm.Type != MessageTypeSignatureRequest {
+			return err
+		}
+		return m.replySignatureRequest(ctx, peer, key, evt, msg, sm)
+	}
+}
 
-		switch true {
-		case len(sig) == 64:
-			err = crypto.Verify(m.poly.Commit(), msg, sig)
-			if err != nil && evt.Timestamp > 1638789832002675803 { // FIXME remove this timestamp check
-				logger.Verbosef("crypto.Verify(%x, %x) => %v %v", msg, sig, evt, err)
-				continue
-			}
-			evt.Signature = sig
-			logger.Verbosef("loopReceiveGroupMessages(%x) => WriteSignedGroupEventAndExpirePending(%v)", b, evt)
-			err = m.writeSignedGroupEventAndExpirePending(evt, SignTypeTBLS)
-			if err != nil {
-				panic(err)
-			}
-		case fullSignature:
-			if sm[evt.ID()].Add(messagePeriod).After(time.Now()) {
-				continue
-			}
-			evt.Signature = partials[0]
-			threshold := make([]byte, 8)
-			binary.BigEndian.PutUint64(threshold, uint64(time.Now().UnixNano()))
-			m.messenger.QueueMessage(ctx, peer, append(evt.Encode(), threshold...))
-			sm[evt.ID()] = time.Now()
-		default:
-			// FIXME ensure valid partial signature
-			err = m.appendPendingGroupEventSignature(evt, msg, sig, SignTypeTBLS)
-			if err != nil {
-				panic(err)
-			}
+// replySignatureRequest sends the full signature or the partial of this node
+// to the peer, only if the event is signed by this node already
+func (m *Machine) replySignatureRequest(ctx context.Context, peer string, key *groupKey, evt *encoding.Event, msg []byte, sm map[string]time.Time) error {
+	if key.share == nil || sm[evt.ID()].Add(messagePeriod).After(time.Now()) {
+		return nil
+	}
+	partials, fullSignature, err := m.store.ReadGroupEventSignatures(evt.Process, evt.Nonce, SignTypeTBLS)
+	if err != nil {
+		return err
+	}
+	typ := MessageTypeFull
+	if !fullSignature {
+		scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
+		partial, err := scheme.Sign(key.share, msg)
+		if err != nil || !checkSignedWith(partials, partial) {
+			return err
 		}
+		partials, typ = [][]byte{partial}, MessageTypePartial
 	}
+	evt.Signature = partials[0]
+	sm[evt.ID()] = time.Now()
+	return m.queueMessage(ctx, []string{peer}, typ, evt)
 }
 
-func (m *Machine) appendPendingGroupEventSignature(e *encoding.Event, msg, partial []byte, signType int) error {
+func verifyPartial(key *groupKey, msg, partial []byte) error {
+	scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
+	i, err := scheme.IndexOf(partial)
+	if err != nil {
+		return err
+	}
+	if i < 0 || i >= len(key.members) {
+		return fmt.Errorf("invalid partial index %d", i)
+	}
+	return scheme.VerifyPartial(key.poly, msg, partial)
+}
+
+// validPartials drops the invalid partials stored before the verification,
+// and the duplicated ones from the same share index
+func validPartials(key *groupKey, msg []byte, partials [][]byte) [][]byte {
+	scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
+	indexes := make(map[int]bool)
+	var valid [][]byte
+	for _, p := range partials {
+		if verifyPartial(key, msg, p) != nil {
+			continue
+		}
+		i, _ := scheme.IndexOf(p)
+		if indexes[i] {
+			continue
+		}
+		indexes[i] = true
+		valid = append(valid, p)
+	}
+	return valid
+}
+
+func (m *Machine) appendPendingGroupEventSignature(p *Process, e *encoding.Event, msg, partial []byte) error {
 	m.signerLock.Lock()
 	defer m.signerLock.Unlock()
 
+	signType := p.SignType()
 	partials, fullSignature, err := m.store.ReadGroupEventSignatures(e.Process, e.Nonce, signType)
 	if err != nil {
 		return err
@@ -161,18 +290,31 @@ func (m *Machine) appendPendingGroupEventSignature(e *encoding.Event, msg, parti
 		return nil
 	}
 	partials = append(partials, partial)
+	threshold := m.group.GetThreshold()
+	key := m.groupKey(e.Nonce)
+	if signType == SignTypeTBLS {
+		partials = validPartials(key, msg, partials)
+		threshold = key.threshold
+	}
 
-	if len(partials) < m.group.GetThreshold() {
+	if len(partials) < threshold {
 		return m.store.WritePendingGroupEventSignatures(e.Process, e.Nonce, partials, signType)
 	}
 
 	if signType == SignTypeTBLS {
-		e.Signature = m.recoverSignature(msg, partials)
-		logger.Verbosef("loopSignGroupEvents() => WriteSignedGroupEventAndExpirePending(%v) recover", e)
-		return m.store.WriteSignedGroupEventAndExpirePending(e, SignTypeTBLS)
+		e.Signature, err = recoverSignature(key, msg, partials)
 	} else {
-		return m.eosWriteFullSignatures(e, partials)
+		e.Signature, err = m.engines[p.Platform].CombineSignatures(p.Address, e, partials)
+	}
+	if err != nil {
+		return err
+	}
+	logger.Verbosef("loopSignGroupEvents() => WriteSignedGroupEventAndExpirePending(%v) combine", e)
+	err = m.store.WriteSignedGroupEventAndExpirePending(e, signType)
+	if err == nil {
+		observeSignatureLatency(p.Platform, e)
 	}
+	return err
 }
 
 func (m *Machine) writeSignedGroupEventAndExpirePending(e *encoding.Event, signType int) error {
@@ -182,17 +324,17 @@ func (m *Machine) writeSignedGroupEventAndExpirePending(e *encoding.Event, signT
 	return m.store.WriteSignedGroupEventAndExpirePending(e, signType)
 }
 
-func (m *Machine) recoverSignature(msg []byte, partials [][]byte) []byte {
+func recoverSignature(key *groupKey, msg []byte, partials [][]byte) ([]byte, error) {
 	scheme := tbls.NewThresholdSchemeOnG1(en256.NewSuiteG2())
-	sig, err := scheme.Recover(m.poly, msg, partials, m.group.GetThreshold(), len(m.group.GetMembers()))
+	sig, err := scheme.Recover(key.poly, msg, partials, key.threshold, len(key.members))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	err = crypto.Verify(m.poly.Commit(), msg, sig)
+	err = crypto.Verify(key.poly.Commit(), msg, sig)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return sig
+	return sig, nil
 }
 
 func checkSignedWith(partials [][]byte, s []byte) bool {
@@ -204,60 +346,48 @@ func checkSignedWith(partials [][]byte, s []byte) bool {
 	return false
 }
 
-func (m *Machine) handleEOSGroupMessages(ctx context.Context, address string, evt *encoding.Event, sm map[string]time.Time) {
-	if len(evt.Signature) == 0 || len(evt.Signature)%65 != 0 {
-		logger.Verbosef("++++handleEOSGroupMessages: invalid signature length: %d", len(evt.Signature))
-		return
+// handleEngineGroupMessages handles the signatures signed by the engine,
+// instead of the machine TBLS share
+func (m *Machine) handleEngineGroupMessages(ctx context.Context, p *Process, evt *encoding.Event, sm map[string]time.Time) error {
+	engine := m.engines[p.Platform]
+	scheme := GetSignatureScheme(p.SignType())
+	if len(evt.Signature) == 0 || len(evt.Signature)%scheme.PartialSize != 0 {
+		logger.Verbosef("handleEngineGroupMessages(%s): invalid signature length: %d", p.Platform, len(evt.Signature))
+		return nil
 	}
 
-	if !m.engines[ProcessPlatformEOS].VerifyEvent(address, evt) {
-		logger.Verbosef("VerifyEvent(%v, %v) return false", address, evt)
-		return
+	if !engine.VerifyEvent(p.Address, evt) {
+		logger.Verbosef("VerifyEvent(%v, %v) return false", p.Address, evt)
+		return nil
 	}
 
-	_, fullSignature, err := m.store.ReadGroupEventSignatures(evt.Process, evt.Nonce, SignTypeSECP256K1)
+	_, fullSignature, err := m.store.ReadGroupEventSignatures(evt.Process, evt.Nonce, scheme.SignType)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	lst, ok := sm[evt.ID()]
 	if !ok {
 		sm[evt.ID()] = time.Now()
 	} else if fullSignature && lst.Add(messagePeriod).Before(time.Now()) {
-		partial := m.engines[ProcessPlatformEOS].SignEvent(address, evt)
+		partial := engine.SignEvent(p.Address, evt)
 		evt.Signature = partial
-		threshold := make([]byte, 8)
-		binary.BigEndian.PutUint64(threshold, uint64(time.Now().UnixNano()))
-		m.messenger.BroadcastMessage(ctx, append(evt.Encode(), threshold...))
+		err = m.broadcastMessage(ctx, MessageTypePartial, evt)
+		if err != nil {
+			metrics.MessengerErrors.WithLabelValues(metrics.MessengerBroadcast).Inc()
+		}
 		sm[evt.ID()] = time.Now()
 	}
 
 	if fullSignature {
-		return
+		return nil
 	}
 	sig := evt.Signature
 	evt.Signature = nil
-	m.appendPendingGroupEventSignature(evt, nil, sig, SignTypeSECP256K1)
-}
-
-func (m *Machine) eosWriteFullSignatures(e *encoding.Event, partials [][]byte) error {
-	e.Signature = nil
-	sort.Slice(partials, func(i, j int) bool {
-		return bytes.Compare(partials[i], partials[j]) < 0
-	})
-	for _, partial := range partials {
-		e.Signature = append(e.Signature, partial...)
-	}
-	e.Signature = append(e.Signature, byte(len(partials)))
-	return m.store.WriteSignedGroupEventAndExpirePending(e, SignTypeSECP256K1)
+	return m.appendPendingGroupEventSignature(p, evt, nil, sig)
 }
 
-func (m *Machine) queueMessage(ctx context.Context, b []byte) error {
-	for _, p := range m.group.GetMembers() {
-		err := m.messenger.QueueMessage(ctx, p, b)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+func observeSignatureLatency(platform string, e *encoding.Event) {
+	ts := time.Unix(0, int64(e.Timestamp))
+	metrics.SignatureLatency.WithLabelValues(platform).Observe(time.Since(ts).Seconds())
 }
@@ -0,0 +1,142 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+)
+
+// the intervals of the machine loops and the backoff, which are shortened by
+// the tests to run without waiting the production clocks
+var (
+	loopInterval    = 3 * time.Second
+	processInterval = 5 * time.Second
+	pauseInterval   = time.Minute
+
+	backoffMinimum = time.Second
+	backoffMaximum = time.Minute
+)
+
+type backoff struct {
+	delay time.Duration
+}
+
+func (b *backoff) reset() {
+	b.delay = 0
+}
+
+func (b *backoff) wait(ctx context.Context) bool {
+	switch {
+	case b.delay < backoffMinimum:
+		b.delay = backoffMinimum
+	case b.delay*2 > backoffMaximum:
+		b.delay = backoffMaximum
+	default:
+		b.delay = b.delay * 2
+	}
+	return sleep(ctx, b.delay)
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// runStep converts a panic in the step to a poison error, so that a bad
+// event could only stop its own process instead of the whole node
+func runStep(stage string, step func() (time.Duration, error)) (delay time.Duration, err error) {
+	defer func() {
+		rcv := recover()
+		if rcv == nil {
+			return
+		}
+		var me *Error
+		if e, ok := rcv.(error); ok && errors.As(e, &me) {
+			me.Poison = true
+			err = me
+		} else {
+			err = &Error{Stage: stage, Poison: true, Err: fmt.Errorf("panic %v", rcv)}
+		}
+	}()
+	return step()
+}
+
+// retry runs the function until it succeeds, or the context is done, or the
+// error is poison which will never succeed on retry
+func (m *Machine) retry(ctx context.Context, op string, fn func() error) error {
+	var bo backoff
+	for {
+		_, err := runStep(op, func() (time.Duration, error) {
+			return 0, fn()
+		})
+		if err == nil {
+			return nil
+		}
+		logger.Printf("Machine.retry(%s) => %v", op, err)
+		var me *Error
+		if errors.As(err, &me) && me.Poison {
+			return err
+		}
+		if !bo.wait(ctx) {
+			return ctx.Err()
+		}
+	}
+}
+
+// retryOutput retries the step of the output handler with the machine
+// context, and blocks the output once the machine is shutting down, so it's
+// handled again after restart. The lock held by the handler is released
+// before blocking, because the blocked handler never returns.
+func (m *Machine) retryOutput(locker sync.Locker, op string, fn func() error) error {
+	err := m.retry(m.ctx, op, fn)
+	if err != nil && m.ctx.Err() != nil {
+		if locker != nil {
+			locker.Unlock()
+		}
+		m.blockOutput()
+	}
+	return err
+}
+
+// superviseProcess runs the process step until the context is done, the
+// transient errors are retried with backoff, and the poison event is
+// quarantined and skipped so the later events of the process still proceed
+func (m *Machine) superviseProcess(ctx context.Context, p *Process, stage string, step func() (time.Duration, error)) {
+	var bo backoff
+	for ctx.Err() == nil {
+		delay, err := runStep(stage, step)
+		if err == nil {
+			bo.reset()
+			sleep(ctx, delay)
+			continue
+		}
+
+		var me *Error
+		if !errors.As(err, &me) || !me.Poison || me.Event == nil {
+			logger.Printf("Process(%s).%s => %v", p.Identifier, stage, err)
+			bo.wait(ctx)
+			continue
+		}
+		err = m.skipPoisonEvent(ctx, p, me)
+		if err != nil {
+			logger.Printf("Process(%s).%s => skipPoisonEvent(%s) => %v", p.Identifier, stage, me.Event.ID(), err)
+			bo.wait(ctx)
+			continue
+		}
+		logger.Printf("Process(%s).%s => quarantined %s", p.Identifier, stage, me.Event.ID())
+		bo.reset()
+	}
+}
@@ -0,0 +1,203 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/tip/crypto"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+)
+
+const (
+	syncBatch = 100
+)
+
+var (
+	syncPeriod         = 5 * time.Second
+	syncTimeout        = time.Minute
+	syncBackoffMaximum = 30 * time.Minute
+)
+
+// syncState is when to request the signatures of the pending event again,
+// and the backoff after that request
+type syncState struct {
+	next    time.Time
+	backoff time.Duration
+}
+
+// loopSyncGroupEvents asks the peers for the signatures of the pending events
+// which are not signed in a sync timeout, or all pending events right after
+// boot, so the member missed the broadcasts needs not to wait the messages
+// sent again after the message period. The request of each event backs off
+// until it is signed, so the stuck events don't flood the members
+func (m *Machine) loopSyncGroupEvents(ctx context.Context) {
+	var states map[string]*syncState
+	for sleep(ctx, syncPeriod) {
+		events, err := m.store.ListPendingGroupEvents(syncBatch)
+		if err != nil {
+			logger.Printf("ListPendingGroupEvents() => %v", err)
+			continue
+		}
+
+		now := time.Now()
+		boot := states == nil
+		pending := make(map[string]*syncState)
+		ranges := make(map[string][2]uint64)
+		for _, e := range events {
+			s := states[e.ID()]
+			if s == nil {
+				s = &syncState{next: now.Add(syncTimeout), backoff: syncTimeout}
+				if boot {
+					s.next = now
+				}
+			}
+			pending[e.ID()] = s
+			if s.next.After(now) {
+				continue
+			}
+			p := m.getProcess(e.Process)
+			if p == nil || p.SignType() != SignTypeTBLS {
+				continue
+			}
+			s.next = now.Add(s.backoff)
+			s.backoff = s.backoff * 2
+			if s.backoff > syncBackoffMaximum {
+				s.backoff = syncBackoffMaximum
+			}
+			r, ok := ranges[e.Process]
+			if !ok {
+				r = [2]uint64{e.Nonce, e.Nonce}
+			}
+			if e.Nonce < r[0] {
+				r[0] = e.Nonce
+			}
+			if e.Nonce > r[1] {
+				r[1] = e.Nonce
+			}
+			ranges[e.Process] = r
+		}
+		for pid, r := range ranges {
+			err = m.requestSync(ctx, pid, r[0], r[1])
+			if err != nil {
+				logger.Printf("Machine.requestSync(%s, %d, %d) => %v", pid, r[0], r[1], err)
+			}
+		}
+		states = pending
+	}
+}
+
+// requestSync sends the sync request envelope to all other members, even if
+// they are not known to accept the envelope after a restart, and the legacy
+// nodes just drop the unknown message. The message nonce is the first nonce
+// of the range, and the timestamp is the last one
+func (m *Machine) requestSync(ctx context.Context, pid string, from, to uint64) error {
+	if to-from >= syncBatch {
+		to = from + syncBatch - 1
+	}
+	evt := &encoding.Event{
+		Process:   pid,
+		Asset:     pid,
+		Amount:    common.Zero,
+		Nonce:     from,
+		Timestamp: to,
+	}
+	logger.Verbosef("Machine.requestSync(%s, %d, %d)", pid, from, to)
+	for _, id := range m.peers() {
+		if id == m.self {
+			continue
+		}
+		err := m.messenger.QueueMessage(ctx, id, m.buildMessage(true, MessageTypeSyncRequest, evt))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleSyncRequest replies the full signature, or all partials, stored for
+// each nonce of the range, at most once in a sync period for a peer process
+func (m *Machine) handleSyncRequest(ctx context.Context, peer string, evt *encoding.Event, sm map[string]time.Time) error {
+	p := m.getProcess(evt.Process)
+	if p == nil || p.SignType() != SignTypeTBLS {
+		return nil
+	}
+	from, to := evt.Nonce, evt.Timestamp
+	if to < from || to-from >= syncBatch {
+		return fmt.Errorf("invalid sync range %d %d", from, to)
+	}
+	id := fmt.Sprintf("SYNC:%s:%s", peer, evt.Process)
+	if sm[id].Add(syncPeriod).After(time.Now()) {
+		return nil
+	}
+	sm[id] = time.Now()
+
+	for nonce := from; nonce <= to; nonce++ {
+		partials, _, err := m.store.ReadGroupEventSignatures(evt.Process, nonce, SignTypeTBLS)
+		if err != nil {
+			return err
+		} else if len(partials) == 0 {
+			continue
+		}
+		var sig []byte
+		for _, s := range partials {
+			sig = append(sig, s...)
+		}
+		resp := &encoding.Event{
+			Process:   evt.Process,
+			Asset:     evt.Process,
+			Amount:    common.Zero,
+			Nonce:     nonce,
+			Signature: sig,
+		}
+		err = m.messenger.QueueMessage(ctx, peer, m.buildMessage(true, MessageTypeSyncResponse, resp))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleSyncResponse verifies the signatures against the pending event of
+// this node, so the peer is not trusted with the event content
+func (m *Machine) handleSyncResponse(peer string, resp *encoding.Event) error {
+	p := m.getProcess(resp.Process)
+	if p == nil || p.SignType() != SignTypeTBLS {
+		return nil
+	}
+	evt, err := m.store.ReadGroupEvent(resp.Process, resp.Nonce)
+	if err != nil || evt == nil || evt.Signature != nil {
+		return err
+	}
+	msg := evt.Encode()
+	key := m.groupKey(evt.Nonce)
+
+	scheme := GetSignatureScheme(SignTypeTBLS)
+	if scheme.CheckFull(resp.Signature) {
+		err = crypto.Verify(key.poly.Commit(), msg, resp.Signature)
+		if err != nil && !m.checkExemption(ExemptionUnverifiedSignature, evt) {
+			m.recordPeerMisbehavior(peer, PeerMisbehaviorInvalidSignature, evt, err)
+			return nil
+		}
+		evt.Signature = resp.Signature
+		return m.writeSignedGroupEventAndExpirePending(evt, SignTypeTBLS)
+	}
+
+	partials, _ := scheme.DecodeSignatures(resp.Signature)
+	for _, partial := range partials {
+		err = verifyPartial(key, msg, partial)
+		if err != nil {
+			m.recordPeerMisbehavior(peer, PeerMisbehaviorInvalidPartial, evt, err)
+			return nil
+		}
+	}
+	for _, partial := range partials {
+		err = m.appendPendingGroupEventSignature(p, evt, msg, partial)
+		if err != nil || evt.Signature != nil {
+			return err
+		}
+	}
+	return nil
+}
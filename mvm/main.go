@@ -65,7 +65,7 @@ func main() {
 						Name:    "platform",
 						Aliases: []string{"p"},
 						Value:   "quorum",
-						Usage:   "The smart contract platform",
+						Usage:   "The smart contract platform, e.g. quorum, evm-137, eos or solana",
 					},
 					&cli.StringFlag{
 						Name:    "address",
@@ -116,6 +116,133 @@ func main() {
 					},
 				},
 			},
+			{
+				Name:   "credit",
+				Usage:  "Credit a MVM app with the process fee asset",
+				Action: creditProcessCmd,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "machine",
+						Aliases: []string{"m"},
+						Value:   "~/.mixin/mvm/config.toml",
+						Usage:   "The MVM members and threshold configuration",
+					},
+					&cli.StringFlag{
+						Name:    "key",
+						Aliases: []string{"k"},
+						Usage:   "The app key JSON file",
+					},
+					&cli.StringFlag{
+						Name:    "process",
+						Aliases: []string{"p"},
+						Usage:   "The app ID, default to the app key client id",
+					},
+					&cli.StringFlag{
+						Name:  "amount",
+						Value: "1",
+						Usage: "The process fee asset amount",
+					},
+				},
+			},
+			{
+				Name:   "halt",
+				Usage:  "Vote to halt the registry contract of a MVM app",
+				Action: haltProcessCmd,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   "~/.mixin/mvm/config.toml",
+						Usage:   "The configuration file path of the member node",
+					},
+					&cli.StringFlag{
+						Name:    "process",
+						Aliases: []string{"p"},
+						Usage:   "The app ID",
+					},
+				},
+			},
+			{
+				Name:   "evolve",
+				Usage:  "Vote to evolve the halted registry contract of a MVM app to the next one",
+				Action: evolveProcessCmd,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   "~/.mixin/mvm/config.toml",
+						Usage:   "The configuration file path of the member node",
+					},
+					&cli.StringFlag{
+						Name:    "process",
+						Aliases: []string{"p"},
+						Usage:   "The app ID",
+					},
+					&cli.StringFlag{
+						Name:    "address",
+						Aliases: []string{"a"},
+						Usage:   "The next registry contract address",
+					},
+				},
+			},
+			{
+				Name:   "keygen",
+				Usage:  "Generate the group key with the genesis members",
+				Action: keygenCmd,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   "~/.mixin/mvm/config.toml",
+						Usage:   "The configuration file path of the member node",
+					},
+					&cli.StringFlag{
+						Name:    "dir",
+						Aliases: []string{"d"},
+						Value:   "~/.mixin/mvm/keygen",
+						Usage:   "The keygen state directory path to resume",
+					},
+					&cli.Uint64Flag{
+						Name:  "nonce",
+						Usage: "The keygen ceremony nonce, the same for all members",
+					},
+				},
+			},
+			{
+				Name:   "reshare",
+				Usage:  "Reshare the group key to the new members without changing the group public key",
+				Action: reshareCmd,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Value:   "~/.mixin/mvm/config.toml",
+						Usage:   "The configuration file path of the old or new member node",
+					},
+					&cli.StringFlag{
+						Name:    "dir",
+						Aliases: []string{"d"},
+						Value:   "~/.mixin/mvm/keygen",
+						Usage:   "The reshare state directory path to resume",
+					},
+					&cli.StringSliceFlag{
+						Name:  "members",
+						Usage: "The new members",
+					},
+					&cli.IntFlag{
+						Name:  "threshold",
+						Usage: "The new threshold",
+					},
+					&cli.Uint64Flag{
+						Name:  "nonce",
+						Usage: "The reshare ceremony nonce, the same for all old and new members",
+					},
+					&cli.Uint64Flag{
+						Name:  "switch",
+						Usage: "The event nonce to sign with the new shares, higher than all process nonces",
+					},
+				},
+			},
 			{
 				Name:   "decode",
 				Usage:  "Decode a MVM message",
@@ -4,7 +4,7 @@ import (
 	"encoding/base64"
 	"fmt"
 
-	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
 	"github.com/urfave/cli/v2"
 )
 
@@ -13,10 +13,11 @@ func decodeMsgCmd(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	evt, err := encoding.DecodeEvent(b[:len(b)-8])
+	msg, evt, err := machine.DecodeMessage(b)
 	if err != nil {
 		return err
 	}
+	fmt.Println(msg.Version, msg.Type, msg.Sender, msg.Timestamp)
 	fmt.Println(evt)
 	return nil
 }
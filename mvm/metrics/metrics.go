@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "mvm"
+
+	PartialValid   = "valid"
+	PartialInvalid = "invalid"
+
+	MessengerReceive   = "receive"
+	MessengerQueue     = "queue"
+	MessengerBroadcast = "broadcast"
+
+	ReorgRollback = "rollback"
+	ReorgAlarm    = "alarm"
+
+	DropNonMember      = "non-member"
+	DropRateLimit      = "rate-limit"
+	DropInvalidMessage = "invalid-message"
+	DropStaleMessage   = "stale-message"
+)
+
+var (
+	SignatureLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "machine",
+		Name:      "signature_latency_seconds",
+		Help:      "Duration from the group event output to its full signature.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"platform"})
+
+	PartialsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "machine",
+		Name:      "partials_received_total",
+		Help:      "Partial signatures received from each peer.",
+	}, []string{"peer", "result"})
+
+	MessengerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "messenger",
+		Name:      "errors_total",
+		Help:      "Messenger receive and send errors.",
+	}, []string{"operation"})
+
+	MessagesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "messenger",
+		Name:      "dropped_messages_total",
+		Help:      "Group messages dropped before handled.",
+	}, []string{"reason"})
+
+	SendGroupEventsFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "machine",
+		Name:      "send_group_events_failures_total",
+		Help:      "Failed EnsureSendGroupEvents calls of each process.",
+	}, []string{"process"})
+
+	EngineBlockOffset = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "engine",
+		Name:      "block_offset",
+		Help:      "The block number scanned by each engine.",
+	}, []string{"platform"})
+
+	EngineReorgs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "engine",
+		Name:      "reorg_events_total",
+		Help:      "Contract events from orphaned blocks, rolled back or alarmed.",
+	}, []string{"platform", "action"})
+
+	EngineTransactions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "engine",
+		Name:      "transactions_total",
+		Help:      "Outbound engine transactions confirmed by status.",
+	}, []string{"platform", "status"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		SignatureLatency,
+		PartialsReceived,
+		MessengerErrors,
+		MessagesDropped,
+		SendGroupEventsFailures,
+		EngineBlockOffset,
+		EngineReorgs,
+		EngineTransactions,
+	)
+}
@@ -0,0 +1,115 @@
+package quorum
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/gofrs/uuid"
+)
+
+const (
+	opPush4  = 0x63
+	opPush32 = 0x7f
+)
+
+// registryView is the code and the views of a registry read at the same
+// height, the view is "0x" if the contract has no such view
+type registryView struct {
+	code     []byte
+	pid      string
+	inbound  string
+	outbound string
+}
+
+// verifyContractCode checks the deployed code implements the MixinProcess,
+// the dispatcher pushes the mixin(bytes) selector, the emit pushes the
+// MixinTransaction topic, and the PID view returns the process
+func verifyContractCode(address, pid string, code []byte, res string) error {
+	err := verifyProcessCode(address, code)
+	if err != nil {
+		return err
+	}
+	id, err := parseContractPID(res)
+	if err != nil {
+		return fmt.Errorf("contract %s has no PID %s", address, res)
+	}
+	if id != pid {
+		return fmt.Errorf("contract %s has process %s not %s", address, id, pid)
+	}
+	return nil
+}
+
+// verifyRegistryEvolve checks the next registry as the evolve of the current
+// one does, the next one has another PID and the same nonces
+func verifyRegistryEvolve(next string, current, evolved *registryView) error {
+	err := verifyProcessCode(next, evolved.code)
+	if err != nil {
+		return err
+	}
+	id, err := parseContractPID(evolved.pid)
+	if err != nil {
+		return fmt.Errorf("contract %s has no PID %s", next, evolved.pid)
+	}
+	old, err := parseContractPID(current.pid)
+	if err != nil || id == old {
+		return fmt.Errorf("registry %s has the same process %s", next, id)
+	}
+	for _, pair := range [][2]string{
+		{current.inbound, evolved.inbound},
+		{current.outbound, evolved.outbound},
+	} {
+		a, err := ethereumNumberToUint64(pair[0])
+		if err != nil {
+			return err
+		}
+		b, err := ethereumNumberToUint64(pair[1])
+		if err != nil || a != b {
+			return fmt.Errorf("registry %s nonce %s not %s", next, pair[1], pair[0])
+		}
+	}
+	return nil
+}
+
+func verifyProcessCode(address string, code []byte) error {
+	if len(code) == 0 {
+		return fmt.Errorf("address %s is not a contract", address)
+	}
+
+	method, err := hex.DecodeString(EventMethod[2:])
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Contains(code, append([]byte{opPush4}, method...)) {
+		return fmt.Errorf("contract %s has no method %s", address, EventMethod)
+	}
+
+	topic, err := hex.DecodeString(EventTopic[2:])
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Contains(code, append([]byte{opPush32}, topic...)) {
+		return fmt.Errorf("contract %s has no event topic %s", address, EventTopic)
+	}
+	return nil
+}
+
+// parseContractPID decodes the uint128 PID view result to the process id
+func parseContractPID(res string) (string, error) {
+	if !strings.HasPrefix(res, "0x") || len(res) != 66 {
+		return "", fmt.Errorf("invalid pid %s", res)
+	}
+	b, err := hex.DecodeString(res[2:])
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(b[:16], make([]byte, 16)) {
+		return "", fmt.Errorf("invalid pid %s", res)
+	}
+	id, err := uuid.FromBytes(b[16:])
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
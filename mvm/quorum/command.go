@@ -0,0 +1,179 @@
+package quorum
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MixinNetwork/mixin/domains/ethereum"
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// registry halt(bytes) verifies the group signature of this message
+	haltMessage = "HALT"
+)
+
+// EncodeGroupCommand returns the message of the registry halt, or the next
+// registry address bytes for evolve
+func (e *Engine) EncodeGroupCommand(c *machine.GroupCommand) ([]byte, error) {
+	switch c.Kind {
+	case machine.GroupCommandHalt:
+		return []byte(haltMessage), nil
+	case machine.GroupCommandEvolve:
+		err := ethereum.VerifyAddress(c.Next)
+		if err != nil {
+			return nil, err
+		}
+		return common.HexToAddress(c.Next).Bytes(), nil
+	}
+	return nil, fmt.Errorf("invalid group command %d", c.Kind)
+}
+
+// VerifyEvolveAddress checks the next registry at the confirmed height by the
+// rules of the registry evolve, which requires a different PID with the same
+// INBOUND and OUTBOUND, and the RPC errors are returned as the engine
+// unavailable for the machine to retry instead of the rejection
+func (e *Engine) VerifyEvolveAddress(ctx context.Context, address, next string) error {
+	err := ethereum.VerifyAddress(next)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(address, next) {
+		return fmt.Errorf("next registry %s is the current one", next)
+	}
+
+	for i := 0; i < VerifyAddressRetries; i++ {
+		var current, evolved *registryView
+		current, evolved, err = e.getConfirmedRegistries(address, next)
+		if err == nil {
+			return verifyRegistryEvolve(next, current, evolved)
+		}
+		logger.Printf("VerifyEvolveAddress(%s, %s) => getConfirmedRegistries() => %v", address, next, err)
+		if !sleep(ctx, ClockTick) {
+			break
+		}
+	}
+	return fmt.Errorf("%w: %v", machine.ErrorEngineUnavailable, err)
+}
+
+// getConfirmedRegistries reads both registries at the same height, so the
+// members agree on the nonces compared
+func (e *Engine) getConfirmedRegistries(address, next string) (*registryView, *registryView, error) {
+	height, err := e.getConfirmedHeight()
+	if err != nil {
+		return nil, nil, err
+	}
+	current, err := e.getRegistryView(address, height)
+	if err != nil {
+		return nil, nil, err
+	}
+	evolved, err := e.getRegistryView(next, height)
+	return current, evolved, err
+}
+
+func (e *Engine) getRegistryView(address string, height uint64) (*registryView, error) {
+	code, id, err := e.getConfirmedContract(address, height)
+	if err != nil {
+		return nil, err
+	}
+	r := &registryView{code: code, pid: id}
+	r.inbound, err = e.rpc.GetContractView(address, RegistryNonceMethod, height)
+	if err != nil {
+		return nil, err
+	}
+	r.outbound, err = e.rpc.GetContractView(address, RegistryOutboundMethod, height)
+	return r, err
+}
+
+// ExecuteGroupCommand checks the registry state on chain, so all members
+// agree on the command done, and only the publisher sends the transaction
+func (e *Engine) ExecuteGroupCommand(address string, c *machine.GroupCommand) (bool, error) {
+	halted, err := e.rpc.GetContractHalted(address)
+	if err != nil {
+		return false, err
+	}
+	switch c.Kind {
+	case machine.GroupCommandHalt:
+		if halted {
+			return true, nil
+		}
+		return false, e.sendGroupCommand(address, HaltMethod, c.Signature)
+	case machine.GroupCommandEvolve:
+		if !halted {
+			return false, nil
+		}
+		evolved, err := e.rpc.GetRegistryEvolved(address, c.Next)
+		if err != nil {
+			return false, err
+		} else if evolved {
+			return true, e.moveGroupEvents(address, c.Next)
+		}
+		payload := append(common.HexToAddress(c.Next).Bytes(), c.Signature...)
+		return false, e.sendGroupCommand(address, EvolveMethod, payload)
+	}
+	return false, fmt.Errorf("invalid group command %d", c.Kind)
+}
+
+// moveGroupEvents queues the events not sent to the halted registry for the
+// next one, which accepts the events from the same inbound nonce
+func (e *Engine) moveGroupEvents(address, next string) error {
+	offset, err := e.rpc.GetContractNonce(address)
+	if err != nil {
+		return err
+	}
+	for {
+		evts, err := e.storeListGroupEvents(address, offset, 100)
+		if err != nil || len(evts) == 0 {
+			return err
+		}
+		err = e.storeWriteGroupEvents(next, evts)
+		if err != nil {
+			return err
+		}
+		offset = evts[len(evts)-1].Nonce + 1
+	}
+}
+
+// sendGroupCommand sends the command with the publisher key, unless a
+// command transaction to the registry is pending within the bump interval
+func (e *Engine) sendGroupCommand(address, method string, payload []byte) error {
+	if !e.IsPublisher() {
+		return nil
+	}
+	txs, err := e.storeListTransactions(address, 100)
+	if err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		if tx.Kind != machine.TransactionKindGroupCommand || tx.Status != machine.TransactionStatusPending {
+			continue
+		}
+		if tx.SentAt.Add(e.bumpInterval).After(time.Now()) {
+			return nil
+		}
+	}
+
+	nonce, err := e.rpc.GetAddressNonce(pub(e.key))
+	if err != nil {
+		return err
+	}
+	fee, err := e.suggestGasFee()
+	if err != nil {
+		return err
+	}
+	db := buildBytesCallData(method, payload)
+	gas := e.estimateGas(pub(e.key), address, db)
+	id, raw := e.signTransaction(address, e.key, decimal.Zero, db, nonce, gas, fee)
+	res, err := e.rpc.SendRawTransaction(raw)
+	logger.Printf("sendGroupCommand(%s, %s) => SendRawTransaction(%s) => %s, %v", address, method, id, res, err)
+	if err != nil {
+		return err
+	}
+	tx := newEngineTransaction(id, machine.TransactionKindGroupCommand, address, pub(e.key), address, nonce, db, gas)
+	return e.storeWriteTransaction(tx)
+}
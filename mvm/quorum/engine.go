@@ -1,14 +1,21 @@
 package quorum
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
+	"math/big"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/MixinNetwork/mixin/common"
 	"github.com/MixinNetwork/mixin/domains/ethereum"
 	"github.com/MixinNetwork/mixin/logger"
 	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/MixinNetwork/trusted-group/mvm/metrics"
 	"github.com/dgraph-io/badger/v3"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/shopspring/decimal"
@@ -20,33 +27,125 @@ const (
 	EventTopic = "0xdb53e751d28ed0d6e3682814bf8d23f7dd7b29c94f74a56fbb7f88e9dca9f39b"
 	// function mixin(bytes calldata raw) public returns (bool)
 	EventMethod = "0x5cae8005"
+	// uint64 public NONCE
+	ContractNonceMethod = "0xe091dd1a"
+	// uint64 public INBOUND of the registry
+	RegistryNonceMethod = "0x85835923"
+	// uint64 public OUTBOUND of the registry
+	RegistryOutboundMethod = "0x48093204"
+	// uint128 public PID
+	ContractPIDMethod = "0x5eaec0e4"
+	// uint256[4] public GROUP
+	ContractGroupMethod = "0x81ebf1c3"
+	// function iterate(bytes memory raw) public
+	IterateMethod = "0xbab54626"
+	// function halt(bytes memory raw) public
+	HaltMethod = "0x944e7cb1"
+	// function evolve(bytes memory raw) public
+	EvolveMethod = "0x0a2da6ab"
+	// bool public HALTED
+	RegistryHaltedMethod = "0x678d7732"
+	// address[] public addresses
+	RegistryAddressesMethod = "0xedf26d9b"
+	// address public registry of the registrable user and asset contracts
+	RegistrableRegistryMethod = "0x7b103999"
 
 	GasLimit = 8000000
-	GasPrice = 10000000000
+
+	GasTransaction    = 21000
+	GasTxDataZero     = 4
+	GasTxDataNonZero  = 16
+	GasEventExecution = 400000
+	FeeRateGasUnit    = 1000000
+
+	DefaultConfirmations = 12
+	DefaultBumpInterval  = 60
+	DefaultRevertRetries = 3
+	LogsBlockRange       = 10
+	VerifyAddressRetries = 5
 )
 
+// Configuration is an EVM chain instance of the engine, the processes choose
+// the chain by the platform when added, and each instance has its own store
 type Configuration struct {
-	Store      string `toml:"store"`
-	RPC        string `toml:"rpc"`
-	ChainId    int64  `toml:"chain"`
-	Base       uint64 `toml:"base"`
-	PrivateKey string `toml:"key"`
+	Platform      string `toml:"platform"`
+	Store         string `toml:"store"`
+	RPC           string `toml:"rpc"`
+	ChainId       int64  `toml:"chain"`
+	Registry      string `toml:"registry"`
+	Base          uint64 `toml:"base"`
+	Confirmations uint64 `toml:"confirmations"`
+	DynamicFee    bool   `toml:"dynamic-fee"`
+	MaxGasPrice   uint64 `toml:"max-gas-price"`
+	BumpInterval  uint64 `toml:"bump-interval"`
+	RevertRetries uint64 `toml:"revert-retries"`
+	PrivateKey    string `toml:"key"`
+	FeeRate       string `toml:"fee-rate"`
 }
 
 type Engine struct {
-	db      *badger.DB
-	rpc     *RPC
-	chainId int64
-	key     string
+	db       *badger.DB
+	rpc      *RPC
+	platform string
+	chainId  int64
+	registry string
+	key      string
+	feeRate  common.Integer
+	loops    *sync.WaitGroup
+
+	confirmations uint64
+	dynamicFee    bool
+	maxGasPrice   *big.Int
+	bumpInterval  time.Duration
+	revertRetries uint64
 }
 
-func Boot(conf *Configuration) (*Engine, error) {
-	db := openBadger(conf.Store)
-	rpc, err := NewRPC(conf.RPC, conf.Base)
+func Boot(ctx context.Context, conf *Configuration) (*Engine, error) {
+	if conf.Base < quorumMinimumHeight {
+		return nil, fmt.Errorf("block base too small %d", conf.Base)
+	}
+	rpc, chainId, err := bootRPC(ctx, conf)
 	if err != nil {
 		return nil, err
 	}
-	e := &Engine{db: db, rpc: rpc, chainId: conf.ChainId}
+	if chainId != conf.ChainId {
+		return nil, fmt.Errorf("invalid chain id %d %d", conf.ChainId, chainId)
+	}
+	if conf.Registry != "" {
+		err = ethereum.VerifyAddress(conf.Registry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e := &Engine{rpc: rpc, chainId: conf.ChainId, feeRate: common.Zero, loops: new(sync.WaitGroup)}
+	e.platform = conf.Platform
+	if e.platform == "" {
+		e.platform = machine.ProcessPlatformQuorum
+	}
+	e.registry = conf.Registry
+	e.confirmations = conf.Confirmations
+	if e.confirmations == 0 {
+		e.confirmations = DefaultConfirmations
+	}
+	e.dynamicFee = conf.DynamicFee
+	if conf.MaxGasPrice > 0 {
+		e.maxGasPrice = gweiToWei(conf.MaxGasPrice)
+	}
+	e.bumpInterval = time.Duration(conf.BumpInterval) * time.Second
+	if e.bumpInterval == 0 {
+		e.bumpInterval = DefaultBumpInterval * time.Second
+	}
+	e.revertRetries = conf.RevertRetries
+	if e.revertRetries == 0 {
+		e.revertRetries = DefaultRevertRetries
+	}
+	if conf.FeeRate != "" {
+		rate, err := decimal.NewFromString(conf.FeeRate)
+		if err != nil || rate.Sign() < 0 {
+			return nil, fmt.Errorf("invalid quorum fee rate %s", conf.FeeRate)
+		}
+		e.feeRate = common.NewIntegerFromString(rate.String())
+	}
 	if conf.PrivateKey != "" {
 		priv, err := crypto.HexToECDSA(conf.PrivateKey)
 		if err != nil {
@@ -54,11 +153,59 @@ func Boot(conf *Configuration) (*Engine, error) {
 		}
 		e.key = hex.EncodeToString(crypto.FromECDSA(priv))
 	}
-	go e.loopGetLogs(conf.Base)
-	go e.loopHandleContracts()
+	e.db = openBadger(conf.Store)
+	e.spawn(func() { e.loopGetLogs(ctx, conf.Base) })
+	e.spawn(func() { e.loopHandleContracts(ctx) })
+	e.spawn(func() { e.loopConfirmTransactions(ctx) })
 	return e, nil
 }
 
+// bootRPC retries the chain RPC until it's available, so an RPC outage
+// delays the boot instead of failing the whole node
+func bootRPC(ctx context.Context, conf *Configuration) (*RPC, int64, error) {
+	for {
+		rpc, err := NewRPC(conf.RPC, conf.Base)
+		if err == nil {
+			var chainId int64
+			chainId, err = rpc.GetChainId()
+			if err == nil {
+				return rpc, chainId, nil
+			}
+		}
+		logger.Printf("bootRPC(%s, %d) => %v", conf.Platform, conf.ChainId, err)
+		if !sleep(ctx, ClockTick) {
+			return nil, 0, err
+		}
+	}
+}
+
+// Close waits all loops to finish after the boot context is done,
+// then closes the engine database
+func (e *Engine) Close() error {
+	e.loops.Wait()
+	return e.db.Close()
+}
+
+func (e *Engine) spawn(loop func()) {
+	e.loops.Add(1)
+	go func() {
+		defer e.loops.Done()
+		loop()
+	}()
+}
+
+func (e *Engine) Platform() string {
+	return e.platform
+}
+
+func (e *Engine) SignType() int {
+	return machine.SignTypeTBLS
+}
+
+func (e *Engine) CombineSignatures(address string, event *encoding.Event, partials [][]byte) ([]byte, error) {
+	return nil, fmt.Errorf("quorum signatures combined by the machine")
+}
+
 func (e *Engine) Hash(b []byte) []byte {
 	return crypto.Keccak256(b)
 }
@@ -67,34 +214,78 @@ func (e *Engine) SignEvent(address string, event *encoding.Event) []byte {
 	return nil
 }
 
-func (e *Engine) VerifyAddress(address string, _ []byte) error {
+// VerifyAddress reads the code and the PID at the confirmed height, so the
+// members get the same contract regardless of the reorgs, and the RPC errors
+// are returned as the engine unavailable for the machine to retry instead of
+// the rejection
+func (e *Engine) VerifyAddress(ctx context.Context, address, pid string, _ []byte) error {
 	err := ethereum.VerifyAddress(address)
 	if err != nil {
 		return err
 	}
+	if e.registry != "" && !strings.EqualFold(address, e.registry) {
+		return fmt.Errorf("address %s is not the registry %s", address, e.registry)
+	}
 
-	// TODO ABI
-	return nil
+	for i := 0; i < VerifyAddressRetries; i++ {
+		var height uint64
+		var code []byte
+		var id string
+		height, err = e.getConfirmedHeight()
+		if err == nil {
+			code, id, err = e.getConfirmedContract(address, height)
+		}
+		if err == nil {
+			return verifyContractCode(address, pid, code, id)
+		}
+		logger.Printf("VerifyAddress(%s) => getConfirmedContract() => %v", address, err)
+		if !sleep(ctx, ClockTick) {
+			break
+		}
+	}
+	return fmt.Errorf("%w: %v", machine.ErrorEngineUnavailable, err)
+}
+
+func (e *Engine) getConfirmedHeight() (uint64, error) {
+	height, err := e.rpc.GetBlockHeight()
+	if err != nil {
+		return 0, err
+	}
+	if height < e.confirmations {
+		return 0, fmt.Errorf("block height too small %d", height)
+	}
+	return height - e.confirmations, nil
+}
+
+func (e *Engine) getConfirmedContract(address string, height uint64) ([]byte, string, error) {
+	code, err := e.rpc.GetCode(address, height)
+	if err != nil || len(code) == 0 {
+		return code, "", err
+	}
+	id, err := e.rpc.GetContractView(address, ContractPIDMethod, height)
+	return code, id, err
 }
 
+// SetupNotifier returns the machine.ErrorEngineUnavailable error if the RPC
+// fails, for the machine to retry
 func (e *Engine) SetupNotifier(address string) error {
 	seed := e.Hash([]byte(e.key + address))
 	key, err := crypto.ToECDSA(seed)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	notifier := hex.EncodeToString(crypto.FromECDSA(key))
 	nonce, err := e.rpc.GetAddressNonce(pub(notifier))
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("%w: %v", machine.ErrorEngineUnavailable, err)
 	} else if nonce > 0 {
 		return fmt.Errorf("notifier used %d", nonce)
 	}
-	old := e.storeReadContractNotifier(address)
-	if old == notifier {
-		return nil
+	old, err := e.storeReadContractNotifier(address)
+	if err != nil || old == notifier {
+		return err
 	} else if old != "" {
-		panic(old)
+		return fmt.Errorf("contract %s notifier %s", address, pub(old))
 	}
 	return e.storeWriteContractNotifier(address, notifier)
 }
@@ -104,8 +295,14 @@ func (e *Engine) VerifyEvent(address string, event *encoding.Event) bool {
 }
 
 func (e *Engine) EstimateCost(events []*encoding.Event) (common.Integer, error) {
-	// TODO should do it
-	return common.Zero, nil
+	if e.feeRate.Sign() == 0 || len(events) == 0 {
+		return common.Zero, nil
+	}
+	var gas uint64
+	for _, evt := range events {
+		gas = gas + estimateGroupEventGas(evt)
+	}
+	return e.feeRate.Mul(int(gas)).Div(FeeRateGasUnit), nil
 }
 
 func (e *Engine) EnsureSendGroupEvents(address string, events []*encoding.Event) error {
@@ -113,97 +310,357 @@ func (e *Engine) EnsureSendGroupEvents(address string, events []*encoding.Event)
 }
 
 func (e *Engine) ReceiveGroupEvents(address string, offset uint64, limit int) ([]*encoding.Event, error) {
-	return e.storeListContractEvents(address, offset, limit)
+	events, err := e.storeListContractEvents(address, offset, limit)
+	if err != nil || len(events) == 0 {
+		return events, err
+	}
+	// the machine may act on the events once returned
+	err = e.storeWriteContractEventsDelivered(address, events[len(events)-1].Nonce+1)
+	return events, err
+}
+
+// RotateGroup records the iterate payload of the contract, which is sent
+// before the events from the nonce
+func (e *Engine) RotateGroup(address string, nonce uint64, payload []byte) error {
+	if len(payload) != 256 {
+		return fmt.Errorf("invalid rotation payload %x", payload)
+	}
+	old, op := e.storeReadContractRotation(address)
+	if old == nonce && bytes.Equal(op, payload) {
+		return nil
+	}
+	return e.storeWriteContractRotation(address, nonce, payload)
 }
 
 func (e *Engine) IsPublisher() bool {
 	return e.key != ""
 }
 
-func (e *Engine) loopGetLogs(base uint64) {
+func (e *Engine) loopGetLogs(ctx context.Context, base uint64) {
 	logger.Verbosef("Engine.loopGetLogs(%d)", base)
 
-	for {
-		offset := e.storeReadContractLogsOffset()
+	for ctx.Err() == nil {
+		offset, err := e.storeReadContractLogsOffset()
+		if err != nil {
+			logger.Printf("loopGetLogs(%d) => storeReadContractLogsOffset() => %v", base, err)
+			sleep(ctx, 1*time.Minute)
+			continue
+		}
 		if offset < base {
 			offset = base
 		}
-		logs, err := e.rpc.GetLogs(EventTopic, offset, offset+10)
+		metrics.EngineBlockOffset.WithLabelValues(e.platform).Set(float64(offset))
+		height, err := e.rpc.GetBlockHeight()
+		if err != nil || offset+LogsBlockRange+e.confirmations > height {
+			sleep(ctx, ClockTick)
+			continue
+		}
+		reorg, err := e.checkReorg(offset, base)
+		if err != nil {
+			logger.Printf("loopGetLogs(%d) => checkReorg(%d) => %v", base, offset, err)
+			sleep(ctx, 1*time.Minute)
+			continue
+		} else if reorg {
+			continue
+		}
+
+		// the logs are from the same chain only if the hash not changed
+		to := offset + LogsBlockRange
+		hash, err := e.rpc.GetBlockHash(to)
+		if err != nil {
+			sleep(ctx, 1*time.Minute)
+			continue
+		}
+		logs, err := e.rpc.GetLogs(EventTopic, offset, to)
 		logger.Verbosef("loopGetLogs(%d) => GetLogs(%d) => %d, %v", base, offset, len(logs), err)
 		if err != nil {
-			time.Sleep(1 * time.Minute)
+			sleep(ctx, 1*time.Minute)
 			continue
 		}
-		for _, log := range logs {
-			evt, err := encoding.DecodeEvent(log.data)
-			logger.Verbosef("loopGetLogs(%s) => DecodeEvent(%x) => %v, %v", log.address, log.data, evt, err)
-			if err != nil {
-				continue
-			}
-			err = e.storeWriteContractEvent(log.address, evt)
-			if err != nil {
-				panic(err)
-			}
+		after, err := e.rpc.GetBlockHash(to)
+		if err != nil || after != hash {
+			sleep(ctx, ClockTick)
+			continue
 		}
-		height, err := e.rpc.GetBlockHeight()
-		if err != nil || offset+10 > height {
-			time.Sleep(ClockTick)
+		err = e.writeContractLogs(logs, to, hash)
+		if err != nil {
+			logger.Printf("loopGetLogs(%d) => writeContractLogs(%d) => %v", base, to, err)
+			sleep(ctx, 1*time.Minute)
+		}
+	}
+}
+
+// writeContractLogs writes the events of the logs, then the checkpoint, so
+// the logs are scanned again if failed, and the events written are kept
+func (e *Engine) writeContractLogs(logs []*Log, to uint64, hash string) error {
+	for _, log := range logs {
+		evt, err := encoding.DecodeEvent(log.data)
+		logger.Verbosef("loopGetLogs(%s) => DecodeEvent(%x) => %v, %v", log.address, log.data, evt, err)
+		if err != nil {
 			continue
 		}
-		err = e.storeWriteContractLogsOffset(offset + 10)
+		err = e.storeWriteContractEvent(log.address, evt, log.block, log.hash)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
+	return e.storeWriteContractLogsCheckpoint(to, hash)
 }
 
-func (e *Engine) loopSendGroupEvents(address string) {
+// checkReorg compares the hash of the scanned offset block, and rolls back
+// to the latest checkpoint still in the chain if they mismatch
+func (e *Engine) checkReorg(offset, base uint64) (bool, error) {
+	old, err := e.storeReadContractLogsCheckpoint(offset)
+	if err != nil || old == "" {
+		return false, err
+	}
+	hash, err := e.rpc.GetBlockHash(offset)
+	if err != nil || hash == old {
+		return false, err
+	}
+	logger.Printf("checkReorg(%d) => hash %s %s", offset, old, hash)
+
+	fork, err := e.findReorgFork(offset, base, e.rpc.GetBlockHash)
+	if err != nil {
+		return false, err
+	}
+	rolled, alarms, err := e.storeRollbackContractEvents(fork)
+	if err != nil {
+		return false, err
+	}
+	logger.Printf("checkReorg(%d) => rollback %d %d %d", offset, fork, rolled, len(alarms))
+	metrics.EngineReorgs.WithLabelValues(e.platform, metrics.ReorgRollback).Add(float64(rolled))
+	for _, a := range alarms {
+		logger.Printf("ALARM checkReorg(%d) => event %s:%d delivered from orphaned block %d %s", offset, a.Address, a.Nonce, a.Block, a.Hash)
+		metrics.EngineReorgs.WithLabelValues(e.platform, metrics.ReorgAlarm).Inc()
+	}
+	return true, nil
+}
+
+// findReorgFork returns the latest checkpoint lower than the offset still in
+// the chain, or the base to rescan if no checkpoint found in the chain
+func (e *Engine) findReorgFork(offset, base uint64, blockHash func(uint64) (string, error)) (uint64, error) {
+	for height := offset; ; {
+		checkpoints, err := e.storeListContractLogsCheckpoints(height, 100)
+		if err != nil || len(checkpoints) == 0 {
+			return base, err
+		}
+		for _, cp := range checkpoints {
+			hash, err := blockHash(cp.height)
+			if err != nil {
+				return 0, err
+			}
+			if hash == cp.hash {
+				return cp.height, nil
+			}
+		}
+		height = checkpoints[len(checkpoints)-1].height
+	}
+}
+
+func (e *Engine) loopSendGroupEvents(ctx context.Context, address, notifier string) {
 	logger.Verbosef("Engine.loopSendGroupEvents(%s)", address)
-	notifier := e.storeReadContractNotifier(address)
+	sent := make(map[uint64]*sentTransaction)
 
-	for e.IsPublisher() {
+	for e.IsPublisher() && ctx.Err() == nil {
 		balance, err := e.rpc.GetAddressBalance(pub(notifier))
 		if err != nil {
-			time.Sleep(5 * time.Second)
+			sleep(ctx, 5*time.Second)
 			continue
 		}
 		if balance.Cmp(decimal.NewFromInt(1)) < 0 {
-			time.Sleep(5 * time.Second)
+			sleep(ctx, 5*time.Second)
 			continue
 		}
+		// the events are sent from the contract nonce, so the reverted
+		// event is retried with the next notifier nonce
 		nonce, err := e.rpc.GetAddressNonce(pub(notifier))
 		if err != nil {
-			time.Sleep(5 * time.Second)
+			sleep(ctx, 5*time.Second)
 			continue
 		}
-		evts, err := e.storeListGroupEvents(address, nonce, 100)
+		offset, err := e.rpc.GetContractNonce(address)
 		if err != nil {
-			panic(err)
+			sleep(ctx, 5*time.Second)
+			continue
 		}
-		for _, evt := range evts {
-			id, raw := e.signGroupEventTransaction(address, evt, notifier)
-			res, err := e.rpc.SendRawTransaction(raw)
-			logger.Verbosef("loopSendGroupEvents(%s) => SendRawTransaction(%s, %s) => %s, %v", address, id, raw, res, err)
+		halted, err := e.rpc.GetContractHalted(address)
+		if err != nil || halted {
+			logger.Verbosef("loopSendGroupEvents(%s) => halted %t %v", address, halted, err)
+			sleep(ctx, 1*time.Minute)
+			continue
+		}
+		// the mined transactions are confirmed before sending the events
+		// again, otherwise the reverted event would be sent before the
+		// confirm loop counted the revert
+		err = e.confirmSentTransactions(address, pub(notifier), nonce)
+		if err != nil {
+			logger.Verbosef("loopSendGroupEvents(%s) => confirmSentTransactions() => %v", address, err)
+			sleep(ctx, 5*time.Second)
+			continue
+		}
+		reverts, err := e.storeReadGroupEventReverts(address, offset)
+		if err != nil {
+			logger.Printf("storeReadGroupEventReverts(%s, %d) => %v", address, offset, err)
+			sleep(ctx, 5*time.Second)
+			continue
+		}
+		if reverts >= e.revertRetries {
+			logger.Verbosef("loopSendGroupEvents(%s) => event %d reverted", address, offset)
+			sleep(ctx, 1*time.Minute)
+			continue
+		}
+		evts, err := e.storeListGroupEvents(address, offset, 100)
+		if err != nil {
+			logger.Printf("storeListGroupEvents(%s, %d) => %v", address, offset, err)
+			sleep(ctx, 5*time.Second)
+			continue
+		}
+		if len(evts) == 0 {
+			sleep(ctx, ClockTick)
+			continue
 		}
-		time.Sleep(ClockTick)
+		evts, rotation, err := e.checkGroupRotation(address, offset, evts)
+		if err != nil {
+			sleep(ctx, 5*time.Second)
+			continue
+		}
+		fee, err := e.suggestGasFee()
+		if err != nil {
+			sleep(ctx, 5*time.Second)
+			continue
+		}
+		if rotation != nil {
+			e.sendNotifierTransaction(address, machine.TransactionKindGroupRotation, offset, nonce, fee, sent, func(fee *gasFee) (*machine.EngineTransaction, string) {
+				return e.signGroupRotationTransaction(address, offset, rotation, notifier, nonce, fee)
+			})
+		}
+		// only the head event executes against the current contract state,
+		// the later ones would fail the estimation before it mined, so they
+		// use the head gas adjusted to the largest event of the batch
+		var head, batch uint64
+		for i, evt := range evts {
+			i, evt, txNonce := i, evt, nonce+uint64(i)
+			e.sendNotifierTransaction(address, machine.TransactionKindGroupEvent, evt.Nonce, txNonce, fee, sent, func(fee *gasFee) (*machine.EngineTransaction, string) {
+				if head == 0 {
+					head = e.estimateGas(pub(notifier), address, buildGroupEventCallData(evts[0]))
+					batch = estimateBatchGas(head, evts)
+				}
+				gas := batch
+				if i == 0 {
+					gas = head
+				}
+				return e.signGroupEventTransaction(address, evt, notifier, txNonce, gas, fee)
+			})
+		}
+		sleep(ctx, ClockTick)
 	}
 }
 
-func (e *Engine) loopHandleContracts() {
+// checkGroupRotation drops the events signed by the new group until the
+// contract switched to it, and returns the iterate payload to send if all
+// events before the rotation nonce sent
+func (e *Engine) checkGroupRotation(address string, offset uint64, evts []*encoding.Event) ([]*encoding.Event, []byte, error) {
+	nonce, payload := e.storeReadContractRotation(address)
+	if payload == nil || evts[len(evts)-1].Nonce < nonce {
+		return evts, nil, nil
+	}
+	group, err := e.rpc.GetContractGroup(address)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(group, payload[:128]) {
+		return evts, nil, nil
+	}
+	if offset >= nonce {
+		return nil, payload, nil
+	}
+	var before []*encoding.Event
+	for _, evt := range evts {
+		if evt.Nonce < nonce {
+			before = append(before, evt)
+		}
+	}
+	return before, nil, nil
+}
+
+// sendNotifierTransaction sends the transaction once, and replaces it with
+// bumped fees if the notifier nonce stuck for the bump interval, or the
+// nonce should carry another event after a revert. The fees are not bumped
+// beyond the max gas price, then the same transaction is sent again, and
+// the replacement waits until the stuck one mined
+func (e *Engine) sendNotifierTransaction(address, kind string, event, nonce uint64, fee *gasFee, sent map[uint64]*sentTransaction, sign func(fee *gasFee) (*machine.EngineTransaction, string)) {
+	old := sent[nonce]
+	if old != nil && old.kind == kind && old.event == event && old.sentAt.Add(e.bumpInterval).After(time.Now()) {
+		return
+	}
+	if old != nil {
+		bumped, ok := e.bumpGasFee(fee, old.fee)
+		if !ok && (old.kind != kind || old.event != event) {
+			logger.Verbosef("loopSendGroupEvents(%s) => nonce %d stuck at max gas price %s", address, nonce, old.fee.price)
+			old.sentAt = time.Now()
+			return
+		}
+		fee = bumped
+	}
+	tx, raw := sign(fee)
+	res, err := e.rpc.SendRawTransaction(raw)
+	logger.Verbosef("loopSendGroupEvents(%s) => SendRawTransaction(%s, %s) => %s, %v", address, tx.Hash, raw, res, err)
+	// record the failed ones too, a pending transaction of the same nonce
+	// may reject the replacement until the fee bumped
+	sent[nonce] = &sentTransaction{id: tx.Hash, kind: kind, event: event, fee: fee, sentAt: time.Now()}
+	if err != nil {
+		return
+	}
+	err = e.storeWriteTransaction(tx)
+	if err != nil {
+		logger.Printf("storeWriteTransaction(%s) => %v", tx.Hash, err)
+	}
+}
+
+// confirmSentTransactions confirms the pending transactions of the notifier
+// nonces used already, so the reverts are counted before the events sent
+func (e *Engine) confirmSentTransactions(address, sender string, nonce uint64) error {
+	txs, err := e.storeListTransactions(address, 100)
+	if err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		if tx.Sender != sender || tx.Nonce >= nonce || tx.Status != machine.TransactionStatusPending {
+			continue
+		}
+		err = e.confirmTransaction(tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Engine) loopHandleContracts(ctx context.Context) {
 	contracts := make(map[string]bool)
 
-	for {
-		time.Sleep(ClockTick)
+	for sleep(ctx, ClockTick) {
 		all, err := e.storeListContractAddresses()
 		if err != nil {
-			panic(err)
+			logger.Printf("loopHandleContracts() => storeListContractAddresses() => %v", err)
+			sleep(ctx, 1*time.Minute)
+			continue
 		}
+		notifiers := make(map[string]string)
 		for _, c := range all {
+			notifier, err := e.storeReadContractNotifier(c)
+			if err != nil {
+				logger.Printf("loopHandleContracts(%s) => storeReadContractNotifier() => %v", c, err)
+				continue
+			}
+			notifiers[c] = notifier
 			if contracts[c] {
 				continue
 			}
 			contracts[c] = true
-			go e.loopSendGroupEvents(c)
+			address := c
+			e.spawn(func() { e.loopSendGroupEvents(ctx, address, notifier) })
 		}
 		if !e.IsPublisher() {
 			continue
@@ -211,11 +668,14 @@ func (e *Engine) loopHandleContracts() {
 
 		nonce, err := e.rpc.GetAddressNonce(pub(e.key))
 		if err != nil {
-			time.Sleep(1 * time.Minute)
+			sleep(ctx, 1*time.Minute)
 			continue
 		}
 		for _, c := range all {
-			notifier := e.storeReadContractNotifier(c)
+			notifier, ok := notifiers[c]
+			if !ok {
+				continue
+			}
 			balance, err := e.rpc.GetAddressBalance(pub(notifier))
 			if err != nil {
 				break
@@ -223,14 +683,35 @@ func (e *Engine) loopHandleContracts() {
 			if balance.Cmp(decimal.NewFromInt(10)) > 0 {
 				continue
 			}
-			id, raw := e.signContractNotifierDepositTransaction(pub(notifier), e.key, decimal.NewFromInt(100), nonce)
+			fee, err := e.suggestGasFee()
+			if err != nil {
+				break
+			}
+			tx, raw := e.signContractNotifierDepositTransaction(c, pub(notifier), e.key, decimal.NewFromInt(100), nonce, fee)
 			res, err := e.rpc.SendRawTransaction(raw)
-			logger.Verbosef("loopHandleContracts => SendRawTransaction(%s, %s) => %s, %v", id, raw, res, err)
+			logger.Verbosef("loopHandleContracts => SendRawTransaction(%s, %s) => %s, %v", tx.Hash, raw, res, err)
+			if err == nil {
+				err = e.storeWriteTransaction(tx)
+			}
+			if err != nil {
+				logger.Printf("loopHandleContracts(%s) => %v", c, err)
+			}
 			nonce = nonce + 1
 		}
 	}
 }
 
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func pub(priv string) string {
 	key, _ := crypto.HexToECDSA(priv)
 	return crypto.PubkeyToAddress(key.PublicKey).Hex()
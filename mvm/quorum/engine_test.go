@@ -0,0 +1,312 @@
+package quorum
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+const testContract = "0x2A4630550AD909B90aAcD82b5f65E33afFA04323"
+
+func newTestEngine(t *testing.T) *Engine {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	require.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+	return &Engine{db: db, platform: "quorum", confirmations: DefaultConfirmations}
+}
+
+func testEvent(nonce uint64) *encoding.Event {
+	return &encoding.Event{
+		Process:   "ee9e4bd6-3c1b-3c2d-a3a6-5a6b4c6a5c55",
+		Asset:     "c94ac88f-4671-3976-b60a-09064f1811e8",
+		Members:   []string{uuid.Must(uuid.NewV4()).String()},
+		Threshold: 1,
+		Amount:    common.NewIntegerFromString("1"),
+		Timestamp: nonce + 1,
+		Nonce:     nonce,
+	}
+}
+
+func TestFindReorgFork(t *testing.T) {
+	checkpoints := []uint64{10, 20, 30, 40}
+	for h := uint64(1001); h <= 1150; h++ {
+		checkpoints = append(checkpoints, h)
+	}
+
+	// the blocks higher than the stable height are orphaned
+	for _, c := range []struct {
+		name   string
+		offset uint64
+		stable uint64
+		failed bool
+		fork   uint64
+	}{
+		{"latest", 40, 30, false, 30},
+		{"deep", 40, 15, false, 10},
+		{"base", 40, 0, false, 5},
+		{"paged", 1150, 1001, false, 1001},
+		{"rpc", 40, 30, true, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			require := require.New(t)
+			e := newTestEngine(t)
+			for _, h := range checkpoints {
+				require.Nil(e.storeWriteContractLogsCheckpoint(h, fmt.Sprintf("h%d", h)))
+			}
+			fork, err := e.findReorgFork(c.offset, 5, func(h uint64) (string, error) {
+				if c.failed {
+					return "", fmt.Errorf("rpc down")
+				}
+				if h > c.stable {
+					return fmt.Sprintf("o%d", h), nil
+				}
+				return fmt.Sprintf("h%d", h), nil
+			})
+			if c.failed {
+				require.NotNil(err)
+				return
+			}
+			require.Nil(err)
+			require.Equal(c.fork, fork)
+		})
+	}
+}
+
+func TestRollbackContractEvents(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		delivered uint64
+		fork      uint64
+		rolled    int
+		alarms    []uint64
+		kept      []uint64
+	}{
+		{"none", 0, 50, 0, nil, []uint64{0, 1, 2, 3}},
+		{"undelivered", 0, 15, 3, nil, []uint64{0}},
+		{"delivered", 2, 15, 2, []uint64{1}, []uint64{0, 1}},
+		{"all", 4, 5, 0, []uint64{0, 1, 2, 3}, []uint64{0, 1, 2, 3}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			require := require.New(t)
+			e := newTestEngine(t)
+			for i := uint64(0); i < 4; i++ {
+				block := 10 + i*10
+				err := e.storeWriteContractEvent(testContract, testEvent(i), block, fmt.Sprintf("h%d", block))
+				require.Nil(err)
+				require.Nil(e.storeWriteContractLogsCheckpoint(block, fmt.Sprintf("h%d", block)))
+			}
+			if c.delivered > 0 {
+				require.Nil(e.storeWriteContractEventsDelivered(testContract, c.delivered))
+			}
+
+			rolled, alarms, err := e.storeRollbackContractEvents(c.fork)
+			require.Nil(err)
+			require.Equal(c.rolled, rolled)
+			var nonces []uint64
+			for _, a := range alarms {
+				require.Equal(testContract, a.Address)
+				require.Equal(fmt.Sprintf("h%d", a.Block), a.Hash)
+				require.Greater(a.Block, c.fork)
+				nonces = append(nonces, a.Nonce)
+			}
+			require.Equal(c.alarms, nonces)
+
+			events, err := e.storeListContractEvents(testContract, 0, 10)
+			require.Nil(err)
+			nonces = nil
+			for _, evt := range events {
+				nonces = append(nonces, evt.Nonce)
+			}
+			require.Equal(c.kept, nonces)
+			offset, err := e.storeReadContractLogsOffset()
+			require.Nil(err)
+			require.Equal(c.fork, offset)
+			cps, err := e.storeListContractLogsCheckpoints(100, 10)
+			require.Nil(err)
+			for _, cp := range cps {
+				require.LessOrEqual(cp.height, c.fork)
+			}
+		})
+	}
+}
+
+func TestBootRPCRetries(t *testing.T) {
+	require := require.New(t)
+
+	_, err := Boot(context.Background(), &Configuration{RPC: "http://127.0.0.1:1", Base: 1})
+	require.NotNil(err)
+	require.Contains(err.Error(), "block base too small")
+
+	// the RPC is retried until the boot context is done
+	ctx, cancel := context.WithTimeout(context.Background(), ClockTick)
+	defer cancel()
+	start := time.Now()
+	_, err = Boot(ctx, &Configuration{RPC: "http://127.0.0.1:1", Base: quorumMinimumHeight})
+	require.NotNil(err)
+	require.GreaterOrEqual(time.Since(start), ClockTick)
+}
+
+// testChain serves the eth_call results by the contract and the method, at
+// the confirmed height only
+type testChain struct {
+	height uint64
+	codes  map[string][]byte
+	calls  map[string]string
+}
+
+func (c *testChain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	confirmed := fmt.Sprintf("\"0x%x\"", c.height-DefaultConfirmations)
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": 1}
+	switch req.Method {
+	case "eth_blockNumber":
+		resp["result"] = fmt.Sprintf("0x%x", c.height)
+	case "eth_getCode":
+		var address string
+		json.Unmarshal(req.Params[0], &address)
+		if string(req.Params[1]) != confirmed {
+			resp["result"] = "0x"
+		} else {
+			resp["result"] = "0x" + hex.EncodeToString(c.codes[strings.ToLower(address)])
+		}
+	case "eth_call":
+		var call struct {
+			To   string `json:"to"`
+			Data string `json:"data"`
+		}
+		json.Unmarshal(req.Params[0], &call)
+		res, found := c.calls[strings.ToLower(call.To)+call.Data]
+		block := string(req.Params[1])
+		if !found || (block != confirmed && block != `"latest"`) {
+			resp["error"] = map[string]interface{}{"code": -32000, "message": "execution reverted"}
+		} else {
+			resp["result"] = res
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func testProcessCode() []byte {
+	method, _ := hex.DecodeString(EventMethod[2:])
+	topic, _ := hex.DecodeString(EventTopic[2:])
+	code := append([]byte{0x60, 0x80, opPush4}, method...)
+	return append(append(code, opPush32), topic...)
+}
+
+func testPIDResult(pid string) string {
+	return "0x" + strings.Repeat("0", 32) + strings.ReplaceAll(pid, "-", "")
+}
+
+func TestVerifyAddress(t *testing.T) {
+	require := require.New(t)
+	pid := "27d0c319-a4e3-38b4-93ff-cb45da8adbe1"
+	process := "0x2A4630550Ad909B90aAcD82b5f65E33afFA04323"
+	other := "0x8A1B4e0D5D7c2f0d9E8B5d3e0A1D2C3b4a5f6e7d"
+	noPID := "0x1C2d3e4f5A6b7c8d9e0F1A2B3c4d5e6F7A8b9c0D"
+
+	chain := &testChain{height: 1000, codes: map[string][]byte{}, calls: map[string]string{}}
+	for _, addr := range []string{process, other, noPID} {
+		chain.codes[strings.ToLower(addr)] = testProcessCode()
+	}
+	chain.calls[strings.ToLower(process)+ContractPIDMethod] = testPIDResult(pid)
+	chain.calls[strings.ToLower(other)+ContractPIDMethod] = testPIDResult("ee9e4bd6-3c1b-3c2d-a3a6-5a6b4c6a5c55")
+	server := httptest.NewServer(chain)
+	defer server.Close()
+
+	e := newTestEngine(t)
+	e.rpc = &RPC{client: server.Client(), host: server.URL}
+	ctx := context.Background()
+	require.Nil(e.VerifyAddress(ctx, process, pid, nil))
+
+	err := e.VerifyAddress(ctx, other, pid, nil)
+	require.NotNil(err)
+	require.False(errors.Is(err, machine.ErrorEngineUnavailable))
+	err = e.VerifyAddress(ctx, noPID, pid, nil)
+	require.NotNil(err)
+	require.Contains(err.Error(), "has no PID")
+	err = e.VerifyAddress(ctx, "0x0000000000000000000000000000000000000001", pid, nil)
+	require.NotNil(err)
+	require.Contains(err.Error(), "is not a contract")
+
+	// the RPC errors are retried by the machine, not the rejection
+	server.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = e.VerifyAddress(ctx, process, pid, nil)
+	require.True(errors.Is(err, machine.ErrorEngineUnavailable))
+}
+
+func TestVerifyEvolveAddress(t *testing.T) {
+	require := require.New(t)
+	registry := "0x2A4630550Ad909B90aAcD82b5f65E33afFA04323"
+	next := "0x8A1B4e0D5D7c2f0d9E8B5d3e0A1D2C3b4a5f6e7d"
+	forged := "0x1C2d3e4f5A6b7c8d9e0F1A2B3c4d5e6F7A8b9c0D"
+	nonce := func(n uint64) string { return fmt.Sprintf("0x%064x", n) }
+
+	chain := &testChain{height: 1000, codes: map[string][]byte{}, calls: map[string]string{}}
+	deploy := func(address, pid string, inbound, outbound uint64) {
+		address = strings.ToLower(address)
+		chain.codes[address] = testProcessCode()
+		chain.calls[address+ContractPIDMethod] = testPIDResult(pid)
+		chain.calls[address+RegistryNonceMethod] = nonce(inbound)
+		chain.calls[address+RegistryOutboundMethod] = nonce(outbound)
+	}
+	server := httptest.NewServer(chain)
+	defer server.Close()
+
+	e := newTestEngine(t)
+	e.rpc = &RPC{client: server.Client(), host: server.URL}
+	ctx := context.Background()
+
+	// the registry evolve requires another PID and the same nonces
+	deploy(registry, "27d0c319-a4e3-38b4-93ff-cb45da8adbe1", 5, 3)
+	deploy(next, "ee9e4bd6-3c1b-3c2d-a3a6-5a6b4c6a5c55", 5, 3)
+	require.Nil(e.VerifyEvolveAddress(ctx, registry, next))
+	require.NotNil(e.VerifyEvolveAddress(ctx, registry, registry))
+	err := e.VerifyEvolveAddress(ctx, registry, forged)
+	require.NotNil(err)
+	require.Contains(err.Error(), "is not a contract")
+
+	deploy(forged, "27d0c319-a4e3-38b4-93ff-cb45da8adbe1", 5, 3)
+	err = e.VerifyEvolveAddress(ctx, registry, forged)
+	require.NotNil(err)
+	require.Contains(err.Error(), "has the same process")
+	deploy(forged, "c94ac88f-4671-3976-b60a-09064f1811e8", 4, 3)
+	err = e.VerifyEvolveAddress(ctx, registry, forged)
+	require.NotNil(err)
+	require.Contains(err.Error(), "nonce")
+	deploy(forged, "c94ac88f-4671-3976-b60a-09064f1811e8", 5, 2)
+	err = e.VerifyEvolveAddress(ctx, registry, forged)
+	require.NotNil(err)
+	require.Contains(err.Error(), "nonce")
+	delete(chain.calls, strings.ToLower(forged)+RegistryOutboundMethod)
+	err = e.VerifyEvolveAddress(ctx, registry, forged)
+	require.NotNil(err)
+	require.False(errors.Is(err, machine.ErrorEngineUnavailable))
+
+	// the next registry is not the configured one to add processes
+	e.registry = registry
+	require.Nil(e.VerifyEvolveAddress(ctx, registry, next))
+}
@@ -0,0 +1,137 @@
+package quorum
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+const (
+	// the fee history of the latest blocks to suggest the priority fee
+	feeHistoryBlocks     = 10
+	feeHistoryPercentile = 50
+	// the fees should be increased by at least 12.5% to replace a transaction
+	feeBumpNumerator   = 1125
+	feeBumpDenominator = 1000
+	gasEstimateMargin  = 120
+	// the later events of a batch can't be estimated before the head mined,
+	// and their work may cost more than the head
+	gasBatchMargin = 150
+)
+
+// gasFee is the gas price of a legacy transaction, or the fee cap and tip
+// of a dynamic fee transaction
+type gasFee struct {
+	price *big.Int
+	tip   *big.Int
+}
+
+// sentTransaction tracks the latest transaction sent for a nonce, to replace
+// it with bumped fees if it's stuck
+type sentTransaction struct {
+	id     string
+	kind   string
+	event  uint64
+	fee    *gasFee
+	sentAt time.Time
+}
+
+func (e *Engine) suggestGasFee() (*gasFee, error) {
+	if !e.dynamicFee {
+		price, err := e.rpc.GasPrice()
+		if err != nil {
+			return nil, err
+		}
+		return e.capGasFee(&gasFee{price: price}), nil
+	}
+
+	base, tip, err := e.rpc.FeeHistory(feeHistoryBlocks, feeHistoryPercentile)
+	if err != nil {
+		return nil, err
+	}
+	// the fee cap survives six full blocks of base fee increases
+	price := new(big.Int).Add(new(big.Int).Mul(base, big.NewInt(2)), tip)
+	return e.capGasFee(&gasFee{price: price, tip: tip}), nil
+}
+
+// bumpGasFee returns the suggested fee, or the old fee increased enough
+// to replace the stuck transaction if the suggested one is lower, and false
+// if the bumped fee exceeds the max gas price, because the capped one would
+// be rejected as underpriced
+func (e *Engine) bumpGasFee(fee, old *gasFee) (*gasFee, bool) {
+	bumped := &gasFee{price: bumpFee(old.price)}
+	if old.tip != nil {
+		bumped.tip = bumpFee(old.tip)
+	}
+	if e.maxGasPrice != nil && bumped.price.Cmp(e.maxGasPrice) > 0 {
+		return old, false
+	}
+	if fee.price.Cmp(bumped.price) > 0 {
+		bumped.price = fee.price
+	}
+	if fee.tip != nil && (bumped.tip == nil || fee.tip.Cmp(bumped.tip) > 0) {
+		bumped.tip = fee.tip
+	}
+	return e.capGasFee(bumped), true
+}
+
+func (e *Engine) capGasFee(fee *gasFee) *gasFee {
+	if e.maxGasPrice == nil {
+		return fee
+	}
+	if fee.price.Cmp(e.maxGasPrice) > 0 {
+		logger.Printf("capGasFee(%s) => %s", fee.price, e.maxGasPrice)
+		fee.price = new(big.Int).Set(e.maxGasPrice)
+	}
+	if fee.tip != nil && fee.tip.Cmp(fee.price) > 0 {
+		fee.tip = new(big.Int).Set(fee.price)
+	}
+	return fee
+}
+
+// estimateGas estimates the gas limit of the transaction from the chain,
+// and falls back to the constant limit if the estimation fails
+func (e *Engine) estimateGas(from, to string, data []byte) uint64 {
+	gas, err := e.rpc.EstimateGas(from, to, data)
+	if err != nil {
+		logger.Verbosef("EstimateGas(%s, %s) => %v", from, to, err)
+		return GasLimit
+	}
+	gas = gas * gasEstimateMargin / 100
+	if gas > GasLimit {
+		return GasLimit
+	}
+	return gas
+}
+
+func bumpFee(fee *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(fee, big.NewInt(feeBumpNumerator))
+	bumped = bumped.Div(bumped, big.NewInt(feeBumpDenominator))
+	return bumped.Add(bumped, big.NewInt(1))
+}
+
+func gweiToWei(gwei uint64) *big.Int {
+	return new(big.Int).Mul(new(big.Int).SetUint64(gwei), big.NewInt(params.GWei))
+}
+
+// estimateBatchGas returns the gas limit of the later events of the batch,
+// the head gas estimated from the chain is increased by the data gas of the
+// largest event more than the head, then the batch margin
+func estimateBatchGas(head uint64, evts []*encoding.Event) uint64 {
+	base := estimateGroupEventGas(evts[0])
+	max := base
+	for _, evt := range evts[1:] {
+		gas := estimateGroupEventGas(evt)
+		if gas > max {
+			max = gas
+		}
+	}
+	gas := (head + max - base) * gasBatchMargin / 100
+	if gas > GasLimit {
+		return GasLimit
+	}
+	return gas
+}
@@ -0,0 +1,84 @@
+package quorum
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBumpGasFee(t *testing.T) {
+	fee := func(price, tip int64) *gasFee {
+		f := &gasFee{price: big.NewInt(price)}
+		if tip > 0 {
+			f.tip = big.NewInt(tip)
+		}
+		return f
+	}
+
+	for _, c := range []struct {
+		name   string
+		max    int64
+		fee    *gasFee
+		old    *gasFee
+		bumped *gasFee
+		ok     bool
+	}{
+		{"legacy", 0, fee(100, 0), fee(100, 0), fee(113, 0), true},
+		{"suggested", 0, fee(200, 0), fee(100, 0), fee(200, 0), true},
+		{"dynamic", 0, fee(100, 10), fee(100, 10), fee(113, 12), true},
+		{"tip", 0, fee(100, 20), fee(100, 10), fee(113, 20), true},
+		{"capped", 120, fee(200, 0), fee(100, 0), fee(120, 0), true},
+		{"capped tip", 120, fee(200, 150), fee(100, 10), fee(120, 120), true},
+		{"reached", 120, fee(200, 0), fee(110, 0), fee(110, 0), false},
+		{"max", 120, fee(120, 10), fee(120, 10), fee(120, 10), false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			require := require.New(t)
+			e := &Engine{}
+			if c.max > 0 {
+				e.maxGasPrice = big.NewInt(c.max)
+			}
+			bumped, ok := e.bumpGasFee(c.fee, c.old)
+			require.Equal(c.ok, ok)
+			require.Equal(c.bumped.price.String(), bumped.price.String())
+			if c.bumped.tip == nil {
+				require.Nil(bumped.tip)
+			} else {
+				require.Equal(c.bumped.tip.String(), bumped.tip.String())
+			}
+			if ok && c.max > 0 {
+				require.LessOrEqual(bumped.price.Int64(), c.max)
+			}
+		})
+	}
+}
+
+func TestBumpFee(t *testing.T) {
+	require := require.New(t)
+	old := gweiToWei(10)
+	bumped := bumpFee(old)
+	min := new(big.Int).Div(new(big.Int).Mul(old, big.NewInt(feeBumpNumerator)), big.NewInt(feeBumpDenominator))
+	require.Equal(1, bumped.Cmp(min))
+	require.Equal("11250000001", bumped.String())
+}
+
+func TestEstimateBatchGas(t *testing.T) {
+	require := require.New(t)
+
+	head := testEvent(0)
+	small := testEvent(0)
+	small.Members = head.Members
+	large := testEvent(0)
+	large.Members = head.Members
+	large.Extra = make([]byte, 1024)
+	for i := range large.Extra {
+		large.Extra[i] = 0xff
+	}
+	extra := estimateGroupEventGas(large) - estimateGroupEventGas(head)
+
+	require.Equal(uint64(150000), estimateBatchGas(100000, []*encoding.Event{head, small}))
+	require.Equal((100000+extra)*gasBatchMargin/100, estimateBatchGas(100000, []*encoding.Event{head, small, large}))
+	require.Equal(uint64(GasLimit), estimateBatchGas(GasLimit, []*encoding.Event{head, large}))
+}
@@ -0,0 +1,254 @@
+package quorum
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/MixinNetwork/trusted-group/mvm/metrics"
+	"github.com/dgraph-io/badger/v3"
+)
+
+const (
+	prefixQuorumTransaction        = "QUORUM:TRANSACTION:HASH:"
+	prefixQuorumTransactionPending = "QUORUM:TRANSACTION:PENDING:"
+	prefixQuorumTransactionAddress = "QUORUM:TRANSACTION:ADDRESS:"
+	// the group rotation transaction at the nonce is counted with the event,
+	// because the event can't be sent until the rotation succeeds
+	prefixQuorumGroupEventReverts = "QUORUM:GROUP:EVENT:REVERTS:"
+
+	// the transactions reverted for the event sent with a wrong contract nonce
+	// are replaced by the next events, so they are not counted
+	revertReasonInvalidNonce = "invalid nonce"
+)
+
+func (e *Engine) ListTransactions(address string, limit int) ([]*machine.EngineTransaction, error) {
+	return e.storeListTransactions(address, limit)
+}
+
+func (e *Engine) loopConfirmTransactions(ctx context.Context) {
+	for sleep(ctx, ClockTick) {
+		txs, err := e.storeListPendingTransactions(100)
+		if err != nil {
+			logger.Printf("storeListPendingTransactions() => %v", err)
+			continue
+		}
+		for _, tx := range txs {
+			err = e.confirmTransaction(tx)
+			if err != nil {
+				logger.Verbosef("confirmTransaction(%s) => %v", tx.Hash, err)
+				break
+			}
+		}
+	}
+}
+
+func (e *Engine) confirmTransaction(tx *machine.EngineTransaction) error {
+	receipt, err := e.rpc.GetTransactionReceipt(tx.Hash)
+	if err != nil {
+		return err
+	}
+	if receipt == nil {
+		nonce, err := e.rpc.GetAddressNonce(tx.Sender)
+		if err != nil || nonce <= tx.Nonce {
+			return err
+		}
+		// the nonce may be used just after the receipt checked
+		receipt, err = e.rpc.GetTransactionReceipt(tx.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	if receipt == nil {
+		tx.Status = machine.TransactionStatusReplaced
+	} else if receipt.success {
+		tx.Status = machine.TransactionStatusSuccess
+		tx.Block, tx.GasUsed = receipt.block, receipt.gasUsed
+	} else {
+		tx.Status = machine.TransactionStatusReverted
+		tx.Block, tx.GasUsed = receipt.block, receipt.gasUsed
+		tx.Reason, err = e.rpc.CallRevertReason(tx.Sender, tx.To, tx.Payload, receipt.block)
+		if err != nil {
+			return err
+		}
+		if tx.Reason == "" && tx.GasUsed >= tx.Gas {
+			tx.Reason = "out of gas"
+		}
+	}
+	tx.UpdatedAt = time.Now()
+
+	reverts, updated, err := e.storeUpdateTransaction(tx)
+	if err != nil || !updated {
+		return err
+	}
+	metrics.EngineTransactions.WithLabelValues(e.platform, tx.Status).Inc()
+	if tx.Status != machine.TransactionStatusReverted {
+		return nil
+	}
+	logger.Printf("confirmTransaction(%s) => %s %d reverted %d times: %s", tx.Hash, tx.Address, tx.Event, reverts, tx.Reason)
+	if countTransactionReverts(tx.Kind) && reverts >= e.revertRetries {
+		logger.Printf("ALARM confirmTransaction(%s) => %s %d reverted %d times, stop retrying", tx.Hash, tx.Address, tx.Event, reverts)
+	}
+	return nil
+}
+
+func (e *Engine) storeWriteTransaction(tx *machine.EngineTransaction) error {
+	return e.db.Update(func(txn *badger.Txn) error {
+		key := []byte(prefixQuorumTransaction + tx.Hash)
+		_, err := txn.Get(key)
+		if err == nil {
+			return nil
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		err = txn.Set(key, encoding.JSONMarshalPanic(tx))
+		if err != nil {
+			return err
+		}
+		err = txn.Set([]byte(prefixQuorumTransactionPending+tx.Hash), []byte{})
+		if err != nil {
+			return err
+		}
+		ak := []byte(prefixQuorumTransactionAddress + tx.Address)
+		ak = append(ak, uint64Bytes(uint64(tx.SentAt.UnixNano()))...)
+		return txn.Set(append(ak, tx.Hash...), []byte{})
+	})
+}
+
+// storeUpdateTransaction writes the confirmed transaction status, and
+// returns the reverted times of the group event. The transaction confirmed
+// already is skipped and false returned, so the revert is counted once even
+// if both the send and confirm loops confirmed it
+func (e *Engine) storeUpdateTransaction(tx *machine.EngineTransaction) (uint64, bool, error) {
+	var reverts uint64
+	var updated bool
+	err := e.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(prefixQuorumTransactionPending + tx.Hash))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		updated = true
+		err = txn.Set([]byte(prefixQuorumTransaction+tx.Hash), encoding.JSONMarshalPanic(tx))
+		if err != nil {
+			return err
+		}
+		err = txn.Delete([]byte(prefixQuorumTransactionPending + tx.Hash))
+		if err != nil {
+			return err
+		}
+		if tx.Status != machine.TransactionStatusReverted || !countTransactionReverts(tx.Kind) {
+			return nil
+		}
+		if strings.Contains(tx.Reason, revertReasonInvalidNonce) {
+			return nil
+		}
+		key := []byte(prefixQuorumGroupEventReverts + tx.Address)
+		key = append(key, uint64Bytes(tx.Event)...)
+		reverts, err = readUint64(txn, key)
+		if err != nil {
+			return err
+		}
+		reverts = reverts + 1
+		return txn.Set(key, uint64Bytes(reverts))
+	})
+	return reverts, updated, err
+}
+
+func (e *Engine) storeReadGroupEventReverts(address string, nonce uint64) (uint64, error) {
+	txn := e.db.NewTransaction(false)
+	defer txn.Discard()
+
+	key := []byte(prefixQuorumGroupEventReverts + address)
+	return readUint64(txn, append(key, uint64Bytes(nonce)...))
+}
+
+func (e *Engine) storeListPendingTransactions(limit int) ([]*machine.EngineTransaction, error) {
+	txn := e.db.NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(prefixQuorumTransactionPending)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var txs []*machine.EngineTransaction
+	for it.Seek(opts.Prefix); it.Valid(); it.Next() {
+		hash := string(it.Item().Key()[len(opts.Prefix):])
+		tx, err := readTransaction(txn, hash)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+		if len(txs) >= limit {
+			break
+		}
+	}
+	return txs, nil
+}
+
+func (e *Engine) storeListTransactions(address string, limit int) ([]*machine.EngineTransaction, error) {
+	txn := e.db.NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = true
+	opts.Prefix = []byte(prefixQuorumTransactionAddress + address)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var txs []*machine.EngineTransaction
+	for it.Seek(append(opts.Prefix, uint64Bytes(^uint64(0))...)); it.Valid(); it.Next() {
+		hash := string(it.Item().Key()[len(opts.Prefix)+8:])
+		tx, err := readTransaction(txn, hash)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+		if len(txs) >= limit {
+			break
+		}
+	}
+	return txs, nil
+}
+
+// only the reverts of the group events and rotations block the contract
+func countTransactionReverts(kind string) bool {
+	return kind == machine.TransactionKindGroupEvent || kind == machine.TransactionKindGroupRotation
+}
+
+func readTransaction(txn *badger.Txn, hash string) (*machine.EngineTransaction, error) {
+	item, err := txn.Get([]byte(prefixQuorumTransaction + hash))
+	if err != nil {
+		return nil, err
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	var tx machine.EngineTransaction
+	err = encoding.JSONUnmarshal(val, &tx)
+	return &tx, err
+}
+
+func readUint64(txn *badger.Txn, key []byte) (uint64, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
@@ -0,0 +1,100 @@
+package quorum
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func testTransaction(kind string, event, nonce uint64) *machine.EngineTransaction {
+	id := fmt.Sprintf("0x%s%d%d", kind, event, nonce)
+	return newEngineTransaction(id, kind, testContract, "0xnotifier", testContract, nonce, nil, GasLimit)
+}
+
+func TestTransactionJournal(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		kind    string
+		status  string
+		reason  string
+		reverts uint64
+	}{
+		{"success", machine.TransactionKindGroupEvent, machine.TransactionStatusSuccess, "", 0},
+		{"replaced", machine.TransactionKindGroupEvent, machine.TransactionStatusReplaced, "", 0},
+		{"reverted", machine.TransactionKindGroupEvent, machine.TransactionStatusReverted, "out of gas", 1},
+		{"rotation", machine.TransactionKindGroupRotation, machine.TransactionStatusReverted, "", 1},
+		{"nonce", machine.TransactionKindGroupEvent, machine.TransactionStatusReverted, "invalid nonce", 0},
+		{"deposit", machine.TransactionKindNotifierDeposit, machine.TransactionStatusReverted, "", 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			require := require.New(t)
+			e := newTestEngine(t)
+
+			tx := testTransaction(c.kind, 7, 3)
+			tx.Event = 7
+			require.Nil(e.storeWriteTransaction(tx))
+			require.Nil(e.storeWriteTransaction(tx))
+			txs, err := e.storeListPendingTransactions(10)
+			require.Nil(err)
+			require.Len(txs, 1)
+			require.Equal(machine.TransactionStatusPending, txs[0].Status)
+
+			tx.Status, tx.Reason, tx.UpdatedAt = c.status, c.reason, time.Now()
+			reverts, updated, err := e.storeUpdateTransaction(tx)
+			require.Nil(err)
+			require.True(updated)
+			require.Equal(c.reverts, reverts)
+
+			// the transaction confirmed by both loops counts once
+			reverts, updated, err = e.storeUpdateTransaction(tx)
+			require.Nil(err)
+			require.False(updated)
+			require.Equal(uint64(0), reverts)
+			reverts, err = e.storeReadGroupEventReverts(testContract, 7)
+			require.Nil(err)
+			require.Equal(c.reverts, reverts)
+
+			txs, err = e.storeListPendingTransactions(10)
+			require.Nil(err)
+			require.Len(txs, 0)
+			txs, err = e.storeListTransactions(testContract, 10)
+			require.Nil(err)
+			require.Len(txs, 1)
+			require.Equal(c.status, txs[0].Status)
+			require.Equal(c.reason, txs[0].Reason)
+		})
+	}
+}
+
+func TestTransactionJournalReverts(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t)
+
+	for i := uint64(0); i < DefaultRevertRetries; i++ {
+		tx := testTransaction(machine.TransactionKindGroupEvent, 5, 10+i)
+		tx.Event = 5
+		tx.SentAt = tx.SentAt.Add(time.Duration(i) * time.Second)
+		require.Nil(e.storeWriteTransaction(tx))
+		tx.Status = machine.TransactionStatusReverted
+		reverts, updated, err := e.storeUpdateTransaction(tx)
+		require.Nil(err)
+		require.True(updated)
+		require.Equal(i+1, reverts)
+	}
+	reverts, err := e.storeReadGroupEventReverts(testContract, 5)
+	require.Nil(err)
+	require.Equal(uint64(DefaultRevertRetries), reverts)
+	reverts, err = e.storeReadGroupEventReverts(testContract, 6)
+	require.Nil(err)
+	require.Equal(uint64(0), reverts)
+
+	txs, err := e.storeListTransactions(testContract, 10)
+	require.Nil(err)
+	require.Len(txs, DefaultRevertRetries)
+	for i, tx := range txs {
+		require.Equal(uint64(10+DefaultRevertRetries-1-i), tx.Nonce)
+	}
+}
@@ -8,11 +8,13 @@ import (
 	"io"
 	"math/big"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/MixinNetwork/mixin/logger"
 	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/shopspring/decimal"
 )
@@ -64,6 +66,50 @@ func (chain *RPC) GetBlockHeight() (uint64, error) {
 	return ethereumNumberToUint64(resp.Result)
 }
 
+func (chain *RPC) GetChainId() (int64, error) {
+	body, err := chain.call("eth_chainId", []interface{}{})
+	if err != nil {
+		return 0, err
+	}
+	var resp struct {
+		Result string         `json:"result"`
+		Error  *EthereumError `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Error != nil {
+		return 0, resp.Error
+	}
+	id, err := ethereumNumberToUint64(resp.Result)
+	return int64(id), err
+}
+
+func (chain *RPC) GetBlockHash(height uint64) (string, error) {
+	body, err := chain.call("eth_getBlockByNumber", []interface{}{fmt.Sprintf("0x%x", height), false})
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Result *struct {
+			Hash string `json:"hash"`
+		} `json:"result"`
+		Error *EthereumError `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+	if resp.Result == nil || resp.Result.Hash == "" {
+		return "", fmt.Errorf("block %d not found", height)
+	}
+	return resp.Result.Hash, nil
+}
+
 func (chain *RPC) GetAddressNonce(address string) (uint64, error) {
 	body, err := chain.call("eth_getTransactionCount", []interface{}{address, "latest"})
 	if err != nil {
@@ -83,6 +129,28 @@ func (chain *RPC) GetAddressNonce(address string) (uint64, error) {
 	return ethereumNumberToUint64(resp.Result)
 }
 
+func (chain *RPC) GetCode(address string, height uint64) ([]byte, error) {
+	body, err := chain.call("eth_getCode", []interface{}{address, fmt.Sprintf("0x%x", height)})
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Result string         `json:"result"`
+		Error  *EthereumError `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if !strings.HasPrefix(resp.Result, "0x") {
+		return nil, fmt.Errorf("invalid code %s", resp.Result)
+	}
+	return hex.DecodeString(resp.Result[2:])
+}
+
 func (chain *RPC) GetAddressBalance(address string) (decimal.Decimal, error) {
 	body, err := chain.call("eth_getBalance", []interface{}{address, "latest"})
 	if err != nil {
@@ -105,6 +173,8 @@ func (chain *RPC) GetAddressBalance(address string) (decimal.Decimal, error) {
 type Log struct {
 	address string
 	data    []byte
+	block   uint64
+	hash    string
 }
 
 func (chain *RPC) GetLogs(topic string, from, to uint64) ([]*Log, error) {
@@ -118,8 +188,10 @@ func (chain *RPC) GetLogs(topic string, from, to uint64) ([]*Log, error) {
 	}
 	var resp struct {
 		Result []struct {
-			Address string `json:"address"`
-			Data    string `json:"data"`
+			Address     string `json:"address"`
+			Data        string `json:"data"`
+			BlockNumber string `json:"blockNumber"`
+			BlockHash   string `json:"blockHash"`
 		} `json:"result"`
 		Error *EthereumError `json:"error,omitempty"`
 	}
@@ -137,15 +209,307 @@ func (chain *RPC) GetLogs(topic string, from, to uint64) ([]*Log, error) {
 			logger.Verbosef("GetLogs(%d, %d) => parseTransactionLog(%s) => %v", from, to, r.Data, err)
 			continue
 		}
+		block, err := ethereumNumberToUint64(r.BlockNumber)
+		if err != nil {
+			return nil, err
+		}
 		log := &Log{
 			address: formatAddress(r.Address),
 			data:    data,
+			block:   block,
+			hash:    r.BlockHash,
 		}
 		logs = append(logs, log)
 	}
 	return logs, nil
 }
 
+func (chain *RPC) GasPrice() (*big.Int, error) {
+	body, err := chain.call("eth_gasPrice", []interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Result string         `json:"result"`
+		Error  *EthereumError `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return ethereumNumberToBig(resp.Result)
+}
+
+// FeeHistory returns the base fee of the pending block, and the median
+// priority fee of the latest blocks at the reward percentile
+func (chain *RPC) FeeHistory(blocks int, percentile float64) (*big.Int, *big.Int, error) {
+	body, err := chain.call("eth_feeHistory", []interface{}{fmt.Sprintf("0x%x", blocks), "latest", []float64{percentile}})
+	if err != nil {
+		return nil, nil, err
+	}
+	var resp struct {
+		Result struct {
+			BaseFeePerGas []string   `json:"baseFeePerGas"`
+			Reward        [][]string `json:"reward"`
+		} `json:"result"`
+		Error *EthereumError `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Error != nil {
+		return nil, nil, resp.Error
+	}
+	fees := resp.Result.BaseFeePerGas
+	if len(fees) == 0 {
+		return nil, nil, fmt.Errorf("invalid fee history %s", string(body))
+	}
+	base, err := ethereumNumberToBig(fees[len(fees)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	var rewards []*big.Int
+	for _, r := range resp.Result.Reward {
+		if len(r) == 0 {
+			continue
+		}
+		reward, err := ethereumNumberToBig(r[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		rewards = append(rewards, reward)
+	}
+	if len(rewards) == 0 {
+		return base, big.NewInt(0), nil
+	}
+	sort.Slice(rewards, func(i, j int) bool {
+		return rewards[i].Cmp(rewards[j]) < 0
+	})
+	return base, rewards[len(rewards)/2], nil
+}
+
+func (chain *RPC) EstimateGas(from, to string, data []byte) (uint64, error) {
+	body, err := chain.call("eth_estimateGas", []interface{}{map[string]interface{}{
+		"from": from,
+		"to":   to,
+		"data": "0x" + hex.EncodeToString(data),
+	}})
+	if err != nil {
+		return 0, err
+	}
+	var resp struct {
+		Result string         `json:"result"`
+		Error  *EthereumError `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Error != nil {
+		return 0, resp.Error
+	}
+	return ethereumNumberToUint64(resp.Result)
+}
+
+type Receipt struct {
+	success bool
+	block   uint64
+	gasUsed uint64
+}
+
+// GetTransactionReceipt returns nil if the transaction not mined yet
+func (chain *RPC) GetTransactionReceipt(hash string) (*Receipt, error) {
+	body, err := chain.call("eth_getTransactionReceipt", []interface{}{hash})
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Result *struct {
+			Status      string `json:"status"`
+			BlockNumber string `json:"blockNumber"`
+			GasUsed     string `json:"gasUsed"`
+		} `json:"result"`
+		Error *EthereumError `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if resp.Result == nil {
+		return nil, nil
+	}
+	block, err := ethereumNumberToUint64(resp.Result.BlockNumber)
+	if err != nil {
+		return nil, err
+	}
+	gas, err := ethereumNumberToUint64(resp.Result.GasUsed)
+	if err != nil {
+		return nil, err
+	}
+	status, err := ethereumNumberToUint64(resp.Result.Status)
+	if err != nil {
+		return nil, err
+	}
+	return &Receipt{success: status == 1, block: block, gasUsed: gas}, nil
+}
+
+// CallRevertReason replays the reverted transaction at its block, and
+// decodes the Error(string) reason if any
+func (chain *RPC) CallRevertReason(from, to string, data []byte, block uint64) (string, error) {
+	body, err := chain.call("eth_call", []interface{}{map[string]interface{}{
+		"from": from,
+		"to":   to,
+		"data": "0x" + hex.EncodeToString(data),
+	}, fmt.Sprintf("0x%x", block)})
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Result string         `json:"result"`
+		Error  *EthereumError `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.Error == nil {
+		return "", nil
+	}
+	var revert string
+	if json.Unmarshal(resp.Error.Data, &revert) != nil || !strings.HasPrefix(revert, "0x") {
+		return resp.Error.Message, nil
+	}
+	b, err := hex.DecodeString(revert[2:])
+	if err != nil {
+		return resp.Error.Message, nil
+	}
+	reason, err := abi.UnpackRevert(b)
+	if err != nil {
+		return resp.Error.Message, nil
+	}
+	return reason, nil
+}
+
+// GetContractNonce reads the next group event nonce the contract accepts,
+// the public NONCE of the MixinProcess, or the INBOUND of the registry
+func (chain *RPC) GetContractNonce(address string) (uint64, error) {
+	res, err := chain.callContract(address, ContractNonceMethod)
+	if _, ok := err.(*EthereumError); ok || res == "0x" {
+		res, err = chain.callContract(address, RegistryNonceMethod)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return ethereumNumberToUint64(res)
+}
+
+// GetContractGroup reads the uint256[4] public GROUP key of the contract
+func (chain *RPC) GetContractGroup(address string) ([]byte, error) {
+	var group []byte
+	for i := 0; i < 4; i++ {
+		res, err := chain.callContract(address, ContractGroupMethod+fmt.Sprintf("%064x", i))
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(res, "0x") || len(res) != 66 {
+			return nil, fmt.Errorf("invalid group %s", res)
+		}
+		b, err := hex.DecodeString(res[2:])
+		if err != nil {
+			return nil, err
+		}
+		group = append(group, b...)
+	}
+	return group, nil
+}
+
+// GetContractHalted reads the HALTED flag of the registry, the contracts
+// without the flag are never halted
+func (chain *RPC) GetContractHalted(address string) (bool, error) {
+	res, err := chain.callContract(address, RegistryHaltedMethod)
+	if _, ok := err.(*EthereumError); ok || res == "0x" {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	flag, err := ethereumNumberToUint64(res)
+	return flag > 0, err
+}
+
+// GetRegistryEvolved checks whether the user and asset contracts of the
+// registry point to the next registry, it's true if no contracts created
+func (chain *RPC) GetRegistryEvolved(address, next string) (bool, error) {
+	res, err := chain.callContract(address, RegistryAddressesMethod+fmt.Sprintf("%064x", 0))
+	if _, ok := err.(*EthereumError); ok || res == "0x" {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	first, err := parseAddressResult(res)
+	if err != nil {
+		return false, err
+	}
+	res, err = chain.callContract(first, RegistrableRegistryMethod)
+	if err != nil {
+		return false, err
+	}
+	registry, err := parseAddressResult(res)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(registry, next), nil
+}
+
+func parseAddressResult(res string) (string, error) {
+	if !strings.HasPrefix(res, "0x") || len(res) != 66 {
+		return "", fmt.Errorf("invalid address %s", res)
+	}
+	return common.HexToAddress(res[26:]).Hex(), nil
+}
+
+// GetContractView calls the view method of the contract at the height, the
+// result is "0x" if the contract has no such view
+func (chain *RPC) GetContractView(address, method string, height uint64) (string, error) {
+	res, err := chain.callContractAt(address, method, fmt.Sprintf("0x%x", height))
+	if _, ok := err.(*EthereumError); ok {
+		return "0x", nil
+	}
+	return res, err
+}
+
+func (chain *RPC) callContract(address, data string) (string, error) {
+	return chain.callContractAt(address, data, "latest")
+}
+
+func (chain *RPC) callContractAt(address, data, block string) (string, error) {
+	body, err := chain.call("eth_call", []interface{}{map[string]interface{}{
+		"to":   address,
+		"data": data,
+	}, block})
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Result string         `json:"result"`
+		Error  *EthereumError `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+	return resp.Result, nil
+}
+
 func (chain *RPC) SendRawTransaction(raw string) (string, error) {
 	body, err := chain.call("eth_sendRawTransaction", []interface{}{raw})
 	if err != nil {
@@ -244,6 +608,17 @@ func ethereumNumberToUint64(hex string) (uint64, error) {
 	return value.Uint64(), nil
 }
 
+func ethereumNumberToBig(hex string) (*big.Int, error) {
+	if !strings.HasPrefix(hex, "0x") {
+		return nil, fmt.Errorf("invalid hex %s", hex)
+	}
+	value, success := new(big.Int).SetString(hex, 0)
+	if !success {
+		return nil, fmt.Errorf("invalid hex %s", hex)
+	}
+	return value, nil
+}
+
 func ethereumNumberToDecimal(hex string) (decimal.Decimal, error) {
 	if !strings.HasPrefix(hex, "0x") {
 		return decimal.Zero, fmt.Errorf("invalid hex %s", hex)
@@ -257,8 +632,9 @@ func ethereumNumberToDecimal(hex string) (decimal.Decimal, error) {
 }
 
 type EthereumError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
 }
 
 func (err *EthereumError) Error() string {
@@ -2,6 +2,8 @@ package quorum
 
 import (
 	"encoding/binary"
+	"fmt"
+	"time"
 
 	"github.com/MixinNetwork/trusted-group/mvm/encoding"
 	"github.com/dgraph-io/badger/v3"
@@ -12,14 +14,35 @@ const (
 	prefixQuorumContractLogOffset  = "QUORUM:CONTRACT:LOG:OFFSET:ALL"
 	prefixQuorumContractEventQueue = "QUORUM:CONTRACT:EVENT:QUEUE:"
 	prefixQuorumGroupEventQueue    = "QUORUM:GROUP:EVENT:QUEUE:"
+
+	prefixQuorumContractLogCheckpoint   = "QUORUM:CONTRACT:LOG:CHECKPOINT:"
+	prefixQuorumContractEventBlock      = "QUORUM:CONTRACT:EVENT:BLOCK:"
+	prefixQuorumContractEventDelivered  = "QUORUM:CONTRACT:EVENT:DELIVERED:"
+	prefixQuorumContractEventReorgAlarm = "QUORUM:CONTRACT:EVENT:ALARM:"
+	prefixQuorumContractRotation        = "QUORUM:CONTRACT:ROTATION:"
 )
 
+type logsCheckpoint struct {
+	height uint64
+	hash   string
+}
+
+// ReorgAlarm is recorded when a contract event delivered to the machine is
+// found in an orphaned block, the machine may have released the funds
+type ReorgAlarm struct {
+	Address   string    `json:"address"`
+	Nonce     uint64    `json:"nonce"`
+	Block     uint64    `json:"block"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
 func (e *Engine) storeWriteContractNotifier(address, notifier string) error {
 	key := []byte(prefixQuorumContractNotifier + address)
 	return e.db.Update(func(txn *badger.Txn) error {
 		_, err := txn.Get(key)
 		if err == nil {
-			panic(address)
+			return fmt.Errorf("contract notifier %s exists", address)
 		} else if err != badger.ErrKeyNotFound {
 			return err
 		}
@@ -27,23 +50,20 @@ func (e *Engine) storeWriteContractNotifier(address, notifier string) error {
 	})
 }
 
-func (e *Engine) storeReadContractNotifier(address string) string {
+func (e *Engine) storeReadContractNotifier(address string) (string, error) {
 	txn := e.db.NewTransaction(false)
 	defer txn.Discard()
 
 	key := []byte(prefixQuorumContractNotifier + address)
 	item, err := txn.Get(key)
 	if err == badger.ErrKeyNotFound {
-		return ""
+		return "", nil
 	} else if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	val, err := item.ValueCopy(nil)
-	if err != nil {
-		panic(err)
-	}
-	return string(val)
+	return string(val), err
 }
 
 func (e *Engine) storeListContractAddresses() ([]string, error) {
@@ -65,32 +85,189 @@ func (e *Engine) storeListContractAddresses() ([]string, error) {
 	return addresses, nil
 }
 
-func (e *Engine) storeReadContractLogsOffset() uint64 {
+func (e *Engine) storeReadContractLogsOffset() (uint64, error) {
 	txn := e.db.NewTransaction(false)
 	defer txn.Discard()
 
 	key := []byte(prefixQuorumContractLogOffset)
 	item, err := txn.Get(key)
 	if err == badger.ErrKeyNotFound {
-		return 0
+		return 0, nil
 	} else if err != nil {
-		panic(err)
+		return 0, err
 	}
 
 	val, err := item.ValueCopy(nil)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	return binary.BigEndian.Uint64(val)
+	return binary.BigEndian.Uint64(val), nil
 }
 
-func (e *Engine) storeWriteContractLogsOffset(offset uint64) error {
-	key := []byte(prefixQuorumContractLogOffset)
+// storeWriteContractLogsCheckpoint advances the logs offset to the scanned
+// block height, and records its hash to detect the reorgs later
+func (e *Engine) storeWriteContractLogsCheckpoint(offset uint64, hash string) error {
+	return e.db.Update(func(txn *badger.Txn) error {
+		key := append([]byte(prefixQuorumContractLogCheckpoint), uint64Bytes(offset)...)
+		err := txn.Set(key, []byte(hash))
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(prefixQuorumContractLogOffset), uint64Bytes(offset))
+	})
+}
+
+func (e *Engine) storeReadContractLogsCheckpoint(height uint64) (string, error) {
+	txn := e.db.NewTransaction(false)
+	defer txn.Discard()
+
+	key := append([]byte(prefixQuorumContractLogCheckpoint), uint64Bytes(height)...)
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	val, err := item.ValueCopy(nil)
+	return string(val), err
+}
+
+// storeListContractLogsCheckpoints lists the checkpoints lower than the
+// height, the latest first
+func (e *Engine) storeListContractLogsCheckpoints(height uint64, limit int) ([]*logsCheckpoint, error) {
+	txn := e.db.NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(prefixQuorumContractLogCheckpoint)
+	opts.Reverse = true
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var checkpoints []*logsCheckpoint
+	it.Seek(append(opts.Prefix, uint64Bytes(height)...))
+	for ; it.Valid(); it.Next() {
+		key := it.Item().Key()
+		h := binary.BigEndian.Uint64(key[len(opts.Prefix):])
+		if h >= height {
+			continue
+		}
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, &logsCheckpoint{height: h, hash: string(val)})
+		if len(checkpoints) >= limit {
+			break
+		}
+	}
+	return checkpoints, nil
+}
+
+// storeRollbackContractEvents rewinds the logs offset to the fork height,
+// the contract events in the orphaned blocks are removed if not delivered
+// to the machine yet, otherwise they are kept and alarmed
+func (e *Engine) storeRollbackContractEvents(fork uint64) (int, []*ReorgAlarm, error) {
+	var rolled int
+	var alarms []*ReorgAlarm
+	err := e.db.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefixQuorumContractEventBlock)
+		it := txn.NewIterator(opts)
+		var orphans [][]byte
+		for it.Seek(opts.Prefix); it.Valid(); it.Next() {
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if binary.BigEndian.Uint64(val[:8]) <= fork {
+				continue
+			}
+			orphans = append(orphans, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+
+		for _, key := range orphans {
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			ids := key[len(prefixQuorumContractEventBlock):]
+			address := string(ids[:len(ids)-8])
+			nonce := binary.BigEndian.Uint64(ids[len(ids)-8:])
+			delivered, err := readContractEventsDelivered(txn, address)
+			if err != nil {
+				return err
+			}
+			if nonce < delivered {
+				alarm := &ReorgAlarm{
+					Address:   address,
+					Nonce:     nonce,
+					Block:     binary.BigEndian.Uint64(val[:8]),
+					Hash:      string(val[8:]),
+					CreatedAt: time.Now(),
+				}
+				ak := append([]byte(prefixQuorumContractEventReorgAlarm), ids...)
+				err = txn.Set(ak, encoding.JSONMarshalPanic(alarm))
+				if err != nil {
+					return err
+				}
+				alarms = append(alarms, alarm)
+				continue
+			}
+			err = txn.Delete(append([]byte(prefixQuorumContractEventQueue), ids...))
+			if err != nil {
+				return err
+			}
+			err = txn.Delete(key)
+			if err != nil {
+				return err
+			}
+			rolled = rolled + 1
+		}
+
+		opts = badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(prefixQuorumContractLogCheckpoint)
+		it = txn.NewIterator(opts)
+		var checkpoints [][]byte
+		for it.Seek(append(opts.Prefix, uint64Bytes(fork+1)...)); it.Valid(); it.Next() {
+			checkpoints = append(checkpoints, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+		for _, key := range checkpoints {
+			err := txn.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return txn.Set([]byte(prefixQuorumContractLogOffset), uint64Bytes(fork))
+	})
+	return rolled, alarms, err
+}
+
+// storeWriteContractEventsDelivered records the contract events lower than
+// the nonce have been delivered to the machine
+func (e *Engine) storeWriteContractEventsDelivered(address string, nonce uint64) error {
 	return e.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(key, uint64Bytes(offset))
+		old, err := readContractEventsDelivered(txn, address)
+		if err != nil || old >= nonce {
+			return err
+		}
+		key := []byte(prefixQuorumContractEventDelivered + address)
+		return txn.Set(key, uint64Bytes(nonce))
 	})
 }
 
+func readContractEventsDelivered(txn *badger.Txn, address string) (uint64, error) {
+	return readUint64(txn, []byte(prefixQuorumContractEventDelivered+address))
+}
+
 func (e *Engine) storeReadLastContractEventNonce(address string) uint64 {
 	txn := e.db.NewTransaction(false)
 	defer txn.Discard()
@@ -119,9 +296,9 @@ func (e *Engine) storeReadLastContractEventNonce(address string) uint64 {
 	return evt.Nonce
 }
 
-func (e *Engine) storeWriteContractEvent(address string, evt *encoding.Event) error {
-	key := []byte(prefixQuorumContractEventQueue + address)
-	key = append(key, uint64Bytes(evt.Nonce)...)
+func (e *Engine) storeWriteContractEvent(address string, evt *encoding.Event, block uint64, hash string) error {
+	ids := append([]byte(address), uint64Bytes(evt.Nonce)...)
+	key := append([]byte(prefixQuorumContractEventQueue), ids...)
 	val := encoding.JSONMarshalPanic(evt)
 	return e.db.Update(func(txn *badger.Txn) error {
 		_, err := txn.Get(key)
@@ -130,7 +307,12 @@ func (e *Engine) storeWriteContractEvent(address string, evt *encoding.Event) er
 		} else if err != badger.ErrKeyNotFound {
 			return err
 		}
-		return txn.Set(key, val)
+		err = txn.Set(key, val)
+		if err != nil {
+			return err
+		}
+		bk := append([]byte(prefixQuorumContractEventBlock), ids...)
+		return txn.Set(bk, append(uint64Bytes(block), hash...))
 	})
 }
 
@@ -215,6 +397,34 @@ func (e *Engine) storeListGroupEvents(address string, offset uint64, limit int)
 	return events, nil
 }
 
+func (e *Engine) storeWriteContractRotation(address string, nonce uint64, payload []byte) error {
+	key := []byte(prefixQuorumContractRotation + address)
+	return e.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, append(uint64Bytes(nonce), payload...))
+	})
+}
+
+// storeReadContractRotation returns the nonce to switch the contract to the
+// new group, and the iterate payload, or nil if no rotation
+func (e *Engine) storeReadContractRotation(address string) (uint64, []byte) {
+	txn := e.db.NewTransaction(false)
+	defer txn.Discard()
+
+	key := []byte(prefixQuorumContractRotation + address)
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		panic(err)
+	}
+
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(val[:8]), val[8:]
+}
+
 func uint64Bytes(i uint64) []byte {
 	buf := make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, i)
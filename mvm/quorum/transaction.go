@@ -4,34 +4,89 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/big"
+	"time"
 
 	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/params"
 	"github.com/shopspring/decimal"
 )
 
-func (e *Engine) signContractNotifierDepositTransaction(pub string, key string, amount decimal.Decimal, nonce uint64) (string, string) {
-	return e.signTransaction(pub, key, amount, nil, nonce)
+func (e *Engine) signContractNotifierDepositTransaction(contract, notifier string, key string, amount decimal.Decimal, nonce uint64, fee *gasFee) (*machine.EngineTransaction, string) {
+	id, raw := e.signTransaction(notifier, key, amount, nil, nonce, GasTransaction, fee)
+	return newEngineTransaction(id, machine.TransactionKindNotifierDeposit, contract, pub(key), notifier, nonce, nil, GasTransaction), raw
 }
 
-func (e *Engine) signGroupEventTransaction(contract string, evt *encoding.Event, notifier string) (string, string) {
-	data := EventMethod + fmt.Sprintf("%064x", 0x20)
-	data = data + fmt.Sprintf("%064x", len(evt.Encode()))
-	data = data + hex.EncodeToString(evt.Encode())
-	for p := len(evt.Encode()) % 32; p > 0 && p < 32; p++ {
+func (e *Engine) signGroupEventTransaction(contract string, evt *encoding.Event, notifier string, nonce, gas uint64, fee *gasFee) (*machine.EngineTransaction, string) {
+	db := buildGroupEventCallData(evt)
+	id, raw := e.signTransaction(contract, notifier, decimal.Zero, db, nonce, gas, fee)
+	tx := newEngineTransaction(id, machine.TransactionKindGroupEvent, contract, pub(notifier), contract, nonce, db, gas)
+	tx.Event = evt.Nonce
+	return tx, raw
+}
+
+func newEngineTransaction(id, kind, address, sender, to string, nonce uint64, data []byte, gas uint64) *machine.EngineTransaction {
+	return &machine.EngineTransaction{
+		Hash:      id,
+		Kind:      kind,
+		Address:   address,
+		Sender:    sender,
+		To:        to,
+		Nonce:     nonce,
+		Payload:   data,
+		Gas:       gas,
+		Status:    machine.TransactionStatusPending,
+		SentAt:    time.Now(),
+		UpdatedAt: time.Now(),
+	}
+}
+
+func (e *Engine) signGroupRotationTransaction(contract string, rotation uint64, payload []byte, notifier string, nonce uint64, fee *gasFee) (*machine.EngineTransaction, string) {
+	db := buildBytesCallData(IterateMethod, payload)
+	gas := e.estimateGas(pub(notifier), contract, db)
+	id, raw := e.signTransaction(contract, notifier, decimal.Zero, db, nonce, gas, fee)
+	tx := newEngineTransaction(id, machine.TransactionKindGroupRotation, contract, pub(notifier), contract, nonce, db, gas)
+	tx.Event = rotation
+	return tx, raw
+}
+
+func buildGroupEventCallData(evt *encoding.Event) []byte {
+	return buildBytesCallData(EventMethod, evt.Encode())
+}
+
+// buildBytesCallData encodes the call data of the method with a single
+// bytes argument
+func buildBytesCallData(method string, b []byte) []byte {
+	data := method + fmt.Sprintf("%064x", 0x20)
+	data = data + fmt.Sprintf("%064x", len(b))
+	data = data + hex.EncodeToString(b)
+	for p := len(b) % 32; p > 0 && p < 32; p++ {
 		data = data + "00"
 	}
 	db, err := hex.DecodeString(data[2:])
 	if err != nil {
 		panic(err)
 	}
-	return e.signTransaction(contract, notifier, decimal.Zero, db, evt.Nonce)
+	return db
+}
+
+// the gas is estimated locally instead of eth_estimateGas, because all
+// members must agree on the cost to keep the process credit consistent
+func estimateGroupEventGas(evt *encoding.Event) uint64 {
+	gas := uint64(GasTransaction + GasEventExecution)
+	for _, b := range buildGroupEventCallData(evt) {
+		if b == 0 {
+			gas = gas + GasTxDataZero
+		} else {
+			gas = gas + GasTxDataNonZero
+		}
+	}
+	return gas
 }
 
-func (e *Engine) signTransaction(to string, key string, amount decimal.Decimal, data []byte, nonce uint64) (string, string) {
+func (e *Engine) signTransaction(to string, key string, amount decimal.Decimal, data []byte, nonce, gas uint64, fee *gasFee) (string, string) {
 	ecdsaPriv, err := crypto.HexToECDSA(key)
 	if err != nil {
 		panic(err)
@@ -44,12 +99,24 @@ func (e *Engine) signTransaction(to string, key string, amount decimal.Decimal,
 	var address common.Address
 	copy(address[:], cb)
 
-	gasPrice := big.NewInt(GasPrice)
+	chainId := big.NewInt(e.chainId)
 	amt := amount.Mul(decimal.New(1, etherPrecision)).BigInt()
-	tx := types.NewTransaction(nonce, address, amt, GasLimit, gasPrice, data)
-	params := params.MainnetChainConfig
-	params.ChainID = big.NewInt(e.chainId)
-	signer := types.MakeSigner(params, params.EIP155Block)
+	var tx *types.Transaction
+	if fee.tip != nil {
+		tx = types.NewTx(&types.DynamicFeeTx{
+			ChainID:   chainId,
+			Nonce:     nonce,
+			GasTipCap: fee.tip,
+			GasFeeCap: fee.price,
+			Gas:       gas,
+			To:        &address,
+			Value:     amt,
+			Data:      data,
+		})
+	} else {
+		tx = types.NewTransaction(nonce, address, amt, gas, fee.price, data)
+	}
+	signer := types.LatestSignerForChainID(chainId)
 	tx, err = types.SignTx(tx, signer, ecdsaPriv)
 	if err != nil {
 		panic(err)
@@ -7,12 +7,16 @@ import (
 	"time"
 
 	"github.com/MixinNetwork/trusted-group/mvm/config"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
 	"github.com/MixinNetwork/trusted-group/mvm/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type RPC struct {
-	store *store.BadgerStore
-	conf  *config.Configuration
+	store   *store.BadgerStore
+	conf    *config.Configuration
+	machine *machine.Machine
 }
 
 type Call struct {
@@ -40,6 +44,14 @@ func (r *Render) RenderData(data interface{}) {
 	r.render(body)
 }
 
+func (r *Render) RenderResult(data interface{}, err error) {
+	if err != nil {
+		r.RenderError(err)
+	} else {
+		r.RenderData(data)
+	}
+}
+
 func (r *Render) RenderError(err error) {
 	body := map[string]interface{}{"error": err.Error()}
 	r.render(body)
@@ -77,19 +89,33 @@ func (impl *RPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	renderer := &Render{w: w, id: call.Id}
 	switch call.Method {
 	case "getinfo":
-		info, err := getInfo(impl.store)
-		if err != nil {
-			renderer.RenderError(err)
-		} else {
-			renderer.RenderData(info)
-		}
+		renderer.RenderResult(getInfo(impl.store))
 	case "getmtgkeys":
-		keys, err := getMTGKeys(impl.conf)
-		if err != nil {
-			renderer.RenderError(err)
-		} else {
-			renderer.RenderData(keys)
-		}
+		renderer.RenderResult(getMTGKeys(impl.conf))
+	case "listexemptions":
+		renderer.RenderResult(listExemptions(impl.conf))
+	case "getgrouprotation":
+		renderer.RenderResult(getGroupRotation(impl.store, impl.conf))
+	case "listprocesses":
+		renderer.RenderResult(listProcesses(impl.store))
+	case "getprocess":
+		renderer.RenderResult(getProcess(impl.store, call.Params))
+	case "getaccountbalance":
+		renderer.RenderResult(getAccountBalance(impl.store, call.Params))
+	case "listpendingevents":
+		renderer.RenderResult(listPendingEvents(impl.store, call.Params))
+	case "listsignedevents":
+		renderer.RenderResult(listSignedEvents(impl.store, call.Params))
+	case "getevent":
+		renderer.RenderResult(getEvent(impl.store, call.Params))
+	case "getengineoffset":
+		renderer.RenderResult(getEngineOffset(impl.store, call.Params))
+	case "listquarantinedevents":
+		renderer.RenderResult(listQuarantinedEvents(impl.store, call.Params))
+	case "listpeermisbehaviors":
+		renderer.RenderResult(listPeerMisbehaviors(impl.store, call.Params))
+	case "listenginetransactions":
+		renderer.RenderResult(listEngineTransactions(impl.store, impl.machine, call.Params))
 	default:
 		renderer.RenderError(fmt.Errorf("invalid method %s", call.Method))
 	}
@@ -115,16 +141,20 @@ func handleCORS(handler http.Handler) http.Handler {
 	})
 }
 
-func NewServer(store *store.BadgerStore, conf *config.Configuration, port int) *http.Server {
+func NewServer(store *store.BadgerStore, conf *config.Configuration, im *machine.Machine, port int) *http.Server {
 	rpc := &RPC{
-		store: store,
-		conf:  conf,
+		store:   store,
+		conf:    conf,
+		machine: im,
 	}
-	handler := handleCORS(rpc)
+	prometheus.MustRegister(&storeCollector{store: store})
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/", handleCORS(rpc))
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
-		Handler:      handler,
+		Handler:      mux,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
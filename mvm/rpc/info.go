@@ -9,6 +9,7 @@ import (
 	"github.com/MixinNetwork/tip/crypto"
 	"github.com/MixinNetwork/tip/crypto/en256"
 	"github.com/MixinNetwork/trusted-group/mvm/config"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
 	"github.com/MixinNetwork/trusted-group/mvm/store"
 	"github.com/drand/kyber"
 	"github.com/drand/kyber/share"
@@ -32,6 +33,45 @@ func getInfo(store *store.BadgerStore) (map[string]interface{}, error) {
 	}, nil
 }
 
+func listExemptions(conf *config.Configuration) (map[string]interface{}, error) {
+	if conf == nil || conf.Machine == nil {
+		return nil, errors.New("invalid config machine")
+	}
+	exemptions := conf.Machine.Exemptions
+	if exemptions == nil {
+		exemptions = []*machine.Exemption{}
+	}
+	return map[string]interface{}{
+		"exemptions": exemptions,
+		"digest":     machine.ExemptionsDigest(exemptions),
+	}, nil
+}
+
+func getGroupRotation(store *store.BadgerStore, conf *config.Configuration) (map[string]interface{}, error) {
+	if conf == nil || conf.Machine == nil || conf.Machine.Rotation == nil {
+		return nil, errors.New("no group rotation")
+	}
+	group, err := conf.Machine.Rotation.Group()
+	if err != nil {
+		return nil, err
+	}
+	view := map[string]interface{}{
+		"group":    hex.EncodeToString(group),
+		"nonce":    conf.Machine.Rotation.Nonce,
+		"partials": []int{0, 0},
+		"signed":   []bool{false, false},
+		"payload":  "",
+	}
+	r, err := store.ReadGroupRotation(group)
+	if err != nil || r == nil {
+		return view, err
+	}
+	view["partials"] = []int{len(r.Partials[machine.RotationSignerOld]), len(r.Partials[machine.RotationSignerNew])}
+	view["signed"] = []bool{r.Signatures[machine.RotationSignerOld] != nil, r.Signatures[machine.RotationSignerNew] != nil}
+	view["payload"] = hex.EncodeToString(r.Payload())
+	return view, nil
+}
+
 func getMTGKeys(conf *config.Configuration) (map[string]string, error) {
 	if conf == nil || conf.Machine == nil || conf.Machine.Poly == "" {
 		return nil, errors.New("invalid config machine")
@@ -0,0 +1,65 @@
+package rpc
+
+import (
+	"strconv"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/trusted-group/mvm/store"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pendingEventsDesc = prometheus.NewDesc("mvm_process_pending_events",
+		"The pending group events queue depth of the process.", []string{"process"}, nil)
+	signedEventsDesc = prometheus.NewDesc("mvm_process_signed_events",
+		"The signed group events queue depth of the process.", []string{"process"}, nil)
+	processCreditDesc = prometheus.NewDesc("mvm_process_credit",
+		"The fee asset credit of the process.", []string{"process"}, nil)
+	accountBalanceDesc = prometheus.NewDesc("mvm_process_account_balance",
+		"The asset balance of the process.", []string{"process", "asset"}, nil)
+)
+
+// storeCollector reads the process gauges from the store on each scrape
+type storeCollector struct {
+	store *store.BadgerStore
+}
+
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingEventsDesc
+	ch <- signedEventsDesc
+	ch <- processCreditDesc
+	ch <- accountBalanceDesc
+}
+
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	processes, err := c.store.ListProcesses()
+	if err != nil {
+		logger.Printf("metrics ListProcesses() => %v", err)
+		return
+	}
+	pending, signed, err := c.store.CountGroupEvents()
+	if err != nil {
+		logger.Printf("metrics CountGroupEvents() => %v", err)
+		return
+	}
+	for _, p := range processes {
+		ch <- prometheus.MustNewConstMetric(pendingEventsDesc, prometheus.GaugeValue, float64(pending[p.Identifier]), p.Identifier)
+		ch <- prometheus.MustNewConstMetric(signedEventsDesc, prometheus.GaugeValue, float64(signed[p.Identifier]), p.Identifier)
+		ch <- prometheus.MustNewConstMetric(processCreditDesc, prometheus.GaugeValue, integerFloat(p.Credit), p.Identifier)
+
+		balances, err := c.store.ListAccountBalances(p.Identifier)
+		if err != nil {
+			logger.Printf("metrics ListAccountBalances(%s) => %v", p.Identifier, err)
+			continue
+		}
+		for asset, balance := range balances {
+			ch <- prometheus.MustNewConstMetric(accountBalanceDesc, prometheus.GaugeValue, integerFloat(balance), p.Identifier, asset)
+		}
+	}
+}
+
+func integerFloat(i common.Integer) float64 {
+	f, _ := strconv.ParseFloat(i.String(), 64)
+	return f
+}
@@ -0,0 +1,351 @@
+package rpc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/MixinNetwork/trusted-group/mvm/store"
+)
+
+const (
+	listLimitDefault = 100
+	listLimitMaximum = 500
+)
+
+func listProcesses(store *store.BadgerStore) ([]map[string]interface{}, error) {
+	procs, err := store.ListProcesses()
+	if err != nil {
+		return nil, err
+	}
+	views := make([]map[string]interface{}, len(procs))
+	for i, p := range procs {
+		views[i] = processView(p)
+	}
+	return views, nil
+}
+
+func getProcess(store *store.BadgerStore, params []interface{}) (map[string]interface{}, error) {
+	p, err := readProcessParam(store, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := store.ReadEngineGroupEventsOffset(p.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	view := processView(p)
+	view["offset"] = offset
+	return view, nil
+}
+
+func getAccountBalance(store *store.BadgerStore, params []interface{}) (map[string]interface{}, error) {
+	p, err := readProcessParam(store, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[string]string)
+	if len(params) > 1 {
+		asset, err := stringParam(params, 1)
+		if err != nil {
+			return nil, err
+		}
+		balance, err := store.ReadAccountBalance(p.Identifier, asset)
+		if err != nil {
+			return nil, err
+		}
+		balances[asset] = balance.String()
+	} else {
+		all, err := store.ListAccountBalances(p.Identifier)
+		if err != nil {
+			return nil, err
+		}
+		for asset, balance := range all {
+			balances[asset] = balance.String()
+		}
+	}
+	return map[string]interface{}{
+		"process":  p.Identifier,
+		"balances": balances,
+	}, nil
+}
+
+func listPendingEvents(store *store.BadgerStore, params []interface{}) ([]map[string]interface{}, error) {
+	p, err := readProcessParam(store, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := limitParam(params, 1)
+	if err != nil {
+		return nil, err
+	}
+	evts, err := store.ListProcessPendingGroupEvents(p.Identifier, limit)
+	if err != nil {
+		return nil, err
+	}
+	return eventViews(evts), nil
+}
+
+func listSignedEvents(store *store.BadgerStore, params []interface{}) ([]map[string]interface{}, error) {
+	p, err := readProcessParam(store, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := limitParam(params, 1)
+	if err != nil {
+		return nil, err
+	}
+	evts, err := store.ListSignedGroupEvents(p.Identifier, limit)
+	if err != nil {
+		return nil, err
+	}
+	return eventViews(evts), nil
+}
+
+func getEvent(store *store.BadgerStore, params []interface{}) (map[string]interface{}, error) {
+	p, err := readProcessParam(store, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := uint64Param(params, 1)
+	if err != nil {
+		return nil, err
+	}
+	if nonce >= p.Nonce {
+		return nil, fmt.Errorf("event %s:%d not found", p.Identifier, nonce)
+	}
+	partials, full, err := store.ReadGroupEventSignatures(p.Identifier, nonce, p.SignType())
+	if err != nil {
+		return nil, err
+	}
+	evt, err := store.ReadGroupEvent(p.Identifier, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	view := map[string]interface{}{
+		"process":  p.Identifier,
+		"nonce":    nonce,
+		"state":    "sent",
+		"partials": len(partials),
+		"signed":   full,
+	}
+	if full {
+		view["partials"] = 0
+	}
+	if evt != nil {
+		view["event"] = eventView(evt)
+		if full {
+			view["state"] = "signed"
+		} else {
+			view["state"] = "pending"
+		}
+	}
+	return view, nil
+}
+
+func getEngineOffset(store *store.BadgerStore, params []interface{}) (map[string]interface{}, error) {
+	p, err := readProcessParam(store, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := store.ReadEngineGroupEventsOffset(p.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"process":  p.Identifier,
+		"platform": p.Platform,
+		"offset":   offset,
+	}, nil
+}
+
+func listQuarantinedEvents(store *store.BadgerStore, params []interface{}) ([]map[string]interface{}, error) {
+	p, err := readProcessParam(store, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := limitParam(params, 1)
+	if err != nil {
+		return nil, err
+	}
+	qes, err := store.ListQuarantinedEvents(p.Identifier, limit)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]map[string]interface{}, len(qes))
+	for i, qe := range qes {
+		views[i] = map[string]interface{}{
+			"process":    qe.Process,
+			"nonce":      qe.Nonce,
+			"stage":      qe.Stage,
+			"reason":     qe.Reason,
+			"created_at": qe.CreatedAt,
+		}
+		if qe.Event != nil {
+			views[i]["event"] = eventView(qe.Event)
+		}
+		if qe.Output != "" {
+			views[i]["output"] = qe.Output
+		}
+	}
+	return views, nil
+}
+
+func listPeerMisbehaviors(store *store.BadgerStore, params []interface{}) ([]map[string]interface{}, error) {
+	peer, err := stringParam(params, 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := limitParam(params, 1)
+	if err != nil {
+		return nil, err
+	}
+	pms, err := store.ListPeerMisbehaviors(peer, limit)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]map[string]interface{}, len(pms))
+	for i, pm := range pms {
+		views[i] = map[string]interface{}{
+			"peer":       pm.Peer,
+			"kind":       pm.Kind,
+			"process":    pm.Process,
+			"nonce":      pm.Nonce,
+			"reason":     pm.Reason,
+			"created_at": pm.CreatedAt,
+		}
+	}
+	return views, nil
+}
+
+func listEngineTransactions(store *store.BadgerStore, im *machine.Machine, params []interface{}) ([]map[string]interface{}, error) {
+	p, err := readProcessParam(store, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := limitParam(params, 1)
+	if err != nil {
+		return nil, err
+	}
+	tj := im.TransactionJournal(p.Platform)
+	if tj == nil {
+		return nil, fmt.Errorf("engine %s has no transaction journal", p.Platform)
+	}
+	txs, err := tj.ListTransactions(p.Address, limit)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]map[string]interface{}, len(txs))
+	for i, tx := range txs {
+		views[i] = map[string]interface{}{
+			"hash":       tx.Hash,
+			"kind":       tx.Kind,
+			"sender":     tx.Sender,
+			"to":         tx.To,
+			"nonce":      tx.Nonce,
+			"event":      tx.Event,
+			"payload":    hex.EncodeToString(tx.Payload),
+			"gas":        tx.Gas,
+			"status":     tx.Status,
+			"reason":     tx.Reason,
+			"block":      tx.Block,
+			"gas_used":   tx.GasUsed,
+			"sent_at":    tx.SentAt,
+			"updated_at": tx.UpdatedAt,
+		}
+	}
+	return views, nil
+}
+
+func processView(p *machine.Process) map[string]interface{} {
+	return map[string]interface{}{
+		"process":  p.Identifier,
+		"platform": p.Platform,
+		"address":  p.Address,
+		"credit":   p.Credit.String(),
+		"nonce":    p.Nonce,
+		"asset":    p.Asset,
+	}
+}
+
+func eventViews(evts []*encoding.Event) []map[string]interface{} {
+	views := make([]map[string]interface{}, len(evts))
+	for i, e := range evts {
+		views[i] = eventView(e)
+	}
+	return views
+}
+
+func eventView(e *encoding.Event) map[string]interface{} {
+	members := e.Members
+	if members == nil {
+		members = []string{}
+	}
+	return map[string]interface{}{
+		"process":   e.Process,
+		"nonce":     e.Nonce,
+		"asset":     e.Asset,
+		"amount":    e.Amount.String(),
+		"members":   members,
+		"threshold": e.Threshold,
+		"extra":     hex.EncodeToString(e.Extra),
+		"timestamp": e.Timestamp,
+		"signature": hex.EncodeToString(e.Signature),
+	}
+}
+
+func readProcessParam(store *store.BadgerStore, params []interface{}, i int) (*machine.Process, error) {
+	pid, err := stringParam(params, i)
+	if err != nil {
+		return nil, err
+	}
+	p, err := store.ReadProcess(pid)
+	if err != nil {
+		return nil, err
+	} else if p == nil {
+		return nil, fmt.Errorf("process %s not found", pid)
+	}
+	return p, nil
+}
+
+func stringParam(params []interface{}, i int) (string, error) {
+	if len(params) <= i {
+		return "", fmt.Errorf("missing param %d", i)
+	}
+	s, ok := params[i].(string)
+	if !ok || s == "" {
+		return "", fmt.Errorf("invalid param %d %v", i, params[i])
+	}
+	return s, nil
+}
+
+func uint64Param(params []interface{}, i int) (uint64, error) {
+	if len(params) <= i {
+		return 0, fmt.Errorf("missing param %d", i)
+	}
+	switch v := params[i].(type) {
+	case json.Number:
+		return strconv.ParseUint(v.String(), 10, 64)
+	case string:
+		return strconv.ParseUint(v, 10, 64)
+	}
+	return 0, fmt.Errorf("invalid param %d %v", i, params[i])
+}
+
+func limitParam(params []interface{}, i int) (int, error) {
+	if len(params) <= i {
+		return listLimitDefault, nil
+	}
+	limit, err := uint64Param(params, i)
+	if err != nil {
+		return 0, err
+	}
+	if limit == 0 || limit > listLimitMaximum {
+		return 0, fmt.Errorf("invalid limit %d", limit)
+	}
+	return int(limit), nil
+}
@@ -0,0 +1,509 @@
+package solana
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gofrs/uuid"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// Platform is the process platform of the Solana programs
+	Platform = "solana"
+
+	ClockTick = 3 * time.Second
+
+	// the program instruction to accept a group event
+	InstructionMixin = 0
+
+	// the state account of the contract, all integers are little endian
+	//
+	// process (16) || INBOUND (8) || OUTBOUND (8) || GROUP (128)
+	StateProcessOffset  = 0
+	StateInboundOffset  = 16
+	StateOutboundOffset = 24
+	StateGroupOffset    = 32
+	StateSize           = 160
+
+	// the program emits the events with sol_log_data("MVM", event)
+	EventLogTag = "TVZN"
+
+	NotifierMinimumBalance = 10000000
+	NotifierDepositAmount  = 100000000
+
+	SignaturesLimit      = 1000
+	ResendInterval       = 30 * time.Second
+	ResendMaxInterval    = 10 * time.Minute
+	VerifyAddressRetries = 5
+)
+
+type Configuration struct {
+	Store      string `toml:"store"`
+	RPC        string `toml:"rpc"`
+	PrivateKey string `toml:"key"`
+	FeeRate    string `toml:"fee-rate"`
+}
+
+type Engine struct {
+	db      *badger.DB
+	rpc     *RPC
+	key     ed25519.PrivateKey
+	feeRate common.Integer
+	loops   *sync.WaitGroup
+
+	// the programs of the verified state accounts, so the notifier is set up
+	// without querying the account again
+	programs sync.Map
+}
+
+func Boot(ctx context.Context, conf *Configuration) (*Engine, error) {
+	rpc, err := NewRPC(conf.RPC)
+	if err != nil {
+		return nil, err
+	}
+	e := &Engine{rpc: rpc, feeRate: common.Zero, loops: new(sync.WaitGroup)}
+	if conf.FeeRate != "" {
+		rate, err := decimal.NewFromString(conf.FeeRate)
+		if err != nil || rate.Sign() < 0 {
+			return nil, fmt.Errorf("invalid solana fee rate %s", conf.FeeRate)
+		}
+		e.feeRate = common.NewIntegerFromString(rate.String())
+	}
+	if conf.PrivateKey != "" {
+		e.key, err = decodePrivateKey(conf.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e.db = openBadger(conf.Store)
+	e.spawn(func() { e.loopHandleContracts(ctx) })
+	return e, nil
+}
+
+// Close waits all loops to finish after the boot context is done,
+// then closes the engine database
+func (e *Engine) Close() error {
+	e.loops.Wait()
+	return e.db.Close()
+}
+
+func (e *Engine) spawn(loop func()) {
+	e.loops.Add(1)
+	go func() {
+		defer e.loops.Done()
+		loop()
+	}()
+}
+
+func (e *Engine) Platform() string {
+	return Platform
+}
+
+func (e *Engine) SignType() int {
+	return machine.SignTypeTBLS
+}
+
+func (e *Engine) CombineSignatures(address string, event *encoding.Event, partials [][]byte) ([]byte, error) {
+	return nil, fmt.Errorf("solana signatures combined by the machine")
+}
+
+func (e *Engine) SignEvent(address string, event *encoding.Event) []byte {
+	return nil
+}
+
+// VerifyAddress checks the address is a state account of the process, owned
+// by an executable program. All members should get the same account, so the
+// RPC errors are returned as the engine unavailable to retry.
+func (e *Engine) VerifyAddress(ctx context.Context, address, pid string, _ []byte) error {
+	_, err := decodePublicKey(address)
+	if err != nil {
+		return err
+	}
+
+	state, err := e.getAccountInfo(ctx, address)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("state account %s not found", address)
+	}
+	err = verifyContractState(pid, state.Data)
+	if err != nil {
+		return err
+	}
+	program, err := e.getAccountInfo(ctx, state.Owner)
+	if err != nil {
+		return err
+	}
+	if program == nil || !program.Executable {
+		return fmt.Errorf("state account %s owner %s not executable", address, state.Owner)
+	}
+	e.programs.Store(address, &contractProgram{Program: state.Owner, Process: pid})
+	return nil
+}
+
+func (e *Engine) SetupNotifier(address string) error {
+	program, err := e.readContractProgram(address)
+	if err != nil {
+		return err
+	}
+
+	seed := append(append([]byte{}, e.key...), address...)
+	notifier := base58.Encode(deriveKey(seed))
+	old := e.storeReadContractNotifier(address)
+	if old == notifier {
+		return nil
+	} else if old != "" {
+		panic(old)
+	}
+	return e.storeWriteContractNotifier(address, notifier, program)
+}
+
+func (e *Engine) VerifyEvent(address string, event *encoding.Event) bool {
+	return false
+}
+
+// EstimateCost charges the fee rate for each event, the transaction fees
+// are fixed per signature in Solana
+func (e *Engine) EstimateCost(events []*encoding.Event) (common.Integer, error) {
+	if e.feeRate.Sign() == 0 || len(events) == 0 {
+		return common.Zero, nil
+	}
+	return e.feeRate.Mul(len(events)), nil
+}
+
+func (e *Engine) EnsureSendGroupEvents(address string, events []*encoding.Event) error {
+	return e.storeWriteGroupEvents(address, events)
+}
+
+func (e *Engine) ReceiveGroupEvents(address string, offset uint64, limit int) ([]*encoding.Event, error) {
+	return e.storeListContractEvents(address, offset, limit)
+}
+
+func (e *Engine) IsPublisher() bool {
+	return e.key != nil
+}
+
+func (e *Engine) loopHandleContracts(ctx context.Context) {
+	contracts := make(map[string]bool)
+	deposits := make(map[string]time.Time)
+
+	for sleep(ctx, ClockTick) {
+		all, err := e.storeListContractAddresses()
+		if err != nil {
+			panic(err)
+		}
+		for _, c := range all {
+			if contracts[c] {
+				continue
+			}
+			contracts[c] = true
+			address := c
+			e.spawn(func() { e.loopGetLogs(ctx, address) })
+			e.spawn(func() { e.loopSendGroupEvents(ctx, address) })
+		}
+		if !e.IsPublisher() {
+			continue
+		}
+
+		// the balance is finalized, so deposit once in a while
+		for _, c := range all {
+			if time.Since(deposits[c]) < time.Minute {
+				continue
+			}
+			notifier := e.readContractNotifier(c)
+			balance, err := e.rpc.GetBalance(pub(notifier))
+			if err != nil {
+				break
+			}
+			if balance >= NotifierMinimumBalance {
+				continue
+			}
+			blockhash, err := e.rpc.GetLatestBlockhash()
+			if err != nil {
+				break
+			}
+			data := buildTransferInstruction(NotifierDepositAmount)
+			raw, id, err := buildTransaction(e.key, pub(notifier), SystemProgram, [][]byte{data}, blockhash)
+			if err != nil {
+				panic(err)
+			}
+			res, err := e.rpc.SendTransaction(raw)
+			logger.Verbosef("loopHandleContracts => SendTransaction(%s, %s) => %s, %v", c, id, res, err)
+			deposits[c] = time.Now()
+		}
+	}
+}
+
+// loopGetLogs scans the logs of the finalized transactions of the state
+// account, the signatures are listed backwards to the scanned one
+func (e *Engine) loopGetLogs(ctx context.Context, address string) {
+	logger.Verbosef("Engine.loopGetLogs(%s)", address)
+	program := e.storeReadContractProgram(address)
+
+	for sleep(ctx, ClockTick) {
+		until := e.storeReadContractLogsOffset(address)
+		sigs, err := e.listContractSignatures(address, until)
+		if err != nil {
+			logger.Printf("loopGetLogs(%s) => listContractSignatures(%s) => %v", address, until, err)
+			continue
+		}
+		var events []*encoding.Event
+		var offset string
+		for i := len(sigs) - 1; i >= 0; i-- {
+			s := sigs[i]
+			if isTransactionError(s.Err) {
+				offset = s.Signature
+				continue
+			}
+			meta, err := e.rpc.GetTransactionMeta(s.Signature)
+			if err != nil || meta == nil {
+				logger.Printf("loopGetLogs(%s) => GetTransactionMeta(%s) => %v", address, s.Signature, err)
+				break
+			}
+			offset = s.Signature
+			if isTransactionError(meta.Err) {
+				continue
+			}
+			for _, evt := range parseProgramEvents(program.Program, meta.LogMessages) {
+				if evt.Process != program.Process {
+					logger.Verbosef("loopGetLogs(%s) => event process %s", address, evt.Process)
+					continue
+				}
+				events = append(events, evt)
+			}
+		}
+		if offset == "" {
+			continue
+		}
+		logger.Verbosef("loopGetLogs(%s) => %d %s", address, len(events), offset)
+		err = e.storeWriteContractEventsAndOffset(address, events, offset)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (e *Engine) listContractSignatures(address, until string) ([]*signatureInfo, error) {
+	var all []*signatureInfo
+	var before string
+	for {
+		sigs, err := e.rpc.GetSignaturesForAddress(address, before, until, SignaturesLimit)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, sigs...)
+		if len(sigs) < SignaturesLimit {
+			return all, nil
+		}
+		before = sigs[len(sigs)-1].Signature
+	}
+}
+
+// loopSendGroupEvents packs the events from the state INBOUND nonce into a
+// single transaction, so they are accepted by the program in order
+func (e *Engine) loopSendGroupEvents(ctx context.Context, address string) {
+	logger.Verbosef("Engine.loopSendGroupEvents(%s)", address)
+	program := e.storeReadContractProgram(address)
+	var sentId string
+	var sentOffset uint64
+	var sentAt time.Time
+	interval := ResendInterval
+
+	for e.IsPublisher() && sleep(ctx, ClockTick) {
+		notifier := e.readContractNotifier(address)
+		balance, err := e.rpc.GetBalance(pub(notifier))
+		if err != nil || balance < NotifierMinimumBalance/10 {
+			sleep(ctx, 5*time.Second)
+			continue
+		}
+		state, err := e.rpc.GetAccountInfo(address)
+		if err != nil || state == nil || len(state.Data) < StateSize {
+			logger.Verbosef("loopSendGroupEvents(%s) => GetAccountInfo() => %v", address, err)
+			sleep(ctx, 5*time.Second)
+			continue
+		}
+		offset := binary.LittleEndian.Uint64(state.Data[StateInboundOffset:])
+		if offset == sentOffset && sentId != "" {
+			if time.Since(sentAt) < interval {
+				continue
+			}
+			// resend the dropped transaction with a longer interval each time
+			resend, err := e.checkSentTransaction(address, sentId)
+			sentAt, interval = time.Now(), interval*2
+			if interval > ResendMaxInterval {
+				interval = ResendMaxInterval
+			}
+			if err != nil || !resend {
+				continue
+			}
+		} else {
+			interval = ResendInterval
+		}
+		evts, err := e.storeListGroupEvents(address, offset, 10)
+		if err != nil {
+			panic(err)
+		}
+		if len(evts) == 0 {
+			continue
+		}
+		blockhash, err := e.rpc.GetLatestBlockhash()
+		if err != nil {
+			continue
+		}
+
+		var raw []byte
+		var id string
+		var instructions [][]byte
+		for _, evt := range evts {
+			data := buildGroupEventInstruction(evt)
+			r, i, err := buildTransaction(notifier, address, program.Program, append(instructions, data), blockhash)
+			if err != nil {
+				break
+			}
+			raw, id, instructions = r, i, append(instructions, data)
+		}
+		if raw == nil {
+			logger.Printf("loopSendGroupEvents(%s) => event %d too large", address, offset)
+			sleep(ctx, time.Minute)
+			continue
+		}
+		res, err := e.rpc.SendTransaction(raw)
+		logger.Verbosef("loopSendGroupEvents(%s) => SendTransaction(%s, %d, %d) => %s, %v", address, id, offset, len(instructions), res, err)
+		sentId, sentOffset, sentAt = id, offset, time.Now()
+	}
+}
+
+func (e *Engine) readContractNotifier(address string) ed25519.PrivateKey {
+	notifier := e.storeReadContractNotifier(address)
+	return ed25519.PrivateKey(base58.Decode(notifier))
+}
+
+// readContractProgram returns the program verified by VerifyAddress, or reads
+// the state account for the address verified before the engine restarted
+func (e *Engine) readContractProgram(address string) (*contractProgram, error) {
+	if p, found := e.programs.Load(address); found {
+		return p.(*contractProgram), nil
+	}
+	state, err := e.getAccountInfo(context.Background(), address)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil || len(state.Data) < StateSize {
+		return nil, fmt.Errorf("state account %s not found", address)
+	}
+	pid, err := uuid.FromBytes(state.Data[StateProcessOffset : StateProcessOffset+16])
+	if err != nil {
+		return nil, err
+	}
+	return &contractProgram{Program: state.Owner, Process: pid.String()}, nil
+}
+
+func (e *Engine) getAccountInfo(ctx context.Context, address string) (*accountInfo, error) {
+	var err error
+	for i := 0; i < VerifyAddressRetries; i++ {
+		var info *accountInfo
+		info, err = e.rpc.GetAccountInfo(address)
+		if err == nil {
+			return info, nil
+		}
+		logger.Printf("getAccountInfo(%s) => %v", address, err)
+		if !sleep(ctx, ClockTick) {
+			break
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", machine.ErrorEngineUnavailable, err)
+}
+
+// checkSentTransaction returns false if the transaction is finalized, the
+// failed one is never resent because its fee is paid and the program would
+// reject the same events again
+func (e *Engine) checkSentTransaction(address, id string) (bool, error) {
+	meta, err := e.rpc.GetTransactionMeta(id)
+	if err != nil || meta == nil {
+		return meta == nil, err
+	}
+	if isTransactionError(meta.Err) {
+		logger.Printf("checkSentTransaction(%s, %s) => failed %s", address, id, string(meta.Err))
+	}
+	return false, nil
+}
+
+func verifyContractState(pid string, data []byte) error {
+	if len(data) < StateSize {
+		return fmt.Errorf("invalid state size %d", len(data))
+	}
+	id, err := uuid.FromString(pid)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(id.Bytes(), data[StateProcessOffset:StateProcessOffset+16]) {
+		return fmt.Errorf("invalid state process %x", data[StateProcessOffset:StateProcessOffset+16])
+	}
+	return nil
+}
+
+// parseProgramEvents decodes the events logged by the program itself, the
+// data logged by the programs it invoked are ignored
+func parseProgramEvents(program string, logs []string) []*encoding.Event {
+	var events []*encoding.Event
+	var stack []string
+	for _, l := range logs {
+		f := strings.Fields(l)
+		if len(f) < 3 || f[0] != "Program" {
+			continue
+		}
+		switch {
+		case f[2] == "invoke":
+			stack = append(stack, f[1])
+		case f[2] == "success" || f[2] == "failed:":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case f[1] == "data:" && f[2] == EventLogTag && len(f) == 4:
+			if len(stack) == 0 || stack[len(stack)-1] != program {
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(f[3])
+			if err != nil {
+				continue
+			}
+			evt, err := encoding.DecodeEvent(b)
+			logger.Verbosef("parseProgramEvents(%s) => DecodeEvent(%x) => %v, %v", program, b, evt, err)
+			if err != nil {
+				continue
+			}
+			events = append(events, evt)
+		}
+	}
+	return events
+}
+
+func isTransactionError(err []byte) bool {
+	return len(err) > 0 && string(err) != "null"
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,171 @@
+package solana
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/mixin/common"
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSolanaEngine(t *testing.T) {
+	require := require.New(t)
+	chain := newFakeSolana()
+	server := httptest.NewServer(chain)
+	defer server.Close()
+
+	_, payer, _ := ed25519.GenerateKey(rand.Reader)
+	chain.accounts[pub(payer)] = &fakeAccount{lamports: 1000000000}
+	program := randomAddress()
+	chain.accounts[program] = &fakeAccount{owner: randomAddress(), executable: true}
+	pid := uuid.Must(uuid.NewV4()).String()
+	state := randomAddress()
+	data := make([]byte, StateSize)
+	copy(data[StateProcessOffset:], uuid.FromStringOrNil(pid).Bytes())
+	chain.accounts[state] = &fakeAccount{owner: program, data: data}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e, err := Boot(ctx, &Configuration{
+		Store:      t.TempDir(),
+		RPC:        server.URL,
+		PrivateKey: base58.Encode(payer),
+	})
+	require.Nil(err)
+	defer e.Close()
+	defer cancel()
+
+	require.NotNil(e.VerifyAddress(context.Background(), "0x1234", pid, nil))
+	require.NotNil(e.VerifyAddress(context.Background(), randomAddress(), pid, nil))
+	require.NotNil(e.VerifyAddress(context.Background(), state, uuid.Must(uuid.NewV4()).String(), nil))
+	require.Nil(e.VerifyAddress(context.Background(), state, pid, nil))
+	require.Nil(e.SetupNotifier(state))
+	require.Nil(e.SetupNotifier(state))
+
+	var events []*encoding.Event
+	for i := 0; i < 3; i++ {
+		evt := testEvent(pid, uint64(i))
+		evt.Signature = make([]byte, 64)
+		events = append(events, evt)
+	}
+	require.Nil(e.EnsureSendGroupEvents(state, events[:2]))
+	require.Nil(e.EnsureSendGroupEvents(state, events))
+	waitFor(t, func() bool { return chain.inbound(state) == 3 })
+	require.Less(chain.balance(pub(payer)), uint64(1000000000))
+
+	evt := testEvent(pid, 0)
+	other := randomAddress()
+	chain.record(state, []string{
+		fmt.Sprintf("Program %s invoke [1]", program),
+		"Program log: Instruction: Mixin",
+		fmt.Sprintf("Program %s invoke [2]", other),
+		programDataLog(testEvent(pid, 7)),
+		fmt.Sprintf("Program %s success", other),
+		programDataLog(testEvent(uuid.Must(uuid.NewV4()).String(), 8)),
+		programDataLog(evt),
+		fmt.Sprintf("Program %s consumed 1000 of 200000 compute units", program),
+		fmt.Sprintf("Program %s success", program),
+	}, nil)
+	failed := chain.record(state, []string{
+		fmt.Sprintf("Program %s invoke [1]", program),
+		programDataLog(testEvent(pid, 1)),
+		fmt.Sprintf("Program %s failed: custom program error: 0x1", program),
+	}, json.RawMessage(`{"InstructionError":[0,{"Custom":1}]}`))
+
+	waitFor(t, func() bool {
+		return e.storeReadContractLogsOffset(state) == failed
+	})
+	evts, err := e.ReceiveGroupEvents(state, 0, 10)
+	require.Nil(err)
+	require.Len(evts, 1)
+	require.True(bytes.Equal(evt.Encode(), evts[0].Encode()))
+
+	cost, err := e.EstimateCost(evts)
+	require.Nil(err)
+	require.Equal(0, cost.Sign())
+
+	// the finalized transactions are never resent, even the failed ones
+	resend, err := e.checkSentTransaction(state, failed)
+	require.Nil(err)
+	require.False(resend)
+	resend, err = e.checkSentTransaction(state, base58.Encode(make([]byte, 64)))
+	require.Nil(err)
+	require.True(resend)
+}
+
+func TestSolanaEngineUnavailable(t *testing.T) {
+	require := require.New(t)
+	chain := newFakeSolana()
+	chain.outage = true
+	server := httptest.NewServer(chain)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e, err := Boot(ctx, &Configuration{Store: t.TempDir(), RPC: server.URL})
+	require.Nil(err)
+	defer e.Close()
+	defer cancel()
+
+	require.Equal(Platform, e.Platform())
+	vctx, vcancel := context.WithTimeout(context.Background(), time.Second)
+	defer vcancel()
+	err = e.VerifyAddress(vctx, randomAddress(), uuid.Must(uuid.NewV4()).String(), nil)
+	require.True(errors.Is(err, machine.ErrorEngineUnavailable))
+}
+
+func TestSolanaCompactLength(t *testing.T) {
+	require := require.New(t)
+
+	for _, n := range []int{0, 1, 127, 128, 255, 16383, 16384, 65535} {
+		b := compactLength(n)
+		m, l := readCompactLength(b)
+		require.Equal(n, m)
+		require.Equal(len(b), l)
+	}
+	require.Equal([]byte{0x80, 0x01}, compactLength(128))
+}
+
+func testEvent(pid string, nonce uint64) *encoding.Event {
+	return &encoding.Event{
+		Process:   pid,
+		Asset:     "c94ac88f-4671-3976-b60a-09064f1811e8",
+		Members:   []string{uuid.Must(uuid.NewV4()).String()},
+		Threshold: 1,
+		Amount:    common.NewIntegerFromString("1.5"),
+		Extra:     []byte("solana"),
+		Timestamp: uint64(time.Now().UnixNano()),
+		Nonce:     nonce,
+	}
+}
+
+func programDataLog(evt *encoding.Event) string {
+	return fmt.Sprintf("Program data: %s %s", EventLogTag, base64.StdEncoding.EncodeToString(evt.Encode()))
+}
+
+func randomAddress() string {
+	key, _, _ := ed25519.GenerateKey(rand.Reader)
+	return base58.Encode(key)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(60 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
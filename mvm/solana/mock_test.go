@@ -0,0 +1,264 @@
+package solana
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/btcsuite/btcutil/base58"
+)
+
+type fakeAccount struct {
+	owner      string
+	executable bool
+	lamports   uint64
+	data       []byte
+}
+
+type fakeTransaction struct {
+	err  json.RawMessage
+	logs []string
+}
+
+// fakeSolana is the local JSON-RPC stand-in of the Solana network, every
+// transaction is finalized at once, and executed by the reference program
+// layout without the signature verification of the events
+type fakeSolana struct {
+	sync.Mutex
+	accounts map[string]*fakeAccount
+	txs      map[string]*fakeTransaction
+	history  map[string][]string
+	slot     uint64
+
+	// the accounts are unavailable in an RPC outage
+	outage bool
+}
+
+func newFakeSolana() *fakeSolana {
+	return &fakeSolana{
+		accounts: make(map[string]*fakeAccount),
+		txs:      make(map[string]*fakeTransaction),
+		history:  make(map[string][]string),
+		slot:     1000,
+	}
+}
+
+func (s *fakeSolana) inbound(address string) uint64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return binary.LittleEndian.Uint64(s.accounts[address].data[StateInboundOffset:])
+}
+
+func (s *fakeSolana) balance(address string) uint64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.accounts[address].lamports
+}
+
+// record makes a finalized transaction of the address with the logs
+func (s *fakeSolana) record(address string, logs []string, err json.RawMessage) string {
+	s.Lock()
+	defer s.Unlock()
+
+	sig := make([]byte, 64)
+	rand.Read(sig)
+	id := base58.Encode(sig)
+	s.txs[id] = &fakeTransaction{err: err, logs: logs}
+	s.history[address] = append(s.history[address], id)
+	s.slot = s.slot + 1
+	return id
+}
+
+func (s *fakeSolana) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Id     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Lock()
+	result, err := s.handle(req.Method, req.Params)
+	s.Unlock()
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.Id}
+	if err != nil {
+		resp["error"] = map[string]interface{}{"code": -32002, "message": err.Error()}
+	} else {
+		resp["result"] = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *fakeSolana) handle(method string, params []json.RawMessage) (interface{}, error) {
+	var address string
+	if len(params) > 0 {
+		json.Unmarshal(params[0], &address)
+	}
+	switch method {
+	case "getSlot":
+		return s.slot, nil
+	case "getAccountInfo":
+		if s.outage {
+			return nil, fmt.Errorf("account %s unavailable", address)
+		}
+		a := s.accounts[address]
+		if a == nil {
+			return map[string]interface{}{"value": nil}, nil
+		}
+		return map[string]interface{}{"value": map[string]interface{}{
+			"owner":      a.owner,
+			"executable": a.executable,
+			"lamports":   a.lamports,
+			"data":       []string{base64.StdEncoding.EncodeToString(a.data), "base64"},
+		}}, nil
+	case "getBalance":
+		var lamports uint64
+		if a := s.accounts[address]; a != nil {
+			lamports = a.lamports
+		}
+		return map[string]interface{}{"value": lamports}, nil
+	case "getLatestBlockhash":
+		hash := make([]byte, 32)
+		binary.BigEndian.PutUint64(hash, s.slot)
+		return map[string]interface{}{"value": map[string]interface{}{"blockhash": base58.Encode(hash)}}, nil
+	case "getSignaturesForAddress":
+		var opts struct {
+			Before string `json:"before"`
+			Until  string `json:"until"`
+			Limit  int    `json:"limit"`
+		}
+		json.Unmarshal(params[1], &opts)
+		history := s.history[address]
+		sigs := []map[string]interface{}{}
+		skip := opts.Before != ""
+		for i := len(history) - 1; i >= 0 && len(sigs) < opts.Limit; i-- {
+			id := history[i]
+			if id == opts.Until {
+				break
+			}
+			if skip {
+				skip = id != opts.Before
+				continue
+			}
+			sigs = append(sigs, map[string]interface{}{"signature": id, "slot": s.slot, "err": s.txs[id].err})
+		}
+		return sigs, nil
+	case "getTransaction":
+		tx := s.txs[address]
+		if tx == nil {
+			return nil, nil
+		}
+		return map[string]interface{}{"meta": map[string]interface{}{"err": tx.err, "logMessages": tx.logs}}, nil
+	case "sendTransaction":
+		raw, err := base64.StdEncoding.DecodeString(address)
+		if err != nil {
+			return nil, err
+		}
+		return s.execute(raw)
+	}
+	return nil, fmt.Errorf("method %s not found", method)
+}
+
+// execute runs the single signer transaction built by the engine, with the
+// system transfer and the reference program mixin instruction
+func (s *fakeSolana) execute(raw []byte) (string, error) {
+	if len(raw) < 1+64+3+1 || raw[0] != 1 {
+		return "", fmt.Errorf("invalid transaction %x", raw)
+	}
+	sig, msg := raw[1:65], raw[65:]
+	if msg[0] != 1 || int(msg[3]) > 127 {
+		return "", fmt.Errorf("invalid message header %x", msg[:4])
+	}
+	n := int(msg[3])
+	var keys []string
+	for i := 0; i < n; i++ {
+		keys = append(keys, base58.Encode(msg[4+i*32:4+i*32+32]))
+	}
+	if !ed25519.Verify(base58.Decode(keys[0]), msg, sig) {
+		return "", fmt.Errorf("invalid signature")
+	}
+	rest := msg[4+n*32+32:]
+	count, rest := int(rest[0]), rest[1:]
+
+	var logs []string
+	var touched []string
+	changes := make(map[string]*fakeAccount)
+	account := func(k string) *fakeAccount {
+		if changes[k] == nil {
+			a := &fakeAccount{}
+			if old := s.accounts[k]; old != nil {
+				*a = *old
+				a.data = append([]byte{}, old.data...)
+			}
+			changes[k] = a
+		}
+		return changes[k]
+	}
+	for i := 0; i < count; i++ {
+		program := keys[rest[0]]
+		accounts := rest[2 : 2+int(rest[1])]
+		rest = rest[2+int(rest[1]):]
+		size, l := readCompactLength(rest)
+		data := rest[l : l+size]
+		rest = rest[l+size:]
+
+		from, to := account(keys[accounts[0]]), account(keys[accounts[1]])
+		touched = append(touched, keys[accounts[1]])
+		logs = append(logs, fmt.Sprintf("Program %s invoke [1]", program))
+		switch {
+		case program == SystemProgram:
+			amount := binary.LittleEndian.Uint64(data[4:])
+			if from.lamports < amount {
+				return "", fmt.Errorf("insufficient lamports %d", from.lamports)
+			}
+			from.lamports, to.lamports = from.lamports-amount, to.lamports+amount
+		case to.owner == program && data[0] == InstructionMixin:
+			evt, err := encoding.DecodeEvent(data[1:])
+			if err != nil {
+				return "", err
+			}
+			inbound := binary.LittleEndian.Uint64(to.data[StateInboundOffset:])
+			if evt.Nonce != inbound || len(evt.Signature) != 64 {
+				return "", fmt.Errorf("invalid event nonce %d %d", evt.Nonce, inbound)
+			}
+			binary.LittleEndian.PutUint64(to.data[StateInboundOffset:], inbound+1)
+		default:
+			return "", fmt.Errorf("invalid instruction %s %x", program, data)
+		}
+		logs = append(logs, fmt.Sprintf("Program %s success", program))
+	}
+	for k, a := range changes {
+		s.accounts[k] = a
+	}
+	id := base58.Encode(sig)
+	s.txs[id] = &fakeTransaction{logs: logs}
+	for _, k := range touched {
+		s.history[k] = append(s.history[k], id)
+	}
+	s.slot = s.slot + 1
+	return id, nil
+}
+
+func readCompactLength(b []byte) (int, int) {
+	var n, shift int
+	for i, c := range b {
+		n = n | int(c&0x7f)<<shift
+		if c&0x80 == 0 {
+			return n, i + 1
+		}
+		shift = shift + 7
+	}
+	panic(b)
+}
@@ -0,0 +1,216 @@
+package solana
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+)
+
+const (
+	// all reads are finalized, so the engine never handles the forks
+	commitmentFinalized = "finalized"
+)
+
+type RPC struct {
+	client *http.Client
+	host   string
+}
+
+type accountInfo struct {
+	Owner      string
+	Executable bool
+	Lamports   uint64
+	Data       []byte
+}
+
+type signatureInfo struct {
+	Signature string          `json:"signature"`
+	Slot      uint64          `json:"slot"`
+	Err       json.RawMessage `json:"err"`
+}
+
+type transactionMeta struct {
+	Err         json.RawMessage `json:"err"`
+	LogMessages []string        `json:"logMessages"`
+}
+
+func NewRPC(host string) (*RPC, error) {
+	chain := &RPC{
+		client: &http.Client{Timeout: 30 * time.Second},
+		host:   host,
+	}
+	_, err := chain.GetSlot()
+	if err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+func (chain *RPC) GetSlot() (uint64, error) {
+	var slot uint64
+	err := chain.call("getSlot", []interface{}{
+		map[string]interface{}{"commitment": commitmentFinalized},
+	}, &slot)
+	return slot, err
+}
+
+// GetAccountInfo returns nil if the account not found
+func (chain *RPC) GetAccountInfo(address string) (*accountInfo, error) {
+	var result struct {
+		Value *struct {
+			Owner      string   `json:"owner"`
+			Executable bool     `json:"executable"`
+			Lamports   uint64   `json:"lamports"`
+			Data       []string `json:"data"`
+		} `json:"value"`
+	}
+	err := chain.call("getAccountInfo", []interface{}{address, map[string]interface{}{
+		"encoding":   "base64",
+		"commitment": commitmentFinalized,
+	}}, &result)
+	if err != nil || result.Value == nil {
+		return nil, err
+	}
+	if len(result.Value.Data) != 2 || result.Value.Data[1] != "base64" {
+		return nil, fmt.Errorf("invalid account data %v", result.Value.Data)
+	}
+	data, err := base64.StdEncoding.DecodeString(result.Value.Data[0])
+	if err != nil {
+		return nil, err
+	}
+	return &accountInfo{
+		Owner:      result.Value.Owner,
+		Executable: result.Value.Executable,
+		Lamports:   result.Value.Lamports,
+		Data:       data,
+	}, nil
+}
+
+func (chain *RPC) GetBalance(address string) (uint64, error) {
+	var result struct {
+		Value uint64 `json:"value"`
+	}
+	err := chain.call("getBalance", []interface{}{address, map[string]interface{}{
+		"commitment": commitmentFinalized,
+	}}, &result)
+	return result.Value, err
+}
+
+func (chain *RPC) GetLatestBlockhash() (string, error) {
+	var result struct {
+		Value struct {
+			Blockhash string `json:"blockhash"`
+		} `json:"value"`
+	}
+	err := chain.call("getLatestBlockhash", []interface{}{map[string]interface{}{
+		"commitment": commitmentFinalized,
+	}}, &result)
+	if err != nil {
+		return "", err
+	}
+	if result.Value.Blockhash == "" {
+		return "", fmt.Errorf("invalid blockhash")
+	}
+	return result.Value.Blockhash, nil
+}
+
+// GetSignaturesForAddress lists the finalized transaction signatures of the
+// address before the signature and after the until one, the latest first
+func (chain *RPC) GetSignaturesForAddress(address, before, until string, limit int) ([]*signatureInfo, error) {
+	opts := map[string]interface{}{
+		"commitment": commitmentFinalized,
+		"limit":      limit,
+	}
+	if before != "" {
+		opts["before"] = before
+	}
+	if until != "" {
+		opts["until"] = until
+	}
+	var sigs []*signatureInfo
+	err := chain.call("getSignaturesForAddress", []interface{}{address, opts}, &sigs)
+	return sigs, err
+}
+
+// GetTransactionMeta returns nil if the transaction not found
+func (chain *RPC) GetTransactionMeta(signature string) (*transactionMeta, error) {
+	var result *struct {
+		Meta *transactionMeta `json:"meta"`
+	}
+	err := chain.call("getTransaction", []interface{}{signature, map[string]interface{}{
+		"encoding":                       "json",
+		"commitment":                     commitmentFinalized,
+		"maxSupportedTransactionVersion": 0,
+	}}, &result)
+	if err != nil || result == nil {
+		return nil, err
+	}
+	if result.Meta == nil {
+		return nil, fmt.Errorf("transaction %s meta not found", signature)
+	}
+	return result.Meta, nil
+}
+
+func (chain *RPC) SendTransaction(raw []byte) (string, error) {
+	var signature string
+	err := chain.call("sendTransaction", []interface{}{
+		base64.StdEncoding.EncodeToString(raw),
+		map[string]interface{}{"encoding": "base64"},
+	}, &signature)
+	return signature, err
+}
+
+func (chain *RPC) call(method string, params []interface{}, result interface{}) error {
+	data := map[string]interface{}{
+		"method":  method,
+		"params":  params,
+		"id":      time.Now().UnixNano(),
+		"jsonrpc": "2.0",
+	}
+
+	body := encoding.JSONMarshalPanic(data)
+	req, err := http.NewRequest("POST", chain.host, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Close = true
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := chain.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var res struct {
+		Result json.RawMessage `json:"result"`
+		Error  *SolanaError    `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(body, &res)
+	if err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	return json.Unmarshal(res.Result, result)
+}
+
+type SolanaError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (err *SolanaError) Error() string {
+	return fmt.Sprintf("RPC ERROR Solana %d %s", err.Code, err.Message)
+}
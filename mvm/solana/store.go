@@ -0,0 +1,197 @@
+package solana
+
+import (
+	"encoding/binary"
+
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/dgraph-io/badger/v3"
+)
+
+const (
+	prefixSolanaContractNotifier   = "SOLANA:CONTRACT:NOTIFIER:"
+	prefixSolanaContractProgram    = "SOLANA:CONTRACT:PROGRAM:"
+	prefixSolanaContractLogOffset  = "SOLANA:CONTRACT:LOG:OFFSET:"
+	prefixSolanaContractEventQueue = "SOLANA:CONTRACT:EVENT:QUEUE:"
+	prefixSolanaGroupEventQueue    = "SOLANA:GROUP:EVENT:QUEUE:"
+)
+
+// contractProgram is the program owning the contract state account, and
+// the process of the state
+type contractProgram struct {
+	Program string `json:"program"`
+	Process string `json:"process"`
+}
+
+func (e *Engine) storeWriteContractNotifier(address, notifier string, program *contractProgram) error {
+	key := []byte(prefixSolanaContractNotifier + address)
+	return e.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(key)
+		if err == nil {
+			panic(address)
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		pk := []byte(prefixSolanaContractProgram + address)
+		err = txn.Set(pk, encoding.JSONMarshalPanic(program))
+		if err != nil {
+			return err
+		}
+		return txn.Set(key, []byte(notifier))
+	})
+}
+
+func (e *Engine) storeReadContractNotifier(address string) string {
+	val := e.storeReadValue([]byte(prefixSolanaContractNotifier + address))
+	return string(val)
+}
+
+func (e *Engine) storeReadContractProgram(address string) *contractProgram {
+	val := e.storeReadValue([]byte(prefixSolanaContractProgram + address))
+	if val == nil {
+		return nil
+	}
+	var cp contractProgram
+	err := encoding.JSONUnmarshal(val, &cp)
+	if err != nil {
+		panic(err)
+	}
+	return &cp
+}
+
+func (e *Engine) storeListContractAddresses() ([]string, error) {
+	txn := e.db.NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(prefixSolanaContractNotifier)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var addresses []string
+	for it.Seek(opts.Prefix); it.Valid(); it.Next() {
+		key := string(it.Item().Key())
+		addr := key[len(prefixSolanaContractNotifier):]
+		addresses = append(addresses, addr)
+	}
+	return addresses, nil
+}
+
+// storeReadContractLogsOffset returns the latest transaction signature of
+// the contract with all its logs scanned
+func (e *Engine) storeReadContractLogsOffset(address string) string {
+	val := e.storeReadValue([]byte(prefixSolanaContractLogOffset + address))
+	return string(val)
+}
+
+// storeWriteContractEventsAndOffset writes the events scanned from the logs
+// of the transactions up to the signature
+func (e *Engine) storeWriteContractEventsAndOffset(address string, events []*encoding.Event, signature string) error {
+	return e.db.Update(func(txn *badger.Txn) error {
+		for _, evt := range events {
+			key := append([]byte(prefixSolanaContractEventQueue+address), uint64Bytes(evt.Nonce)...)
+			_, err := txn.Get(key)
+			if err == nil {
+				continue
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+			err = txn.Set(key, encoding.JSONMarshalPanic(evt))
+			if err != nil {
+				return err
+			}
+		}
+		key := []byte(prefixSolanaContractLogOffset + address)
+		return txn.Set(key, []byte(signature))
+	})
+}
+
+func (e *Engine) storeListContractEvents(address string, offset uint64, limit int) ([]*encoding.Event, error) {
+	return e.storeListEvents(prefixSolanaContractEventQueue+address, offset, limit)
+}
+
+func (e *Engine) storeWriteGroupEvents(address string, events []*encoding.Event) error {
+	return e.db.Update(func(txn *badger.Txn) error {
+		for _, evt := range events {
+			key := []byte(prefixSolanaGroupEventQueue + address)
+			key = append(key, uint64Bytes(evt.Nonce)...)
+			_, err := txn.Get(key)
+			if err == nil {
+				continue
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+			err = txn.Set(key, encoding.JSONMarshalPanic(evt))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *Engine) storeListGroupEvents(address string, offset uint64, limit int) ([]*encoding.Event, error) {
+	return e.storeListEvents(prefixSolanaGroupEventQueue+address, offset, limit)
+}
+
+func (e *Engine) storeListEvents(prefix string, offset uint64, limit int) ([]*encoding.Event, error) {
+	txn := e.db.NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(prefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var events []*encoding.Event
+	it.Seek(append(opts.Prefix, uint64Bytes(offset)...))
+	for ; it.Valid(); it.Next() {
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		var evt encoding.Event
+		err = encoding.JSONUnmarshal(val, &evt)
+		if err != nil {
+			panic(err)
+		}
+		events = append(events, &evt)
+		if len(events) >= limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+func (e *Engine) storeReadValue(key []byte) []byte {
+	txn := e.db.NewTransaction(false)
+	defer txn.Discard()
+
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+func uint64Bytes(i uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, i)
+	return buf
+}
+
+func openBadger(dir string) *badger.DB {
+	opts := badger.DefaultOptions(dir)
+	db, err := badger.Open(opts)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
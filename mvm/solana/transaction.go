@@ -0,0 +1,118 @@
+package solana
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/btcsuite/btcutil/base58"
+)
+
+const (
+	SystemProgram = "11111111111111111111111111111111"
+
+	// the instruction tag of the system program transfer
+	systemInstructionTransfer = 2
+
+	// the maximum serialized transaction size of the network
+	transactionSizeLimit = 1232
+)
+
+// buildTransaction signs a legacy transaction with the instructions to the
+// program, the payer is the only signer, and all instructions have the payer
+// as the account 0 and the writable account as the account 1
+//
+// 1 || signature || 1 || 0 || 1 || 3 || payer || account || program ||
+// blockhash || len(instructions) || [2 || 2 || 0 || 1 || len(data) || data]
+func buildTransaction(payer ed25519.PrivateKey, account, program string, instructions [][]byte, blockhash string) ([]byte, string, error) {
+	keys := [][]byte{payer.Public().(ed25519.PublicKey)}
+	for _, k := range []string{account, program, blockhash} {
+		b, err := decodePublicKey(k)
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, b)
+	}
+
+	msg := []byte{1, 0, 1}
+	msg = append(msg, compactLength(3)...)
+	for _, k := range keys {
+		msg = append(msg, k...)
+	}
+	msg = append(msg, compactLength(len(instructions))...)
+	for _, data := range instructions {
+		msg = append(msg, 2)
+		msg = append(msg, compactLength(2)...)
+		msg = append(msg, 0, 1)
+		msg = append(msg, compactLength(len(data))...)
+		msg = append(msg, data...)
+	}
+
+	sig := ed25519.Sign(payer, msg)
+	raw := append(compactLength(1), sig...)
+	raw = append(raw, msg...)
+	if len(raw) > transactionSizeLimit {
+		return nil, "", fmt.Errorf("transaction too large %d", len(raw))
+	}
+	return raw, base58.Encode(sig), nil
+}
+
+// buildGroupEventInstruction encodes the mixin instruction of the program
+//
+// 0 || event
+func buildGroupEventInstruction(evt *encoding.Event) []byte {
+	return append([]byte{InstructionMixin}, evt.Encode()...)
+}
+
+func buildTransferInstruction(lamports uint64) []byte {
+	data := make([]byte, 12)
+	binary.LittleEndian.PutUint32(data, systemInstructionTransfer)
+	binary.LittleEndian.PutUint64(data[4:], lamports)
+	return data
+}
+
+// compactLength is the compact-u16 encoding of the array lengths
+func compactLength(n int) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n = n >> 7
+		if n == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// deriveKey derives the ed25519 key from the seed, the notifiers of all
+// contracts are derived from the publisher key
+func deriveKey(seed []byte) ed25519.PrivateKey {
+	h := sha256.Sum256(seed)
+	return ed25519.NewKeyFromSeed(h[:])
+}
+
+func decodePrivateKey(s string) (ed25519.PrivateKey, error) {
+	b := base58.Decode(s)
+	if len(b) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid private key length %d", len(b))
+	}
+	key := ed25519.NewKeyFromSeed(b[:ed25519.SeedSize])
+	if !key.Equal(ed25519.PrivateKey(b)) {
+		return nil, fmt.Errorf("invalid private key")
+	}
+	return key, nil
+}
+
+func decodePublicKey(s string) ([]byte, error) {
+	b := base58.Decode(s)
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid address %s", s)
+	}
+	return b, nil
+}
+
+func pub(key ed25519.PrivateKey) string {
+	return base58.Encode(key.Public().(ed25519.PublicKey))
+}
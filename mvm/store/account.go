@@ -1,6 +1,8 @@
 package store
 
 import (
+	"fmt"
+
 	"github.com/MixinNetwork/mixin/common"
 	"github.com/MixinNetwork/trusted-group/mvm/encoding"
 	"github.com/MixinNetwork/trusted-group/mvm/machine"
@@ -17,7 +19,7 @@ func (bs *BadgerStore) CheckAccountSnapshot(as *machine.AccountSnapshot) (bool,
 	txn := bs.Badger().NewTransaction(false)
 	defer txn.Discard()
 	if as.Credit {
-		panic(as.Amount)
+		return false, fmt.Errorf("invalid credit snapshot check %s:%d", as.Process, as.Nonce)
 	}
 
 	ask := buildAccountSnapshotKey(as)
@@ -50,7 +52,7 @@ func (bs *BadgerStore) WriteAccountSnapshot(as *machine.AccountSnapshot) error {
 			return err
 		}
 		if !as.Credit && bal.Cmp(as.Amount) < 0 {
-			panic(bal)
+			return fmt.Errorf("insufficient balance %s %s %s", as.Process, bal, as.Amount)
 		}
 		if as.Credit {
 			bal = bal.Add(as.Amount)
@@ -67,6 +69,36 @@ func (bs *BadgerStore) WriteAccountSnapshot(as *machine.AccountSnapshot) error {
 	})
 }
 
+func (bs *BadgerStore) ReadAccountBalance(pid, asset string) (common.Integer, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	return bs.readAccountBalance(txn, pid, asset)
+}
+
+func (bs *BadgerStore) ListAccountBalances(pid string) (map[string]common.Integer, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(prefixAccountBalance + pid)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	balances := make(map[string]common.Integer)
+	for it.Seek(opts.Prefix); it.Valid(); it.Next() {
+		key := string(it.Item().Key())
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		asset := key[len(opts.Prefix):]
+		balances[asset] = common.NewIntegerFromString(string(val))
+	}
+	return balances, nil
+}
+
 func (bs *BadgerStore) readAccountBalance(txn *badger.Txn, pid, asset string) (common.Integer, error) {
 	key := buildAccountBalanceKey(pid, asset)
 	item, err := txn.Get(key)
@@ -7,7 +7,8 @@ import (
 )
 
 const (
-	prefixAssetMeta = "MVM:ASSET:META:"
+	prefixAssetMeta        = "MVM:ASSET:META:"
+	prefixCollectibleToken = "MVM:COLLECTIBLE:TOKEN:"
 )
 
 func (bs *BadgerStore) ReadAsset(id string) (*machine.Asset, error) {
@@ -50,3 +51,29 @@ func buildAssetMetaKey(id string) []byte {
 	key := prefixAssetMeta + id
 	return []byte(key)
 }
+
+func (bs *BadgerStore) ReadCollectibleToken(id string) (*machine.CollectibleToken, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	item, err := txn.Get([]byte(prefixCollectibleToken + id))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	var t machine.CollectibleToken
+	err = encoding.JSONUnmarshal(val, &t)
+	return &t, err
+}
+
+func (bs *BadgerStore) WriteCollectibleToken(t *machine.CollectibleToken) error {
+	return bs.Badger().Update(func(txn *badger.Txn) error {
+		key := []byte(prefixCollectibleToken + t.Id)
+		return txn.Set(key, encoding.JSONMarshalPanic(t))
+	})
+}
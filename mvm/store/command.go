@@ -0,0 +1,62 @@
+package store
+
+import (
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/dgraph-io/badger/v3"
+)
+
+const (
+	prefixGroupCommand = "MVM:GROUP:COMMAND:"
+)
+
+func (bs *BadgerStore) ReadGroupCommand(id string) (*machine.GroupCommand, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	item, err := txn.Get([]byte(prefixGroupCommand + id))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	var c machine.GroupCommand
+	err = encoding.JSONUnmarshal(val, &c)
+	return &c, err
+}
+
+func (bs *BadgerStore) WriteGroupCommand(c *machine.GroupCommand) error {
+	return bs.Badger().Update(func(txn *badger.Txn) error {
+		key := []byte(prefixGroupCommand + c.Id)
+		return txn.Set(key, encoding.JSONMarshalPanic(c))
+	})
+}
+
+func (bs *BadgerStore) ListGroupCommands() ([]*machine.GroupCommand, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(prefixGroupCommand)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var commands []*machine.GroupCommand
+	for it.Seek(opts.Prefix); it.Valid(); it.Next() {
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		var c machine.GroupCommand
+		err = encoding.JSONUnmarshal(val, &c)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, &c)
+	}
+	return commands, nil
+}
@@ -29,13 +29,13 @@ func (bs *BadgerStore) CheckPendingGroupEventIdentifier(id string) (bool, error)
 func (bs *BadgerStore) WritePendingGroupEventAndNonce(event *encoding.Event, id string, sigType int) error {
 	return bs.Badger().Update(func(txn *badger.Txn) error {
 		if event.Timestamp <= 0 {
-			panic(event.Timestamp)
+			return fmt.Errorf("%w: timestamp %d", machine.ErrorInvalidEvent, event.Timestamp)
 		}
 		ts, err := bs.readPendingGroupEventIdentifier(txn, id)
 		if err != nil {
 			return err
 		} else if ts > 0 {
-			panic(id)
+			return fmt.Errorf("pending event identifier %s exists", id)
 		}
 		err = bs.writePendingGroupEventIdentifier(txn, id, event.Timestamp)
 		if err != nil {
@@ -46,8 +46,8 @@ func (bs *BadgerStore) WritePendingGroupEventAndNonce(event *encoding.Event, id
 		if err != nil {
 			return err
 		}
-		if proc.Nonce != event.Nonce {
-			panic(event)
+		if proc == nil || proc.Nonce != event.Nonce {
+			return fmt.Errorf("%w: nonce %s:%d", machine.ErrorInvalidEvent, event.Process, event.Nonce)
 		}
 		proc.Nonce = proc.Nonce + 1
 		err = bs.writeProcess(txn, proc)
@@ -95,6 +95,82 @@ func (bs *BadgerStore) ListPendingGroupEvents(limit int) ([]*encoding.Event, err
 	return evts, nil
 }
 
+func (bs *BadgerStore) ListProcessPendingGroupEvents(pid string, limit int) ([]*encoding.Event, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(prefixPendingEventQueue)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var evts []*encoding.Event
+	for it.Seek(opts.Prefix); it.Valid(); it.Next() {
+		key := it.Item().Key()
+		if string(key[len(opts.Prefix)+8:len(key)-8]) != pid {
+			continue
+		}
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		var evt encoding.Event
+		err = encoding.JSONUnmarshal(val, &evt)
+		if err != nil {
+			return nil, err
+		}
+		evts = append(evts, &evt)
+		if len(evts) == limit {
+			break
+		}
+	}
+	return evts, nil
+}
+
+// ReadGroupEvent returns the event still in the signed or pending queue,
+// nil if the event has been sent to the engine or never existed
+func (bs *BadgerStore) ReadGroupEvent(pid string, nonce uint64) (*encoding.Event, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	key := buildSignedEventTimedKey(pid, nonce)
+	item, err := txn.Get(key)
+	if err == nil {
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		var evt encoding.Event
+		err = encoding.JSONUnmarshal(val, &evt)
+		return &evt, err
+	} else if err != badger.ErrKeyNotFound {
+		return nil, err
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(prefixPendingEventQueue)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	suffix := append([]byte(pid), uint64Bytes(nonce)...)
+	for it.Seek(opts.Prefix); it.Valid(); it.Next() {
+		key := it.Item().Key()
+		if string(key[len(opts.Prefix)+8:]) != string(suffix) {
+			continue
+		}
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		var evt encoding.Event
+		err = encoding.JSONUnmarshal(val, &evt)
+		return &evt, err
+	}
+	return nil, nil
+}
+
 func (bs *BadgerStore) ReadGroupEventSignatures(pid string, nonce uint64, signType int) ([][]byte, bool, error) {
 	txn := bs.Badger().NewTransaction(false)
 	defer txn.Discard()
@@ -110,31 +186,19 @@ func (bs *BadgerStore) ReadGroupEventSignatures(pid string, nonce uint64, signTy
 	if err != nil {
 		return nil, false, err
 	}
-	if signType == machine.SignTypeTBLS {
-		if len(val) == 64 {
-			return [][]byte{val}, true, nil
-		}
-		sigs := make([][]byte, len(val)/66)
-		for i := 0; i < len(sigs); i++ {
-			sigs[i] = val[i*66 : (i+1)*66]
-		}
-		return sigs, false, nil
-	} else if signType == machine.SignTypeSECP256K1 {
-		sigs := make([][]byte, len(val)/65)
-		for i := 0; i < len(sigs); i++ {
-			sigs[i] = val[i*65 : (i+1)*65]
-		}
-		if len(val)%65 == 1 {
-			return sigs, true, nil
-		} else {
-			return sigs, false, nil
-		}
-	} else {
-		panic(fmt.Errorf("unknown signType: %d", signType))
+	scheme := machine.GetSignatureScheme(signType)
+	if scheme == nil {
+		return nil, false, fmt.Errorf("unknown signType: %d", signType)
 	}
+	sigs, full := scheme.DecodeSignatures(val)
+	return sigs, full, nil
 }
 
 func (bs *BadgerStore) WritePendingGroupEventSignatures(pid string, nonce uint64, partials [][]byte, signType int) error {
+	scheme := machine.GetSignatureScheme(signType)
+	if scheme == nil {
+		return fmt.Errorf("unknown signType: %d", signType)
+	}
 	return bs.Badger().Update(func(txn *badger.Txn) error {
 		full, err := bs.checkSignedEvent(txn, pid, nonce, signType)
 		if err != nil || full {
@@ -143,14 +207,8 @@ func (bs *BadgerStore) WritePendingGroupEventSignatures(pid string, nonce uint64
 
 		var val []byte
 		for _, p := range partials {
-			if machine.SignTypeTBLS == signType {
-				if len(p) != 66 {
-					panic(hex.EncodeToString(p))
-				}
-			} else if machine.SignTypeSECP256K1 == signType {
-				if len(p) != 65 {
-					panic(hex.EncodeToString(p))
-				}
+			if len(p) != scheme.PartialSize {
+				return fmt.Errorf("invalid partial signature %s", hex.EncodeToString(p))
 			}
 			val = append(val, p...)
 		}
@@ -162,7 +220,7 @@ func (bs *BadgerStore) WritePendingGroupEventSignatures(pid string, nonce uint64
 func (bs *BadgerStore) WriteSignedGroupEventAndExpirePending(event *encoding.Event, signType int) error {
 	return bs.Badger().Update(func(txn *badger.Txn) error {
 		if !checkFullSignature(event.Signature, signType) {
-			panic(hex.EncodeToString(event.Signature))
+			return fmt.Errorf("invalid full signature %s", hex.EncodeToString(event.Signature))
 		}
 		full, err := bs.checkSignedEvent(txn, event.Process, event.Nonce, signType)
 		if err != nil || full {
@@ -215,6 +273,34 @@ func (bs *BadgerStore) ListSignedGroupEvents(pid string, limit int) ([]*encoding
 	return evts, nil
 }
 
+// CountGroupEvents counts the pending and signed queue depth of each process
+func (bs *BadgerStore) CountGroupEvents() (map[string]int, map[string]int, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	pending := make(map[string]int)
+	prefix := []byte(prefixPendingEventQueue)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().Key()
+		pid := string(key[len(prefix)+8 : len(key)-8])
+		pending[pid] = pending[pid] + 1
+	}
+
+	signed := make(map[string]int)
+	prefix = []byte(prefixSignedEventQueue)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().Key()
+		pid := string(key[len(prefix) : len(key)-8])
+		signed[pid] = signed[pid] + 1
+	}
+	return pending, signed, nil
+}
+
 func (bs *BadgerStore) ExpireGroupEventsWithCost(events []*encoding.Event, cost common.Integer) error {
 	if len(events) == 0 {
 		return nil
@@ -223,7 +309,7 @@ func (bs *BadgerStore) ExpireGroupEventsWithCost(events []*encoding.Event, cost
 	return bs.Badger().Update(func(txn *badger.Txn) error {
 		for _, evt := range events {
 			if evt.Process != pid {
-				panic(evt.Process)
+				return fmt.Errorf("invalid events process %s %s", pid, evt.Process)
 			}
 			key := buildSignedEventTimedKey(evt.Process, evt.Nonce)
 			err := txn.Delete(key)
@@ -300,11 +386,6 @@ func buildSignedEventTimedKey(pid string, nonce uint64) []byte {
 }
 
 func checkFullSignature(val []byte, sigType int) bool {
-	if sigType == machine.SignTypeTBLS {
-		return len(val) == 64
-	} else if sigType == machine.SignTypeSECP256K1 {
-		return len(val)%65 == 1
-	} else {
-		panic(sigType)
-	}
+	scheme := machine.GetSignatureScheme(sigType)
+	return scheme != nil && scheme.CheckFull(val)
 }
@@ -0,0 +1,30 @@
+package store
+
+import (
+	"github.com/dgraph-io/badger/v3"
+)
+
+const (
+	prefixUserMask = "MVM:USER:MASK:"
+)
+
+func (bs *BadgerStore) WriteUserMask(pid, user, mask string) error {
+	return bs.Badger().Update(func(txn *badger.Txn) error {
+		key := []byte(prefixUserMask + pid + mask)
+		return txn.Set(key, []byte(user))
+	})
+}
+
+func (bs *BadgerStore) ReadMaskedUser(pid, mask string) (string, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	item, err := txn.Get([]byte(prefixUserMask + pid + mask))
+	if err == badger.ErrKeyNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	val, err := item.ValueCopy(nil)
+	return string(val), err
+}
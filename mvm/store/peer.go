@@ -0,0 +1,95 @@
+package store
+
+import (
+	"time"
+
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/dgraph-io/badger/v3"
+)
+
+const (
+	prefixPeerMisbehavior = "MVM:PEER:MISBEHAVIOR:"
+	prefixPeerEnvelope    = "MVM:PEER:ENVELOPE:"
+
+	// the misbehaviors are only the reports to the operators, so they expire
+	// to keep the store bounded
+	peerMisbehaviorTTL = 30 * 24 * time.Hour
+)
+
+func (bs *BadgerStore) WritePeerMisbehavior(pm *machine.PeerMisbehavior) error {
+	return bs.Badger().Update(func(txn *badger.Txn) error {
+		key := append([]byte(prefixPeerMisbehavior), pm.Peer...)
+		key = append(key, uint64Bytes(uint64(pm.CreatedAt.UnixNano()))...)
+		val := encoding.JSONMarshalPanic(pm)
+		return txn.SetEntry(badger.NewEntry(key, val).WithTTL(peerMisbehaviorTTL))
+	})
+}
+
+// ListPeerMisbehaviors lists the latest misbehaviors of the peer first
+func (bs *BadgerStore) ListPeerMisbehaviors(peer string, limit int) ([]*machine.PeerMisbehavior, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = true
+	opts.Prefix = append([]byte(prefixPeerMisbehavior), peer...)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var pms []*machine.PeerMisbehavior
+	seek := append(opts.Prefix, uint64Bytes(^uint64(0))...)
+	for it.Seek(seek); it.Valid(); it.Next() {
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		var pm machine.PeerMisbehavior
+		err = encoding.JSONUnmarshal(val, &pm)
+		if err != nil {
+			return nil, err
+		}
+		pms = append(pms, &pm)
+		if len(pms) == limit {
+			break
+		}
+	}
+	return pms, nil
+}
+
+// WritePeerEnvelope writes the peer accepts the envelope, and whether it sent
+// the envelope already, so the capability survives the restart
+func (bs *BadgerStore) WritePeerEnvelope(peer string, enveloped bool) error {
+	return bs.Badger().Update(func(txn *badger.Txn) error {
+		key := append([]byte(prefixPeerEnvelope), peer...)
+		val := []byte{0}
+		if enveloped {
+			val[0] = 1
+		}
+		return txn.Set(key, val)
+	})
+}
+
+// ListPeerEnvelopes lists the peers accepting the envelope, and whether each
+// peer sent the envelope
+func (bs *BadgerStore) ListPeerEnvelopes() (map[string]bool, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(prefixPeerEnvelope)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	peers := make(map[string]bool)
+	for it.Seek(opts.Prefix); it.Valid(); it.Next() {
+		item := it.Item()
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		peer := string(item.Key()[len(opts.Prefix):])
+		peers[peer] = len(val) > 0 && val[0] == 1
+	}
+	return peers, nil
+}
@@ -2,7 +2,9 @@ package store
 
 import (
 	"encoding/binary"
+	"fmt"
 
+	"github.com/MixinNetwork/mixin/common"
 	"github.com/MixinNetwork/trusted-group/mvm/encoding"
 	"github.com/MixinNetwork/trusted-group/mvm/machine"
 	"github.com/dgraph-io/badger/v3"
@@ -11,6 +13,7 @@ import (
 const (
 	prefixProcessPayload          = "MVM:PROCESS:PAYLOAD:"
 	prefixEngineGroupEventsOffset = "MVM:ENGINE:GROUP:EVENTS:OFFSET:"
+	prefixProcessCreditIdentifier = "MVM:PROCESS:CREDIT:IDENTIFIER:"
 )
 
 func (bs *BadgerStore) ReadEngineGroupEventsOffset(pid string) (uint64, error) {
@@ -36,6 +39,13 @@ func (bs *BadgerStore) WriteEngineGroupEventsOffset(pid string, offset uint64) e
 	})
 }
 
+func (bs *BadgerStore) ReadProcess(pid string) (*machine.Process, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	return bs.readProcess(txn, pid)
+}
+
 func (bs *BadgerStore) ListProcesses() ([]*machine.Process, error) {
 	txn := bs.Badger().NewTransaction(false)
 	defer txn.Discard()
@@ -72,6 +82,52 @@ func (bs *BadgerStore) WriteProcess(p *machine.Process) error {
 	})
 }
 
+// WriteProcessState switches the process to the address, and halts or
+// resumes it, the credit and nonce are kept
+func (bs *BadgerStore) WriteProcessState(pid string, address string, halted bool) error {
+	return bs.Badger().Update(func(txn *badger.Txn) error {
+		proc, err := bs.readProcess(txn, pid)
+		if err != nil {
+			return err
+		} else if proc == nil {
+			return fmt.Errorf("process %s not found", pid)
+		}
+		proc.Address = address
+		proc.Halted = halted
+		return bs.writeProcess(txn, proc)
+	})
+}
+
+func (bs *BadgerStore) WriteProcessCredit(pid string, amount common.Integer, id string) (common.Integer, error) {
+	var credit common.Integer
+	err := bs.Badger().Update(func(txn *badger.Txn) error {
+		proc, err := bs.readProcess(txn, pid)
+		if err != nil {
+			return err
+		} else if proc == nil {
+			return fmt.Errorf("process %s not found", pid)
+		}
+		credit = proc.Credit
+
+		key := append([]byte(prefixProcessCreditIdentifier), id...)
+		_, err = txn.Get(key)
+		if err == nil {
+			return nil
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		err = txn.Set(key, []byte(amount.String()))
+		if err != nil {
+			return err
+		}
+
+		proc.Credit = proc.Credit.Add(amount)
+		credit = proc.Credit
+		return bs.writeProcess(txn, proc)
+	})
+	return credit, err
+}
+
 func (bs *BadgerStore) writeProcess(txn *badger.Txn, p *machine.Process) error {
 	key := []byte(prefixProcessPayload + p.Identifier)
 	val := encoding.JSONMarshalPanic(p)
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/dgraph-io/badger/v3"
+)
+
+const (
+	prefixQuarantinedEvent = "MVM:EVENT:QUARANTINE:"
+)
+
+func (bs *BadgerStore) WriteQuarantinedEvent(qe *machine.QuarantinedEvent) error {
+	return bs.Badger().Update(func(txn *badger.Txn) error {
+		key := buildQuarantinedEventKey(qe.Process, qe.Nonce, qe.Stage, qe.Output)
+		val := encoding.JSONMarshalPanic(qe)
+		return txn.Set(key, val)
+	})
+}
+
+func (bs *BadgerStore) ListQuarantinedEvents(pid string, limit int) ([]*machine.QuarantinedEvent, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = append([]byte(prefixQuarantinedEvent), pid...)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var qes []*machine.QuarantinedEvent
+	for it.Seek(opts.Prefix); it.Valid(); it.Next() {
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		var qe machine.QuarantinedEvent
+		err = encoding.JSONUnmarshal(val, &qe)
+		if err != nil {
+			return nil, err
+		}
+		qes = append(qes, &qe)
+		if len(qes) == limit {
+			break
+		}
+	}
+	return qes, nil
+}
+
+func buildQuarantinedEventKey(pid string, nonce uint64, stage, output string) []byte {
+	key := append([]byte(prefixQuarantinedEvent), pid...)
+	key = append(key, uint64Bytes(nonce)...)
+	key = append(key, stage...)
+	return append(key, output...)
+}
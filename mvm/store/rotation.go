@@ -0,0 +1,38 @@
+package store
+
+import (
+	"github.com/MixinNetwork/trusted-group/mvm/encoding"
+	"github.com/MixinNetwork/trusted-group/mvm/machine"
+	"github.com/dgraph-io/badger/v3"
+)
+
+const (
+	prefixGroupRotation = "MVM:GROUP:ROTATION:"
+)
+
+func (bs *BadgerStore) ReadGroupRotation(group []byte) (*machine.GroupRotation, error) {
+	txn := bs.Badger().NewTransaction(false)
+	defer txn.Discard()
+
+	key := append([]byte(prefixGroupRotation), group...)
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	var r machine.GroupRotation
+	err = encoding.JSONUnmarshal(val, &r)
+	return &r, err
+}
+
+func (bs *BadgerStore) WriteGroupRotation(r *machine.GroupRotation) error {
+	return bs.Badger().Update(func(txn *badger.Txn) error {
+		key := append([]byte(prefixGroupRotation), r.Group...)
+		return txn.Set(key, encoding.JSONMarshalPanic(r))
+	})
+}